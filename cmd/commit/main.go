@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/internal/layer"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func main() {
+	
+	// Parse our command-line flags
+	baseReference := flag.String("base", "", "the org.opencontainers.image.ref.name annotation or digest of the base image (defaults to the image for the host platform)")
+	refName := flag.String("ref", "", "the org.opencontainers.image.ref.name annotation for the new image")
+	compression := flag.String("compression", "gzip", "the codec used to compress the new layer (none, gzip or zstd)")
+	createdBy := flag.String("created-by", "", "the command that produced the new layer, as recorded in the image history")
+	uidMap := flag.String("uidmap", "", "the user ID mappings to apply when unpacking and committing, in the format containerID:hostID:size[,...]")
+	gidMap := flag.String("gidmap", "", "the group ID mappings to apply when unpacking and committing, in the format containerID:hostID:size[,...]")
+	subuid := flag.String("subuid", "", "map root in the container to the specified user and the remaining IDs to their subordinate ID ranges from /etc/subuid and /etc/subgid when unpacking and committing (requires root)")
+	opaqueThreshold := flag.Float64("opaque-threshold", 0, "the fraction of a directory's original entries that must be removed or replaced before an opaque whiteout is generated (defaults to 0, which disables opaque whiteouts, whilst 1 requires every original entry to have been removed or replaced)")
+	sourceDateEpoch := flag.String("source-date-epoch", os.Getenv("SOURCE_DATE_EPOCH"), "the latest timestamp recorded in the new layer and the creation time of the new image, in seconds since the Unix epoch (defaults to $SOURCE_DATE_EPOCH)")
+	xattrAllow := flag.String("xattr-allow", "", "the name prefixes of the extended attributes to extract, compare and commit, separated by commas (defaults to all attributes)")
+	xattrDeny := flag.String("xattr-deny", "", "the name prefixes of the extended attributes to ignore, separated by commas (defaults to the security and trusted namespaces when not running as root)")
+	compareContents := flag.Bool("compare-contents", false, "compare the contents of files whose size and modification time are unchanged, for modified files whose timestamps are unreliable")
+	flag.Parse()
+	if len(flag.Args()) < 3 {
+		fmt.Println("Usage: commit [-base <REFERENCE>] [-ref <NAME>] [-compression <CODEC>] [-created-by <COMMAND>] [-uidmap <MAP> -gidmap <MAP> | -subuid <USER>] [-compare-contents] [-opaque-threshold <FRACTION>] [-source-date-epoch <SECONDS>] [-xattr-allow <PREFIXES>] [-xattr-deny <PREFIXES>] <IMAGE_DIR> <UNPACK_DIR> <MODIFIED_DIR> [<DIFF_DIR>]")
+		fmt.Println("(If DIFF_DIR is omitted then the new layer is written directly from the modified files without populating a diff directory)")
+		os.Exit(0)
+	}
+	
+	// Retrieve the directory paths
+	imageDir := flag.Args()[0]
+	unpackDir := flag.Args()[1]
+	modifiedDir := flag.Args()[2]
+	diffDir := ""
+	if len(flag.Args()) > 3 {
+		diffDir = flag.Args()[3]
+	}
+	
+	// Stop cleanly if we receive an interrupt signal
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	
+	// Parse the ID mappings, if any were specified, or create the mappings for a user's subordinate IDs
+	mappings, err := layer.ParseIDMappings(*uidMap, *gidMap)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if *subuid != "" {
+		if mappings != nil {
+			fmt.Println("Error: -subuid cannot be combined with -uidmap and -gidmap")
+			os.Exit(1)
+		}
+		if mappings, err = layer.SubordinateIDMappingsForUser(*subuid); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+	}
+	
+	// Parse the extended attribute filter, if one was specified
+	xattrs := layer.ParseXattrFilter(*xattrAllow, *xattrDeny)
+	
+	// Parse the source date epoch, if one was specified
+	epoch, err := layer.ParseSourceDateEpoch(*sourceDateEpoch)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	
+	// Create an ImageUnpacker for the image
+	unpacker, err := image.UnpackerForImage(imageDir, unpackDir)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	unpacker.IDMappings = mappings
+	unpacker.Xattrs = xattrs
+	
+	// Unpack the base image, reusing any layers that have already been unpacked
+	var base *image.UnpackedImage
+	if *baseReference != "" {
+		base, err = unpacker.UnpackReferenceContext(ctx, *baseReference, nil)
+	} else {
+		base, err = unpacker.UnpackContext(ctx, nil)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	
+	// Determine the merged contents of the base image, using an empty directory if the base image has no layers
+	baseDir := ""
+	if len(base.Layers) > 0 {
+		baseDir = base.Layers[len(base.Layers) - 1].MergedDir
+	} else {
+		if baseDir, err = os.MkdirTemp("", "empty-base-"); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		defer os.Remove(baseDir)
+	}
+	
+	// Create a DiffGenerator to compare the merged contents of the base image to the modified files
+	generator := &layer.DiffGenerator{
+		BaseDir: baseDir,
+		ModifiedDir: modifiedDir,
+		DiffDir: diffDir,
+		CompareContents: *compareContents,
+		OpaqueWhiteoutThreshold: *opaqueThreshold,
+		Xattrs: xattrs,
+	}
+	options := image.CommitOptions{
+		Compression: *compression,
+		RefName: *refName,
+		CreatedBy: *createdBy,
+		SourceDateEpoch: epoch,
+	}
+	
+	// If no diff directory was specified then write the new layer directly from the modified files
+	var descriptor oci.Descriptor
+	if diffDir == "" {
+		descriptor, err = unpacker.CommitModified(ctx, base, generator, options)
+	} else {
+		
+		// Generate the diff
+		if err := os.MkdirAll(diffDir, os.ModePerm); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		if err := <-generator.DiffRecursiveContext(ctx, "", nil, false); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		
+		// Commit the diff as a new layer
+		descriptor, err = unpacker.Commit(ctx, base, diffDir, options)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	
+	fmt.Println("Committed image manifest", descriptor.Digest)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/macoscontainers/experiments/internal/image"
+)
+
+func main() {
+	
+	// Parse our command-line flags
+	reference := flag.String("ref", "", "the org.opencontainers.image.ref.name annotation or digest of the image to export (defaults to all images)")
+	flag.Parse()
+	if len(flag.Args()) < 2 {
+		fmt.Println("Usage: export [-ref <REFERENCE>] <IMAGE_DIR|IMAGE_ARCHIVE> <OUTPUT_ARCHIVE>")
+		os.Exit(0)
+	}
+	
+	// Stop cleanly if we receive an interrupt signal
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	
+	// Create an ImageUnpacker for the image
+	unpacker, err := image.UnpackerForPath(flag.Args()[0], "")
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	defer unpacker.Close()
+	
+	// Create the output archive
+	output, err := os.Create(flag.Args()[1])
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	
+	// Export the image, removing the incomplete output archive if an error occurs
+	if err := unpacker.ExportArchive(ctx, *reference, output); err != nil {
+		output.Close()
+		os.Remove(flag.Args()[1])
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if err := output.Close(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	
+	fmt.Println("Exported image to", flag.Args()[1])
+}
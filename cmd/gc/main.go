@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/macoscontainers/experiments/internal/image"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func main() {
+	
+	// Parse our command-line flags
+	dryRun := flag.Bool("dry-run", false, "report what would be removed without removing anything")
+	retain := flag.String("retain-layers", "", "the ChainIDs of additional unpacked layers to retain, separated by commas (e.g. layers used by images in other image layouts)")
+	flag.Parse()
+	if len(flag.Args()) < 2 {
+		fmt.Println("Usage: gc [-dry-run] [-retain-layers <CHAINIDS>] <IMAGE_DIR> [<IMAGE_DIR>...] <UNPACK_DIR>")
+		fmt.Println("Every image layout whose images were unpacked to UNPACK_DIR must be specified, or its layers must be retained with -retain-layers, since layers that are not reachable from the specified image layouts will be removed.")
+		os.Exit(0)
+	}
+	
+	// Retrieve the image layout and unpack directory paths
+	imageDirs := flag.Args()[:len(flag.Args()) - 1]
+	unpackDir := flag.Args()[len(flag.Args()) - 1]
+	
+	// Parse the list of layers to retain
+	options := image.GarbageCollectionOptions{DryRun: *dryRun}
+	for _, chainID := range strings.Split(*retain, ",") {
+		if chainID = strings.TrimSpace(chainID); chainID != "" {
+			options.RetainLayers = append(options.RetainLayers, digest.Digest(chainID))
+		}
+	}
+	
+	// Remove any blobs and unpacked layers that are no longer reachable
+	report, err := image.CollectGarbage(imageDirs, unpackDir, options)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	
+	// Report the results
+	verb, freed := "Removed", "freed"
+	if report.DryRun {
+		verb, freed = "Would remove", "would free"
+	}
+	for _, blob := range report.RemovedBlobs {
+		fmt.Println(verb, "blob", blob)
+	}
+	for _, layer := range report.RemovedLayers {
+		fmt.Println(verb, "layer directory", layer)
+	}
+	fmt.Printf("Retained %d blobs and %d layers, %s %d bytes\n", report.ReachableBlobs, report.ReachableLayers, freed, report.BytesFreed)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/macoscontainers/experiments/internal/image"
+)
+
+func main() {
+	
+	// Parse our command-line flags
+	reference := flag.String("image", "", "the org.opencontainers.image.ref.name annotation or digest of the image to squash (defaults to the image for the host platform)")
+	refName := flag.String("ref", "", "the org.opencontainers.image.ref.name annotation for the squashed image")
+	from := flag.Int("from", 0, "the index of the first layer to squash (layers below this are preserved)")
+	to := flag.Int("to", 0, "the index after the last layer to squash (defaults to the number of layers)")
+	compression := flag.String("compression", "gzip", "the codec used to compress the squashed layer (none, gzip or zstd)")
+	flag.Parse()
+	if len(flag.Args()) < 2 {
+		fmt.Println("Usage: squash [-image <REFERENCE>] [-ref <NAME>] [-from <INDEX>] [-to <INDEX>] [-compression <CODEC>] <IMAGE_DIR> <UNPACK_DIR>")
+		os.Exit(0)
+	}
+	
+	// Stop cleanly if we receive an interrupt signal
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	
+	// Create an ImageUnpacker for the image
+	unpacker, err := image.UnpackerForImage(flag.Args()[0], flag.Args()[1])
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	
+	// Unpack the image, reusing any layers that have already been unpacked
+	var unpacked *image.UnpackedImage
+	if *reference != "" {
+		unpacked, err = unpacker.UnpackReferenceContext(ctx, *reference, nil)
+	} else {
+		unpacked, err = unpacker.UnpackContext(ctx, nil)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	
+	// Squash the requested range of layers
+	descriptor, err := unpacker.Squash(ctx, unpacked, image.SquashOptions{
+		From: *from,
+		To: *to,
+		Compression: *compression,
+		RefName: *refName,
+	})
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	
+	fmt.Println("Squashed image manifest", descriptor.Digest)
+}
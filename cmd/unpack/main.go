@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/internal/layer"
+	"github.com/macoscontainers/experiments/internal/progress"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+
+// Prints layer-level progress events
+func printProgress(event progress.Event) {
+	layerDigest := event.Layer.Encoded()
+	switch event.Type {
+	case progress.LayerReused:
+		fmt.Println("[", layerDigest, "] reused existing layer")
+	case progress.LayerExtractStarted:
+		fmt.Println("[", layerDigest, "] extracting...")
+	case progress.BytesDecompressed:
+		fmt.Println("[", layerDigest, "] decompressed", event.Bytes, "bytes")
+	case progress.MediaTypeMismatch:
+		fmt.Println("[", layerDigest, "] warning:", event.Err)
+	case progress.LayerExtractFinished:
+		fmt.Println("[", layerDigest, "] extracted in", event.Duration)
+	case progress.LayerApplyStarted:
+		fmt.Println("[", layerDigest, "] applying diff...")
+	case progress.LayerApplyFinished:
+		fmt.Println("[", layerDigest, "] applied diff in", event.Duration)
+	case progress.Error:
+		fmt.Println("[", layerDigest, "] error:", event.Err)
+	}
+}
+
+func main() {
+	
+	// Parse our command-line flags
+	reference := flag.String("ref", "", "the org.opencontainers.image.ref.name annotation or digest of the image to unpack")
+	platformFlag := flag.String("platform", "", "the platform of the image to unpack, in the format os/arch[/variant] (defaults to the host platform)")
+	concurrency := flag.Int("concurrency", 0, "the maximum number of layers to extract concurrently (defaults to the number of CPU cores)")
+	showProgress := flag.Bool("progress", false, "print progress information for each filesystem layer")
+	maxTotalBytes := flag.Int64("max-total-bytes", 0, "the maximum number of uncompressed bytes in each layer archive (unlimited if zero)")
+	maxFileSize := flag.Int64("max-file-size", 0, "the maximum size in bytes of any file in a layer archive (unlimited if zero)")
+	maxEntries := flag.Int64("max-entries", 0, "the maximum number of entries in each layer archive (unlimited if zero)")
+	maxPathDepth := flag.Int64("max-path-depth", 0, "the maximum number of path components for any entry in a layer archive (unlimited if zero)")
+	maxNameLength := flag.Int64("max-name-length", 0, "the maximum length in bytes of the path of any entry in a layer archive (unlimited if zero)")
+	uidMap := flag.String("uidmap", "", "the user ID mappings to apply when unpacking, in the format containerID:hostID:size[,...]")
+	gidMap := flag.String("gidmap", "", "the group ID mappings to apply when unpacking, in the format containerID:hostID:size[,...]")
+	subuid := flag.String("subuid", "", "map root in the container to the specified user and the remaining IDs to their subordinate ID ranges from /etc/subuid and /etc/subgid when unpacking (requires root)")
+	xattrAllow := flag.String("xattr-allow", "", "the name prefixes of the extended attributes to extract, separated by commas (defaults to all attributes)")
+	xattrDeny := flag.String("xattr-deny", "", "the name prefixes of the extended attributes to ignore, separated by commas (defaults to the security and trusted namespaces when not running as root)")
+	flag.Parse()
+	if len(flag.Args()) < 2 {
+		fmt.Println("Usage: unpack [-ref <REFERENCE>] [-platform <PLATFORM>] [-concurrency <N>] [-progress] [-max-total-bytes <N>] [-max-file-size <N>] [-max-entries <N>] [-max-path-depth <N>] [-max-name-length <N>] [-uidmap <MAP> -gidmap <MAP> | -subuid <USER>] [-xattr-allow <PREFIXES>] [-xattr-deny <PREFIXES>] <IMAGE_DIR|IMAGE_ARCHIVE> <UNPACK_DIR>")
+		os.Exit(0)
+	}
+	
+	// Retrieve the image and unpack directory paths
+	imageDir := flag.Args()[0]
+	unpackDir := flag.Args()[1]
+	
+	// Parse the platform, if one was specified
+	var platform *oci.Platform
+	if *platformFlag != "" {
+		parsed, err := image.ParsePlatform(*platformFlag)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		platform = &parsed
+	}
+	
+	// Parse the ID mappings, if any were specified, or create the mappings for a user's subordinate IDs
+	mappings, err := layer.ParseIDMappings(*uidMap, *gidMap)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if *subuid != "" {
+		if mappings != nil {
+			fmt.Println("Error: -subuid cannot be combined with -uidmap and -gidmap")
+			os.Exit(1)
+		}
+		if mappings, err = layer.SubordinateIDMappingsForUser(*subuid); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+	}
+	
+	// Create an ImageUnpacker for the image, which may be either an OCI layout directory or an oci-archive tarball
+	unpacker, err := image.UnpackerForPath(imageDir, unpackDir)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	defer unpacker.Close()
+	unpacker.Concurrency = *concurrency
+	unpacker.IDMappings = mappings
+	unpacker.Xattrs = layer.ParseXattrFilter(*xattrAllow, *xattrDeny)
+	unpacker.Limits = layer.ExtractionLimits{
+		MaxTotalBytes: *maxTotalBytes,
+		MaxFileSize: *maxFileSize,
+		MaxEntries: *maxEntries,
+		MaxPathDepth: *maxPathDepth,
+		MaxNameLength: *maxNameLength,
+	}
+	
+	// Print progress information for each layer if requested
+	if *showProgress {
+		unpacker.Observer = progress.ObserverFunc(printProgress)
+	}
+	
+	// Stop unpacking cleanly if we receive an interrupt signal
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	
+	// Attempt to unpack the image, selecting it by reference if one was specified
+	var unpacked *image.UnpackedImage
+	if *reference != "" {
+		unpacked, err = unpacker.UnpackReferenceContext(ctx, *reference, platform)
+	} else {
+		unpacked, err = unpacker.UnpackContext(ctx, platform)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	} else {
+		fmt.Println("Unpacked image manifest", unpacked.Descriptor.Digest)
+	}
+}
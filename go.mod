@@ -4,8 +4,9 @@ go 1.16
 
 require (
 	github.com/hashicorp/go-multierror v1.1.1
-	github.com/mholt/archiver/v3 v3.5.0
-	github.com/opencontainers/go-digest v1.0.0 // indirect
+	github.com/klauspost/compress v1.10.10
+	github.com/opencontainers/go-digest v1.0.0
 	github.com/opencontainers/image-spec v1.0.1
 	github.com/tensorworks/go-build-helpers v0.0.2
+	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c
 )
@@ -0,0 +1,307 @@
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The names of the built-in codecs
+const (
+	CODEC_NONE = "none"
+	CODEC_GZIP = "gzip"
+	CODEC_ZSTD = "zstd"
+)
+
+// Represents a compression format that can be used for filesystem layer archives
+type Codec struct {
+	
+	// The unique name of the compression format
+	Name string
+	
+	// The magic bytes that identify data in this format (leave empty if the format cannot be identified by its contents)
+	Magic []byte
+	
+	// The offset from the start of the data at which the magic bytes appear
+	MagicOffset int
+	
+	// Wraps a reader for data in this format, returning a reader for the decompressed data
+	Decompress func(io.Reader) (io.ReadCloser, error)
+	
+	// Wraps a writer for data in this format, returning a writer that compresses the data written to it (leave nil if the format is decompression-only)
+	// (The returned writer must be closed to flush any buffered data, but closing it does not close the underlying writer)
+	Compress func(io.Writer) (io.WriteCloser, error)
+	
+	// The OCI media type for filesystem layer archives compressed with this codec (leave empty if there is no standard media type)
+	LayerMediaType string
+}
+
+// Determines whether the specified leading bytes of a stream match the magic bytes for the codec
+func (codec *Codec) matches(header []byte) bool {
+	if len(codec.Magic) == 0 || len(header) < codec.MagicOffset + len(codec.Magic) {
+		return false
+	}
+	
+	return bytes.Equal(header[codec.MagicOffset:codec.MagicOffset + len(codec.Magic)], codec.Magic)
+}
+
+// Adapts a writer to the io.WriteCloser interface with a Close() method that does nothing
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Does nothing
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Maps media types to the codecs used to decompress them
+type Registry struct {
+	
+	// Protects the maps below from concurrent access
+	mutex sync.RWMutex
+	
+	// The registered codecs, keyed by name
+	codecs map[string]*Codec
+	
+	// The names of the codecs for each registered media type
+	mediaTypes map[string]string
+	
+	// The registered codec names, in the order they were registered (so sniffing is deterministic)
+	order []string
+}
+
+// Creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		codecs: map[string]*Codec{},
+		mediaTypes: map[string]string{},
+	}
+}
+
+// The default registry, which is populated with the built-in codecs and the standard OCI and Docker layer media types
+var Default = newDefaultRegistry()
+
+// Creates a Registry populated with the built-in codecs and media types
+func newDefaultRegistry() *Registry {
+	
+	// Register the built-in codecs
+	registry := NewRegistry()
+	registry.RegisterCodec(&Codec{
+		Name: CODEC_NONE,
+		Magic: []byte("ustar"),
+		MagicOffset: 257,
+		Decompress: func(reader io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(reader), nil
+		},
+		Compress: func(writer io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{writer}, nil
+		},
+		LayerMediaType: "application/vnd.oci.image.layer.v1.tar",
+	})
+	registry.RegisterCodec(&Codec{
+		Name: CODEC_GZIP,
+		Magic: []byte{0x1f, 0x8b},
+		Decompress: func(reader io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(reader)
+		},
+		Compress: func(writer io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(writer), nil
+		},
+		LayerMediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
+	})
+	registry.RegisterCodec(&Codec{
+		Name: CODEC_ZSTD,
+		Magic: []byte{0x28, 0xb5, 0x2f, 0xfd},
+		Decompress: func(reader io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(reader)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+		Compress: func(writer io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(writer)
+		},
+		LayerMediaType: "application/vnd.oci.image.layer.v1.tar+zstd",
+	})
+	
+	// Register the standard media types
+	mediaTypes := map[string]string{
+		"application/vnd.oci.image.layer.v1.tar": CODEC_NONE,
+		"application/vnd.oci.image.layer.v1.tar+gzip": CODEC_GZIP,
+		"application/vnd.oci.image.layer.v1.tar+zstd": CODEC_ZSTD,
+		"application/vnd.oci.image.layer.nondistributable.v1.tar": CODEC_NONE,
+		"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip": CODEC_GZIP,
+		"application/vnd.oci.image.layer.nondistributable.v1.tar+zstd": CODEC_ZSTD,
+		"application/vnd.docker.image.rootfs.diff.tar.gzip": CODEC_GZIP,
+		"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip": CODEC_GZIP,
+	}
+	for mediaType, codec := range mediaTypes {
+		if err := registry.RegisterMediaType(mediaType, codec); err != nil {
+			panic(err)
+		}
+	}
+	
+	return registry
+}
+
+// Registers a codec, replacing any existing codec with the same name
+func (registry *Registry) RegisterCodec(codec *Codec) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	
+	if _, exists := registry.codecs[codec.Name]; !exists {
+		registry.order = append(registry.order, codec.Name)
+	}
+	
+	registry.codecs[codec.Name] = codec
+}
+
+// Registers the codec with the specified name as the codec for the specified media type
+func (registry *Registry) RegisterMediaType(mediaType string, codecName string) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	
+	if _, exists := registry.codecs[codecName]; !exists {
+		return fmt.Errorf("cannot register media type %s for unknown codec %s", mediaType, codecName)
+	}
+	
+	registry.mediaTypes[mediaType] = codecName
+	return nil
+}
+
+// Retrieves the codec with the specified name
+func (registry *Registry) Codec(name string) (*Codec, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	
+	codec, exists := registry.codecs[name]
+	return codec, exists
+}
+
+// Retrieves the codec registered for the specified media type
+func (registry *Registry) CodecForMediaType(mediaType string) (*Codec, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	
+	name, exists := registry.mediaTypes[mediaType]
+	if !exists {
+		return nil, false
+	}
+	
+	return registry.codecs[name], true
+}
+
+// Identifies the codec for a stream based on its leading bytes, returning nil if no codec's magic bytes match
+func (registry *Registry) Sniff(header []byte) *Codec {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	
+	for _, name := range registry.order {
+		if codec := registry.codecs[name]; codec.matches(header) {
+			return codec
+		}
+	}
+	
+	return nil
+}
+
+// Returns the number of leading bytes required to sniff any of the registered codecs
+func (registry *Registry) sniffLength() int {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	
+	length := 0
+	for _, codec := range registry.codecs {
+		if required := codec.MagicOffset + len(codec.Magic); required > length {
+			length = required
+		}
+	}
+	
+	return length
+}
+
+// Describes layer archive data whose contents do not match the codec registered for its media type
+type MediaTypeMismatchError struct {
+	
+	// The media type that was declared for the data
+	MediaType string
+	
+	// The name of the codec registered for the media type
+	Declared string
+	
+	// The name of the codec that was used to decompress the data
+	Actual string
+}
+
+// Formats the error message
+func (e *MediaTypeMismatchError) Error() string {
+	return fmt.Sprintf("layer data with media type %s (codec %s) was decompressed with codec %s", e.MediaType, e.Declared, e.Actual)
+}
+
+// Determines whether the codec selected for layer archive data contradicts the codec registered for its media type, returning a MediaTypeMismatchError if it does
+// (Unknown media types cannot be contradicted, so this returns nil for them)
+func (registry *Registry) CheckMediaType(mediaType string, codec *Codec) error {
+	declared, known := registry.CodecForMediaType(mediaType)
+	if !known || declared == codec {
+		return nil
+	}
+	
+	return &MediaTypeMismatchError{MediaType: mediaType, Declared: declared.Name, Actual: codec.Name}
+}
+
+// Wraps a reader for layer archive data of the specified media type, returning a reader for the uncompressed tar stream and the codec that was selected to decompress it
+// (If the media type is missing or does not match the magic bytes at the start of the stream then the codec is identified from the stream's contents, and callers can use CheckMediaType() to report the mismatch)
+func (registry *Registry) Decompress(mediaType string, reader io.Reader) (io.ReadCloser, *Codec, error) {
+	
+	// Peek at the leading bytes of the stream without consuming them
+	buffered := bufio.NewReaderSize(reader, registry.sniffLength())
+	header, err := buffered.Peek(registry.sniffLength())
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	
+	// Determine which codec the media type specifies and which codec the stream's contents match
+	declared, known := registry.CodecForMediaType(mediaType)
+	sniffed := registry.Sniff(header)
+	
+	// Select the codec to use, preferring the stream's contents over the media type
+	codec := declared
+	if sniffed != nil {
+		codec = sniffed
+	} else if !known || len(declared.Magic) > 0 {
+		
+		// The stream does not match the media type (or the media type is unknown), so treat it as an uncompressed archive
+		none, exists := registry.Codec(CODEC_NONE)
+		if !exists {
+			return nil, nil, fmt.Errorf("could not identify the codec for layer data with media type %q", mediaType)
+		}
+		codec = none
+	}
+	
+	decompressed, err := codec.Decompress(buffered)
+	if err != nil {
+		return nil, nil, err
+	}
+	
+	return decompressed, codec, nil
+}
+
+// Wraps a writer with the compressor for the codec with the specified name
+func (registry *Registry) Compress(codecName string, writer io.Writer) (io.WriteCloser, error) {
+	codec, exists := registry.Codec(codecName)
+	if !exists {
+		return nil, fmt.Errorf("unknown codec %s", codecName)
+	}
+	if codec.Compress == nil {
+		return nil, fmt.Errorf("codec %s does not support compression", codecName)
+	}
+	
+	return codec.Compress(writer)
+}
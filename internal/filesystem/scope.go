@@ -0,0 +1,130 @@
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The error reported when a path would resolve to a location outside of the root directory that it is scoped to
+type PathEscapeError struct {
+	
+	// The root directory that the path is scoped to
+	Root string
+	
+	// The offending path
+	Path string
+	
+	// The reason the path was rejected
+	Reason string
+}
+
+// Returns the error message
+func (e *PathEscapeError) Error() string {
+	return fmt.Sprintf("refusing to access %q outside of root directory %s: %s", e.Path, e.Root, e.Reason)
+}
+
+// Resolves a relative path (such as the name of an archive entry) to an absolute path within a root directory, rejecting absolute paths and paths that traverse above the root
+// (The resolution is purely lexical, so callers must also use VerifyNoSymlinks() or MkdirAllNoFollow() to ensure that no symlinks are followed when the path is accessed)
+func SecureJoin(root string, name string) (string, error) {
+	
+	// Reject absolute paths rather than silently reinterpreting them as relative paths
+	if filepath.IsAbs(name) {
+		return "", &PathEscapeError{Root: root, Path: name, Reason: "absolute paths are not permitted"}
+	}
+	
+	// Reject paths that traverse above the root once they have been cleaned (e.g. "a/../../b")
+	cleaned := filepath.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".." + string(filepath.Separator)) {
+		return "", &PathEscapeError{Root: root, Path: name, Reason: "path traverses above the root directory"}
+	}
+	
+	return filepath.Join(root, cleaned), nil
+}
+
+// Splits a path within a root directory into its individual components, returning an error if it does not lie within the root
+func splitWithinRoot(root string, path string) ([]string, error) {
+	relative, err := filepath.Rel(root, path)
+	if err != nil {
+		return nil, err
+	}
+	if relative == ".." || strings.HasPrefix(relative, ".." + string(filepath.Separator)) {
+		return nil, &PathEscapeError{Root: root, Path: path, Reason: "path traverses above the root directory"}
+	}
+	if relative == "." {
+		return []string{}, nil
+	}
+	
+	return strings.Split(relative, string(filepath.Separator)), nil
+}
+
+// Verifies that none of the parent directories of a path within a root directory are symlinks or other non-directories, so the path can be written without leaving the root
+// (Parent directories that do not exist yet are permitted, and the final path component is not checked, since callers replace or create it without following it)
+func VerifyNoSymlinks(root string, path string) error {
+	components, err := splitWithinRoot(root, path)
+	if err != nil {
+		return err
+	}
+	
+	// Check each of the parent directories in turn, starting from the root
+	if len(components) == 0 {
+		return nil
+	}
+	current := root
+	for _, component := range components[:len(components) - 1] {
+		current = filepath.Join(current, component)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		
+		if info.Mode() & os.ModeSymlink != 0 {
+			return &PathEscapeError{Root: root, Path: path, Reason: fmt.Sprintf("parent directory %s is a symlink", current)}
+		} else if !info.IsDir() {
+			return fmt.Errorf("parent directory %s of %s is not a directory", current, path)
+		}
+	}
+	
+	return nil
+}
+
+// Creates a directory within a root directory along with any missing parents, without following symlinks
+// (Existing symlinks are never followed, so a path component that is a symlink to a directory is rejected rather than treated as a directory, whereas `os.MkdirAll()` would follow it)
+func MkdirAllNoFollow(root string, path string) error {
+	components, err := splitWithinRoot(root, path)
+	if err != nil {
+		return err
+	}
+	
+	current := root
+	for _, component := range components {
+		current = filepath.Join(current, component)
+		
+		// Create the directory if it does not already exist (if something else creates it first then it is checked below as an existing entry)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			err = os.Mkdir(current, os.ModePerm)
+			if err == nil {
+				continue
+			} else if !os.IsExist(err) {
+				return err
+			}
+			info, err = os.Lstat(current)
+		}
+		if err != nil {
+			return err
+		}
+		
+		// Reject symlinks and other non-directories
+		if info.Mode() & os.ModeSymlink != 0 {
+			return &PathEscapeError{Root: root, Path: path, Reason: fmt.Sprintf("directory %s is a symlink", current)}
+		} else if !info.IsDir() {
+			return fmt.Errorf("cannot create directory %s because %s is not a directory", path, current)
+		}
+	}
+	
+	return nil
+}
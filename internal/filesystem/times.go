@@ -0,0 +1,30 @@
+package filesystem
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Retrieves the access time of a file, falling back to its modification time if the platform-specific attributes are unavailable
+func AccessTime(info fs.FileInfo) time.Time {
+	if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+		return statAccessTime(sys)
+	}
+	
+	return info.ModTime()
+}
+
+// Sets the access and modification times of a file, directory or symlink without following symlinks
+// (Timestamps are set with nanosecond precision on filesystems that support it)
+func SetTimes(path string, accessTime time.Time, modifiedTime time.Time) error {
+	times := []unix.Timespec{timespec(accessTime), timespec(modifiedTime)}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// Converts a time.Time value to a unix.Timespec value
+func timespec(t time.Time) unix.Timespec {
+	return unix.NsecToTimespec(t.UnixNano())
+}
@@ -0,0 +1,13 @@
+// +build linux
+
+package filesystem
+
+import (
+	"syscall"
+	"time"
+)
+
+// Extracts the access time from the Unix-specific attributes of a file
+func statAccessTime(sys *syscall.Stat_t) time.Time {
+	return time.Unix(sys.Atim.Unix())
+}
@@ -7,3 +7,14 @@ func Exists(path string) (bool) {
 	_, err := os.Stat(path)
 	return err == nil || !os.IsNotExist(err)
 }
+
+// Flushes the entries of the specified directory to stable storage, so that files created, renamed or removed within it survive a crash
+func SyncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	
+	return dir.Sync()
+}
@@ -0,0 +1,93 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// Determines whether an error indicates that the filesystem or file type does not support extended attributes
+func IsXattrUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP)
+}
+
+// Determines whether an error indicates that the current user is not permitted to set or remove an extended attribute
+// (e.g. attributes in the security and trusted namespaces without privileges, or attributes in the user namespace on symlinks and special files under Linux)
+func IsXattrNotPermitted(err error) bool {
+	return errors.Is(err, unix.EPERM)
+}
+
+// Retrieves the value of an extended attribute without following symlinks, returning nil if the attribute does not exist
+func GetXattr(path string, name string) ([]byte, error) {
+	for {
+		
+		// Determine the size of the attribute's value
+		size, err := unix.Lgetxattr(path, name, nil)
+		if errors.Is(err, errNoXattr) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		
+		// Retrieve the value, trying again if it grew in the meantime
+		value := make([]byte, size)
+		read, err := unix.Lgetxattr(path, name, value)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		} else if errors.Is(err, errNoXattr) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		
+		return value[:read], nil
+	}
+}
+
+// Sets the value of an extended attribute without following symlinks
+func SetXattr(path string, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
+
+// Removes an extended attribute without following symlinks, succeeding if the attribute does not exist
+func RemoveXattr(path string, name string) error {
+	if err := unix.Lremovexattr(path, name); err != nil && !errors.Is(err, errNoXattr) {
+		return err
+	}
+	
+	return nil
+}
+
+// Lists the names of the extended attributes for a file without following symlinks
+func ListXattrs(path string) ([]string, error) {
+	for {
+		
+		// Determine the size of the list of names
+		size, err := unix.Llistxattr(path, nil)
+		if err != nil {
+			return nil, err
+		} else if size == 0 {
+			return []string{}, nil
+		}
+		
+		// Retrieve the list, trying again if it grew in the meantime
+		list := make([]byte, size)
+		read, err := unix.Llistxattr(path, list)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		
+		// Split the list of null-terminated names
+		names := []string{}
+		for _, name := range bytes.Split(list[:read], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		
+		return names, nil
+	}
+}
@@ -0,0 +1,8 @@
+// +build linux
+
+package filesystem
+
+import "golang.org/x/sys/unix"
+
+// The error reported when an extended attribute does not exist
+const errNoXattr = unix.ENODATA
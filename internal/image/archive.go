@@ -0,0 +1,188 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+// Provides read-only access to the files in an uncompressed tarball (such as an `oci-archive`) without extracting them
+// (The archive is scanned once to record the offset of each file, and files are then read directly from the archive, so concurrent reads are safe)
+type ArchiveSource struct {
+	
+	// The underlying archive file
+	file *os.File
+	
+	// The header and data offset for each regular file in the archive, keyed by its cleaned path
+	entries map[string]archiveEntry
+	
+	// The cleaned target path for each symlink and hardlink in the archive, keyed by its cleaned path
+	links map[string]string
+}
+
+// The maximum number of links that will be followed when resolving a path within an archive (which guards against link cycles)
+const MAX_ARCHIVE_LINKS = 16
+
+// Represents the location of a regular file within an archive
+type archiveEntry struct {
+	
+	// The tar header for the file
+	header *tar.Header
+	
+	// The offset of the file's contents from the start of the archive
+	offset int64
+}
+
+// Tracks the current offset of a reader that may also be seeked
+type offsetReader struct {
+	
+	// The underlying file
+	file *os.File
+	
+	// The current offset from the start of the file
+	offset int64
+}
+
+// Reads from the underlying file and advances the offset
+func (reader *offsetReader) Read(p []byte) (int, error) {
+	n, err := reader.file.Read(p)
+	reader.offset += int64(n)
+	return n, err
+}
+
+// Seeks the underlying file and updates the offset, which allows the tar reader to skip over file contents without reading them
+func (reader *offsetReader) Seek(offset int64, whence int) (int64, error) {
+	position, err := reader.file.Seek(offset, whence)
+	if err == nil {
+		reader.offset = position
+	}
+	
+	return position, err
+}
+
+// Cleans the path of an archive entry so it can be looked up using the paths accepted by fs.FS (e.g. "./blobs/" becomes "blobs")
+func cleanArchivePath(name string) string {
+	return strings.TrimPrefix(path.Clean("/" + name), "/")
+}
+
+// Opens an uncompressed tarball and records the location of each of the files that it contains
+func OpenArchive(filename string) (*ArchiveSource, error) {
+	
+	// Attempt to open the archive
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Verify that the archive is not compressed, since compressed archives cannot be read from arbitrary offsets
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(file, header); err == nil && (bytes.HasPrefix(header, []byte{0x1f, 0x8b}) || bytes.Equal(header, []byte{0x28, 0xb5, 0x2f, 0xfd})) {
+		file.Close()
+		return nil, fmt.Errorf("archive %s is compressed, only uncompressed archives can be read directly", filename)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	
+	// Record the header and data offset for each regular file in the archive, and the target of each link
+	source := &ArchiveSource{file: file, entries: map[string]archiveEntry{}, links: map[string]string{}}
+	counter := &offsetReader{file: file}
+	reader := tar.NewReader(counter)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to read archive %s: %w", filename, err)
+		}
+		
+		// (Symlink targets are relative to the directory containing the symlink, whereas hardlink targets are relative to the root of the archive)
+		name := cleanArchivePath(header.Name)
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			source.entries[name] = archiveEntry{header: header, offset: counter.offset}
+		case tar.TypeSymlink:
+			source.links[name] = cleanArchivePath(path.Join(path.Dir(name), header.Linkname))
+		case tar.TypeLink:
+			source.links[name] = cleanArchivePath(header.Linkname)
+		}
+	}
+	
+	return source, nil
+}
+
+// Opens the file with the specified path, as per the fs.FS interface
+// (Only regular files and links to regular files can be opened, since the image layout is only ever accessed by file path)
+func (source *ArchiveSource) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	
+	// Resolve any links (e.g. `docker save` represents duplicate layers as symlinks to a single copy)
+	resolved := name
+	for hops := 0; ; hops++ {
+		target, isLink := source.links[resolved]
+		if !isLink {
+			break
+		}
+		if hops == MAX_ARCHIVE_LINKS {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("more than %d links were encountered while resolving the path", MAX_ARCHIVE_LINKS)}
+		}
+		resolved = target
+	}
+	
+	entry, exists := source.entries[resolved]
+	if !exists {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	
+	return &archiveFile{
+		SectionReader: io.NewSectionReader(source.file, entry.offset, entry.header.Size),
+		info: entry.header.FileInfo(),
+	}, nil
+}
+
+// Determines whether the archive contains a file (or a link to a file) with the specified path
+func (source *ArchiveSource) Exists(name string) bool {
+	file, err := source.Open(name)
+	if err != nil {
+		return false
+	}
+	
+	file.Close()
+	return true
+}
+
+// Closes the underlying archive file
+func (source *ArchiveSource) Close() error {
+	return source.file.Close()
+}
+
+// Represents an open file within an archive
+type archiveFile struct {
+	*io.SectionReader
+	
+	// The attributes of the file, as recorded in its tar header
+	info fs.FileInfo
+}
+
+// Returns the attributes of the file
+func (file *archiveFile) Stat() (fs.FileInfo, error) {
+	return file.info, nil
+}
+
+// Does nothing, since the underlying archive file remains open until the ArchiveSource is closed
+func (file *archiveFile) Close() error {
+	return nil
+}
+
+// The error reported when attempting to modify an image that was opened from a read-only image source such as an archive
+var ErrReadOnlySource = errors.New("the image source is read-only, write the image to an OCI layout directory to modify it")
@@ -0,0 +1,191 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/macoscontainers/experiments/internal/filesystem"
+	"github.com/macoscontainers/experiments/internal/layer"
+	"github.com/macoscontainers/experiments/internal/marshal"
+	digest "github.com/opencontainers/go-digest"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The filename of the completion record that is written to a layer directory once the layer has been fully unpacked
+const LAYER_RECORD_FILENAME = "layer.json"
+
+// The suffix for the staging directory in which a layer is unpacked before it is atomically renamed into place
+const STAGING_SUFFIX = ".staging"
+
+// Represents a filesystem layer that has been unpacked
+type UnpackedLayer struct {
+	
+	// The descriptor for the layer's archive blob
+	Descriptor oci.Descriptor
+	
+	// The digest of the layer's uncompressed contents
+	DiffID digest.Digest
+	
+	// The ChainID that identifies the layer and all of its parent layers
+	ChainID digest.Digest
+	
+	// The ChainID of the parent layer (empty for the base layer)
+	Parent digest.Digest
+	
+	// The absolute path to the directory that holds the unpacked layer
+	Dir string
+	
+	// The absolute path to the directory containing the layer's filesystem diff
+	DiffDir string
+	
+	// The absolute path to the directory containing the merged contents of the layer and all of its parent layers
+	MergedDir string
+}
+
+// Represents the completion record for an unpacked filesystem layer
+type LayerRecord struct {
+	
+	// The ChainID that identifies the layer and all of its parent layers
+	ChainID digest.Digest `json:"chainID"`
+	
+	// The digest of the layer's uncompressed contents
+	DiffID digest.Digest `json:"diffID"`
+	
+	// The ChainID of the parent layer (empty for the base layer)
+	Parent digest.Digest `json:"parent,omitempty"`
+	
+	// The digest of the archive blob that the layer was unpacked from
+	Blob digest.Digest `json:"blob"`
+	
+	// The ID mappings that were used when unpacking the layer (omitted if IDs were preserved verbatim)
+	IDMappings *layer.IDMappings `json:"idMappings,omitempty"`
+	
+	// The filter that determined which extended attributes were extracted when unpacking the layer, with the default filter resolved for the user who unpacked it
+	// (Since the default filter depends on whether that user was root, storing it resolved prevents layers unpacked without privileged attributes from being reused by root)
+	Xattrs *layer.XattrFilter `json:"xattrs,omitempty"`
+}
+
+// Computes the ChainID for each layer in a list of diff_ids, as per the OCI image specification
+// (The ChainID for the base layer is its diff_id, and the ChainID for each subsequent layer is the digest of its parent's ChainID and its own diff_id)
+func ChainIDs(diffIDs []digest.Digest) []digest.Digest {
+	chainIDs := make([]digest.Digest, len(diffIDs))
+	for index, diffID := range diffIDs {
+		if index == 0 {
+			chainIDs[index] = diffID
+		} else {
+			chainIDs[index] = digest.FromString(fmt.Sprintf("%s %s", chainIDs[index - 1], diffID))
+		}
+	}
+	
+	return chainIDs
+}
+
+// Resolves the path to the directory that holds the unpacked layer with the specified ChainID
+func (unpacker *ImageUnpacker) LayerDir(chainID digest.Digest) string {
+	return filepath.Join(unpacker.unpackDir, chainID.Encoded())
+}
+
+// Resolves the path to the staging directory in which the layer with the specified ChainID is unpacked before it is committed
+func (unpacker *ImageUnpacker) StagingDir(chainID digest.Digest) string {
+	return unpacker.LayerDir(chainID) + STAGING_SUFFIX
+}
+
+// Returns a copy of the specified layer whose paths refer to its staging directory rather than its final location
+func (unpacker *ImageUnpacker) stagingLayer(layer *UnpackedLayer) *UnpackedLayer {
+	staged := *layer
+	staged.Dir = unpacker.StagingDir(layer.ChainID)
+	staged.DiffDir = filepath.Join(staged.Dir, "diff")
+	staged.MergedDir = filepath.Join(staged.Dir, "merged")
+	return &staged
+}
+
+// Resolves the details of the unpacked layers for the specified image manifest and configuration
+func (unpacker *ImageUnpacker) layersForImage(manifest *oci.Manifest, config *oci.Image) []UnpackedLayer {
+	chainIDs := ChainIDs(config.RootFS.DiffIDs)
+	layers := []UnpackedLayer{}
+	for index, descriptor := range manifest.Layers {
+		
+		// Determine the ChainID of the parent layer, if any
+		var parent digest.Digest
+		if index > 0 {
+			parent = chainIDs[index - 1]
+		}
+		
+		// Resolve the paths for the layer
+		dir := unpacker.LayerDir(chainIDs[index])
+		layers = append(layers, UnpackedLayer{
+			Descriptor: descriptor,
+			DiffID: config.RootFS.DiffIDs[index],
+			ChainID: chainIDs[index],
+			Parent: parent,
+			Dir: dir,
+			DiffDir: filepath.Join(dir, "diff"),
+			MergedDir: filepath.Join(dir, "merged"),
+		})
+	}
+	
+	return layers
+}
+
+// Determines whether the specified layer has already been fully unpacked
+func (unpacker *ImageUnpacker) isLayerComplete(layer *UnpackedLayer) bool {
+	
+	// Attempt to parse the layer's completion record
+	record := &LayerRecord{}
+	if err := marshal.UnmarshalJsonFile(filepath.Join(layer.Dir, LAYER_RECORD_FILENAME), record); err != nil {
+		return false
+	}
+	
+	// Verify that the record matches the layer, that the layer's files are owned by the IDs that we would map them to and hold the extended attributes we would extract, and that the merged directory exists
+	return record.ChainID == layer.ChainID && record.DiffID == layer.DiffID && record.IDMappings.Equal(unpacker.IDMappings) && record.Xattrs.Equal(unpacker.Xattrs) && filesystem.Exists(layer.MergedDir)
+}
+
+// Writes the completion record for the specified layer, marking it as fully unpacked
+func (unpacker *ImageUnpacker) writeLayerRecord(layer *UnpackedLayer) error {
+	
+	// Write the record
+	filename := filepath.Join(layer.Dir, LAYER_RECORD_FILENAME)
+	err := marshal.MarshalJsonFile(filename, &LayerRecord{
+		ChainID: layer.ChainID,
+		DiffID: layer.DiffID,
+		Parent: layer.Parent,
+		Blob: layer.Descriptor.Digest,
+		IDMappings: unpacker.IDMappings,
+		Xattrs: unpacker.Xattrs.Resolve(),
+	})
+	if err != nil {
+		return err
+	}
+	
+	// Flush the record to stable storage so it cannot be lost or truncated once the layer has been committed
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Writes the completion record for a layer that has been unpacked in its staging directory, then atomically renames the staging directory into place
+// (Readers therefore only ever see either no layer directory at all or a fully unpacked layer with a completion record)
+func (unpacker *ImageUnpacker) commitLayer(layer *UnpackedLayer) error {
+	
+	// Write the completion record to the staging directory
+	staged := unpacker.stagingLayer(layer)
+	if err := unpacker.writeLayerRecord(staged); err != nil {
+		return err
+	}
+	
+	// Remove any incomplete layer directory that would prevent the rename (e.g. one left behind by an older version of the unpacker)
+	if err := os.RemoveAll(layer.Dir); err != nil {
+		return err
+	}
+	
+	// Rename the staging directory into place and flush the change to stable storage
+	if err := os.Rename(staged.Dir, layer.Dir); err != nil {
+		return err
+	}
+	
+	return filesystem.SyncDir(unpacker.unpackDir)
+}
@@ -0,0 +1,164 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/macoscontainers/experiments/internal/compression"
+	"github.com/macoscontainers/experiments/internal/layer"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Options that control how a filesystem diff is committed as a new layer
+type CommitOptions struct {
+	
+	// The name of the codec used to compress the layer archive (defaults to gzip if empty)
+	Compression string
+	
+	// The value of the `org.opencontainers.image.ref.name` annotation for the new image (optional)
+	RefName string
+	
+	// The command that produced the layer, as recorded in the image history (optional)
+	CreatedBy string
+	
+	// A comment describing the layer, as recorded in the image history (optional)
+	Comment string
+	
+	// The author of the layer, as recorded in the image history (optional)
+	Author string
+	
+	// The latest modification time that may be recorded in the layer archive, which is also used as the creation time of the new image (optional, defaults to the current time)
+	// (This is typically populated from the SOURCE_DATE_EPOCH environment variable, so that committing the same files always produces the same image)
+	SourceDateEpoch time.Time
+}
+
+// Compresses the layer archive produced by the specified function and writes it to the OCI image layout as a blob, returning its descriptor and diff_id
+func (unpacker *ImageUnpacker) writeLayerBlob(codecName string, pack func(io.Writer) error) (oci.Descriptor, digest.Digest, error) {
+	
+	// Determine the media type for the layer archive
+	codec, exists := unpacker.codecs().Codec(codecName)
+	if !exists || codec.LayerMediaType == "" {
+		return oci.Descriptor{}, "", fmt.Errorf("codec %q cannot be used to compress layer archives", codecName)
+	}
+	
+	// Pack the diff into a compressed archive, computing the digest of the uncompressed contents as we go
+	diffID := digest.Canonical.Digester()
+	descriptor, err := unpacker.ingestBlob(codec.LayerMediaType, func(writer io.Writer) error {
+		compressor, err := unpacker.codecs().Compress(codecName, writer)
+		if err != nil {
+			return err
+		}
+		
+		if err := pack(io.MultiWriter(compressor, diffID.Hash())); err != nil {
+			compressor.Close()
+			return err
+		}
+		
+		return compressor.Close()
+	})
+	if err != nil {
+		return oci.Descriptor{}, "", err
+	}
+	
+	return descriptor, diffID.Digest(), nil
+}
+
+// Commits a filesystem diff (such as one produced by a DiffGenerator) as a new layer on top of an unpacked image, returning the descriptor for the new image manifest
+// (The layer archive, image configuration and image manifest are written as blobs and the new image is added to the OCI index)
+func (unpacker *ImageUnpacker) Commit(ctx context.Context, base *UnpackedImage, diffDir string, options CommitOptions) (oci.Descriptor, error) {
+	packer := &layer.LayerPacker{DiffDir: diffDir, IDMappings: unpacker.IDMappings, SourceDateEpoch: options.SourceDateEpoch, Xattrs: unpacker.Xattrs}
+	return unpacker.commitArchive(base, options, func(writer io.Writer) error {
+		return packer.PackContext(ctx, writer)
+	})
+}
+
+// Commits the differences between an unpacked image and a directory of modified files as a new layer, without writing the diff to disk first, returning the descriptor for the new image manifest
+// (The generator's BaseDir must be the merged directory for the top layer of the unpacked image, its DiffDir is not used, and its Xattrs filter must match the unpacker's,
+// since it determines which extended attributes are compared and written, and the base layers were extracted with the unpacker's filter)
+func (unpacker *ImageUnpacker) CommitModified(ctx context.Context, base *UnpackedImage, generator *layer.DiffGenerator, options CommitOptions) (oci.Descriptor, error) {
+	if !generator.Xattrs.Equal(unpacker.Xattrs) {
+		return oci.Descriptor{}, fmt.Errorf("the extended attribute filter of the diff generator (%+v) does not match the filter of the unpacker (%+v)", generator.Xattrs, unpacker.Xattrs)
+	}
+	
+	archiveOptions := layer.ArchiveOptions{IDMappings: unpacker.IDMappings, SourceDateEpoch: options.SourceDateEpoch}
+	return unpacker.commitArchive(base, options, func(writer io.Writer) error {
+		return generator.WriteArchiveContext(ctx, writer, archiveOptions)
+	})
+}
+
+// Commits the layer archive produced by the specified function as a new layer on top of an unpacked image
+func (unpacker *ImageUnpacker) commitArchive(base *UnpackedImage, options CommitOptions, pack func(io.Writer) error) (oci.Descriptor, error) {
+	
+	// Pack the diff into a layer archive blob
+	codecName := options.Compression
+	if codecName == "" {
+		codecName = compression.CODEC_GZIP
+	}
+	layerDescriptor, diffID, err := unpacker.writeLayerBlob(codecName, pack)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	// Create the updated image configuration, adding the diff_id for the new layer and a history entry describing it
+	now := time.Now().UTC()
+	if !options.SourceDateEpoch.IsZero() {
+		now = options.SourceDateEpoch.UTC()
+	}
+	config := *base.Config
+	config.Created = &now
+	config.RootFS.DiffIDs = append(append([]digest.Digest{}, base.Config.RootFS.DiffIDs...), diffID)
+	config.History = append(append([]oci.History{}, base.Config.History...), oci.History{
+		Created: &now,
+		CreatedBy: options.CreatedBy,
+		Author: options.Author,
+		Comment: options.Comment,
+	})
+	if options.Author != "" {
+		config.Author = options.Author
+	}
+	
+	// Write the new image and add it to the OCI index
+	layers := append(append([]oci.Descriptor{}, base.Manifest.Layers...), layerDescriptor)
+	return unpacker.writeImage(base, &config, layers, options.RefName)
+}
+
+// Writes the image configuration and image manifest for an image derived from an existing image, then adds the new image to the OCI index
+func (unpacker *ImageUnpacker) writeImage(base *UnpackedImage, config *oci.Image, layers []oci.Descriptor, refName string) (oci.Descriptor, error) {
+	
+	// Write the image configuration
+	configDescriptor, err := unpacker.writeJsonBlob(oci.MediaTypeImageConfig, config)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	// Create and write the image manifest
+	manifest := &oci.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config: configDescriptor,
+		Layers: layers,
+		Annotations: base.Manifest.Annotations,
+	}
+	manifestDescriptor, err := unpacker.writeJsonBlob(oci.MediaTypeImageManifest, manifest)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	// Record the platform of the new image so it can be selected from the index
+	// (The platform is resolved from the base image's original configuration, since oci.Image does not retain the variant or OS version)
+	platform, err := unpacker.manifestPlatform(base.Descriptor)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	manifestDescriptor.Platform = &platform
+	
+	// Add the new image to the OCI index
+	if err := unpacker.addToIndex(manifestDescriptor, refName); err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	return manifestDescriptor, nil
+}
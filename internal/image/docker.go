@@ -0,0 +1,383 @@
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/macoscontainers/experiments/internal/compression"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The filename of the manifest in a `docker save` tarball
+const DOCKER_MANIFEST_FILENAME = "manifest.json"
+
+// The filename of the legacy repositories file in a `docker save` tarball
+const DOCKER_REPOSITORIES_FILENAME = "repositories"
+
+// Represents an entry in the manifest of a `docker save` tarball
+type dockerManifestEntry struct {
+	
+	// The path to the image configuration within the tarball
+	Config string `json:"Config"`
+	
+	// The repository tags for the image (e.g. "alpine:3.13.5")
+	RepoTags []string `json:"RepoTags"`
+	
+	// The paths to the archives for the image's filesystem layers within the tarball, in order from the base layer to the topmost layer
+	Layers []string `json:"Layers"`
+}
+
+// Presents the contents of a `docker save` tarball as an OCI image layout, without extracting or copying any of its layer archives
+// (The OCI index, image manifests and image configurations are generated in memory, and blobs for filesystem layers are read directly from the tarball)
+type DockerArchiveSource struct {
+	
+	// The underlying archive
+	archive *ArchiveSource
+	
+	// The contents of the generated files (the OCI index, the layout marker file, and the image manifest and image configuration blobs), keyed by path
+	generated map[string][]byte
+	
+	// The paths of the layer archives within the tarball, keyed by the path of the corresponding blob in the OCI image layout
+	layers map[string]string
+}
+
+// Reads and parses a JSON file from an archive
+func readArchiveJson(archive fs.FS, name string, out interface{}) error {
+	data, err := fs.ReadFile(archive, name)
+	if err != nil {
+		return err
+	}
+	
+	return json.Unmarshal(data, out)
+}
+
+// Resolves the repository tags for each image in a `docker save` tarball, merging in any tags from the legacy repositories file
+// (The repositories file maps each tag to the ID of the image's topmost layer, which is the name of the directory containing that layer's archive)
+func dockerRepoTags(archive fs.FS, manifest []dockerManifestEntry) ([][]string, error) {
+	
+	// Start with the tags listed in the manifest
+	tags := make([][]string, len(manifest))
+	seen := make([]map[string]bool, len(manifest))
+	for index, entry := range manifest {
+		seen[index] = map[string]bool{}
+		for _, tag := range entry.RepoTags {
+			tags[index] = append(tags[index], tag)
+			seen[index][tag] = true
+		}
+	}
+	
+	// Parse the legacy repositories file, if there is one
+	repositories := map[string]map[string]string{}
+	if err := readArchiveJson(archive, DOCKER_REPOSITORIES_FILENAME, &repositories); errors.Is(err, fs.ErrNotExist) {
+		return tags, nil
+	} else if err != nil {
+		return nil, err
+	}
+	
+	// Add each tag from the repositories file to the image whose topmost layer matches, in a deterministic order
+	repos := []string{}
+	for repo := range repositories {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	for _, repo := range repos {
+		names := []string{}
+		for name := range repositories[repo] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		
+		for _, name := range names {
+			layerID := repositories[repo][name]
+			tag := fmt.Sprintf("%s:%s", repo, name)
+			for index, entry := range manifest {
+				if len(entry.Layers) > 0 && path.Dir(cleanArchivePath(entry.Layers[len(entry.Layers) - 1])) == layerID && !seen[index][tag] {
+					tags[index] = append(tags[index], tag)
+					seen[index][tag] = true
+				}
+			}
+		}
+	}
+	
+	return tags, nil
+}
+
+// Presents a `docker save` tarball that has already been opened as an OCI image layout
+func newDockerArchiveSource(archive *ArchiveSource) (*DockerArchiveSource, error) {
+	source := &DockerArchiveSource{
+		archive: archive,
+		generated: map[string][]byte{},
+		layers: map[string]string{},
+	}
+	
+	// Parse the manifest for the tarball (tarballs from before Docker 1.10 only contain a repositories file, and use a layer format that predates image configurations)
+	manifest := []dockerManifestEntry{}
+	if err := readArchiveJson(archive, DOCKER_MANIFEST_FILENAME, &manifest); errors.Is(err, fs.ErrNotExist) {
+		return nil, errors.New("tarball does not contain a manifest.json file (tarballs produced by versions of Docker prior to 1.10 are not supported)")
+	} else if err != nil {
+		return nil, err
+	}
+	
+	// Resolve the repository tags for each image
+	tags, err := dockerRepoTags(archive, manifest)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Generate an image manifest for each image and add it to the OCI index
+	index := &oci.Index{Versioned: specs.Versioned{SchemaVersion: 2}, Manifests: []oci.Descriptor{}}
+	for entryIndex, entry := range manifest {
+		descriptor, err := source.addImage(entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to import image %d from docker archive: %w", entryIndex, err)
+		}
+		
+		// Add a descriptor to the index for each of the image's tags, or a single untagged descriptor if there are none
+		if len(tags[entryIndex]) == 0 {
+			index.Manifests = append(index.Manifests, descriptor)
+		}
+		for _, tag := range tags[entryIndex] {
+			tagged := descriptor
+			tagged.Annotations = map[string]string{oci.AnnotationRefName: tag}
+			index.Manifests = append(index.Manifests, tagged)
+		}
+	}
+	
+	// Generate the OCI index and layout marker file
+	if err := source.generate("index.json", index); err != nil {
+		return nil, err
+	}
+	if err := source.generate(oci.ImageLayoutFile, &oci.ImageLayout{Version: oci.ImageLayoutVersion}); err != nil {
+		return nil, err
+	}
+	
+	return source, nil
+}
+
+// Serialises a value as JSON and stores it as a generated file
+func (source *DockerArchiveSource) generate(name string, in interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	
+	source.generated[name] = data
+	return nil
+}
+
+// Stores a generated blob, returning its descriptor
+func (source *DockerArchiveSource) generateBlob(mediaType string, data []byte) (oci.Descriptor, error) {
+	descriptor := oci.Descriptor{
+		MediaType: mediaType,
+		Digest: digest.FromBytes(data),
+		Size: int64(len(data)),
+	}
+	
+	name, err := blobName(descriptor)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	source.generated[name] = data
+	return descriptor, nil
+}
+
+// Generates the image configuration and image manifest blobs for an image in the tarball, returning the descriptor for the image manifest
+func (source *DockerArchiveSource) addImage(entry dockerManifestEntry) (oci.Descriptor, error) {
+	
+	// Read and parse the image configuration (Docker image configurations are a superset of OCI image configurations)
+	configData, err := fs.ReadFile(source.archive, cleanArchivePath(entry.Config))
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	config := &oci.Image{}
+	if err := json.Unmarshal(configData, config); err != nil {
+		return oci.Descriptor{}, err
+	}
+	if len(config.RootFS.DiffIDs) != len(entry.Layers) {
+		return oci.Descriptor{}, fmt.Errorf("image configuration %s specifies %d diff_ids but the manifest specifies %d layers", entry.Config, len(config.RootFS.DiffIDs), len(entry.Layers))
+	}
+	
+	// Store the original configuration as a blob, so its digest matches the image ID that Docker computed
+	configDescriptor, err := source.generateBlob(oci.MediaTypeImageConfig, configData)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	// Create a descriptor for each layer archive
+	layers := []oci.Descriptor{}
+	for layerIndex, layerPath := range entry.Layers {
+		descriptor, err := source.addLayer(cleanArchivePath(layerPath), config.RootFS.DiffIDs[layerIndex])
+		if err != nil {
+			return oci.Descriptor{}, err
+		}
+		layers = append(layers, descriptor)
+	}
+	
+	// Generate the image manifest
+	manifest := &oci.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config: configDescriptor,
+		Layers: layers,
+	}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	descriptor, err := source.generateBlob(oci.MediaTypeImageManifest, manifestData)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	// Record the platform from the image configuration in the descriptor
+	platform, err := parseConfigPlatform(configData)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	descriptor.Platform = &platform
+	return descriptor, nil
+}
+
+// Creates the descriptor for a layer archive in the tarball and maps the corresponding blob path to it
+// (`docker save` writes uncompressed layer archives whose digest is the layer's diff_id, so the archive only needs to be read if it turns out to be compressed)
+func (source *DockerArchiveSource) addLayer(layerPath string, diffID digest.Digest) (oci.Descriptor, error) {
+	
+	// Open the layer archive
+	file, err := source.archive.Open(layerPath)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	// Determine whether the layer archive is compressed
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return oci.Descriptor{}, err
+	}
+	codec := compression.Default.Sniff(header[:n])
+	
+	// Use the diff_id as the digest for uncompressed archives, and compute the digest of compressed archives
+	descriptor := oci.Descriptor{MediaType: oci.MediaTypeImageLayer, Digest: diffID, Size: info.Size()}
+	if codec != nil && codec.Name != compression.CODEC_NONE {
+		file.Close()
+		if file, err = source.archive.Open(layerPath); err != nil {
+			return oci.Descriptor{}, err
+		}
+		digester := digest.Canonical.Digester()
+		if _, err := io.Copy(digester.Hash(), file); err != nil {
+			return oci.Descriptor{}, err
+		}
+		descriptor.Digest = digester.Digest()
+		if codec.LayerMediaType != "" {
+			descriptor.MediaType = codec.LayerMediaType
+		}
+	}
+	
+	// Map the blob path to the layer archive
+	name, err := blobName(descriptor)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	source.layers[name] = layerPath
+	return descriptor, nil
+}
+
+// Opens the file with the specified path in the generated OCI image layout, as per the fs.FS interface
+func (source *DockerArchiveSource) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	
+	// Serve generated files from memory
+	if data, exists := source.generated[name]; exists {
+		return &generatedFile{Reader: bytes.NewReader(data), info: generatedFileInfo{name: path.Base(name), size: int64(len(data))}}, nil
+	}
+	
+	// Serve layer blobs from the tarball
+	if layerPath, exists := source.layers[name]; exists {
+		return source.archive.Open(layerPath)
+	}
+	
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// Closes the underlying archive
+func (source *DockerArchiveSource) Close() error {
+	return source.archive.Close()
+}
+
+// Opens a `docker save` tarball and presents its contents as an OCI image layout
+func OpenDockerArchive(filename string) (*DockerArchiveSource, error) {
+	archive, err := OpenArchive(filename)
+	if err != nil {
+		return nil, err
+	}
+	
+	source, err := newDockerArchiveSource(archive)
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+	
+	return source, nil
+}
+
+// Represents an open file that was generated in memory
+type generatedFile struct {
+	*bytes.Reader
+	
+	// The attributes of the file
+	info generatedFileInfo
+}
+
+// Returns the attributes of the file
+func (file *generatedFile) Stat() (fs.FileInfo, error) {
+	return file.info, nil
+}
+
+// Does nothing, since the file's contents are held in memory
+func (file *generatedFile) Close() error {
+	return nil
+}
+
+// Represents the attributes of a file that was generated in memory
+type generatedFileInfo struct {
+	
+	// The base name of the file
+	name string
+	
+	// The size of the file in bytes
+	size int64
+}
+
+// Returns the base name of the file
+func (info generatedFileInfo) Name() string { return info.name }
+
+// Returns the size of the file in bytes
+func (info generatedFileInfo) Size() int64 { return info.size }
+
+// Returns the file's mode bits (generated files are always read-only regular files)
+func (info generatedFileInfo) Mode() fs.FileMode { return 0444 }
+
+// Returns the file's modification time (generated files have no meaningful modification time)
+func (info generatedFileInfo) ModTime() time.Time { return time.Time{} }
+
+// Returns false, since generated files are never directories
+func (info generatedFileInfo) IsDir() bool { return false }
+
+// Returns nil, since generated files have no underlying data source
+func (info generatedFileInfo) Sys() interface{} { return nil }
@@ -0,0 +1,171 @@
+package image
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Writes a file with the specified contents to an archive
+func writeArchiveFile(archive *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name: name,
+		Mode: 0644,
+		Size: int64(len(data)),
+		ModTime: time.Unix(0, 0),
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	
+	_, err := archive.Write(data)
+	return err
+}
+
+// Writes a directory entry to an archive
+func writeArchiveDir(archive *tar.Writer, name string) error {
+	return archive.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name: name + "/",
+		Mode: 0755,
+		ModTime: time.Unix(0, 0),
+	})
+}
+
+// Writes the images matching the specified reference (or all images if the reference is empty) to an `oci-archive` tarball, along with every blob that they reference
+// (The archive is written in a deterministic order, and each blob is verified against its descriptor before it is copied. Since the output
+// cannot be rewound, an error may leave a partial archive behind, and callers must discard the output if an error is returned)
+func (unpacker *ImageUnpacker) ExportArchive(ctx context.Context, reference string, output io.Writer) error {
+	
+	// Select the descriptors for the images to export
+	descriptors := unpacker.index.Manifests
+	if reference != "" {
+		selected, err := unpacker.selectReference(reference)
+		if err != nil {
+			return err
+		}
+		descriptors = selected
+	}
+	
+	// Identify the blobs that the images reference
+	reachable := &reachability{
+		unpacker: unpacker,
+		blobs: map[digest.Digest]oci.Descriptor{},
+		layers: map[string]bool{},
+	}
+	for _, descriptor := range descriptors {
+		if err := reachable.mark(descriptor, 0); err != nil {
+			return err
+		}
+	}
+	digests := []string{}
+	for blob := range reachable.blobs {
+		digests = append(digests, blob.String())
+	}
+	sort.Strings(digests)
+	
+	// Write the layout marker file and the OCI index
+	archive := tar.NewWriter(output)
+	layout, err := json.Marshal(&oci.ImageLayout{Version: oci.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveFile(archive, oci.ImageLayoutFile, layout); err != nil {
+		return err
+	}
+	index, err := json.Marshal(&oci.Index{Versioned: specs.Versioned{SchemaVersion: 2}, Manifests: descriptors})
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveFile(archive, "index.json", index); err != nil {
+		return err
+	}
+	
+	// Write each of the blobs, creating the directory for each digest algorithm as we encounter it
+	if err := writeArchiveDir(archive, "blobs"); err != nil {
+		return err
+	}
+	directories := map[string]bool{}
+	for _, blob := range digests {
+		descriptor := reachable.blobs[digest.Digest(blob)]
+		
+		// Stop processing if the context has been cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		
+		// Create the directory for the digest algorithm if we have not already done so
+		name, err := blobName(descriptor)
+		if err != nil {
+			return err
+		}
+		if dir := path.Dir(name); !directories[dir] {
+			if err := writeArchiveDir(archive, dir); err != nil {
+				return err
+			}
+			directories[dir] = true
+		}
+		
+		// Write the blob
+		if err := unpacker.exportBlob(archive, name, descriptor); err != nil {
+			return err
+		}
+	}
+	
+	// Write the end-of-archive marker
+	return archive.Close()
+}
+
+// Copies an individual blob to an archive, verifying its contents before any of them are written
+// (Blobs for foreign layers are often absent from image layouts, so these are skipped if they are missing, as per their descriptors' URLs)
+func (unpacker *ImageUnpacker) exportBlob(archive *tar.Writer, name string, descriptor oci.Descriptor) error {
+	
+	// Attempt to open the blob and verify its contents, so that a corrupted blob is never written to the archive
+	blob, err := unpacker.openBlob(descriptor)
+	if os.IsNotExist(err) && len(descriptor.URLs) > 0 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = blob.verifyContents()
+	blob.Close()
+	if err != nil {
+		return err
+	}
+	
+	// Re-open the blob to copy its contents
+	blob, err = unpacker.openBlob(descriptor)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	
+	// Write the header for the blob
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name: name,
+		Mode: 0644,
+		Size: descriptor.Size,
+		ModTime: time.Unix(0, 0),
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	
+	// Copy the blob's contents and verify them again, in case the blob was modified after it was first verified
+	if _, err := io.Copy(archive, blob); err != nil {
+		return err
+	}
+	
+	return blob.Verify()
+}
@@ -0,0 +1,380 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/macoscontainers/experiments/internal/marshal"
+	digest "github.com/opencontainers/go-digest"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The media type used by Docker for image manifests, which are equivalent to OCI image manifests
+const MEDIA_TYPE_DOCKER_MANIFEST = "application/vnd.docker.distribution.manifest.v2+json"
+
+// The media type used by Docker for image configurations, which are equivalent to OCI image configurations
+const MEDIA_TYPE_DOCKER_CONFIG = "application/vnd.docker.container.image.v1+json"
+
+// The maximum size of a blob with an unrecognised media type that will be read to determine whether it is an image index or image manifest
+const MAX_SNIFF_SIZE = 4 << 20
+
+// Options that control garbage collection
+type GarbageCollectionOptions struct {
+	
+	// The ChainIDs of additional unpacked layers that should be retained (e.g. layers used by images that are not stored in any of the OCI image layouts being collected)
+	RetainLayers []digest.Digest
+	
+	// Report what would be removed without actually removing anything
+	DryRun bool
+}
+
+// Represents the results of garbage collection
+type GarbageCollectionReport struct {
+	
+	// The number of blobs that were reachable and therefore retained
+	ReachableBlobs int
+	
+	// The number of unpacked layers that were reachable and therefore retained
+	ReachableLayers int
+	
+	// The paths of the unreachable blobs that were removed (or would be removed, for a dry run)
+	RemovedBlobs []string
+	
+	// The paths of the unreachable layer directories and stale staging directories that were removed (or would be removed, for a dry run)
+	RemovedLayers []string
+	
+	// The number of bytes of storage that were freed (or would be freed, for a dry run)
+	// (Files that are hardlinked from retained layers are not counted, since removing one of their links does not free any storage)
+	BytesFreed int64
+	
+	// Whether this was a dry run
+	DryRun bool
+}
+
+// Identifies an inode, for detecting files that are hardlinked from multiple locations
+type inodeKey struct {
+	
+	// The device that holds the inode
+	device uint64
+	
+	// The inode number
+	inode uint64
+}
+
+// Tracks the inodes in the paths being removed, so storage is only counted as freed once every link to an inode has been removed
+type freedSpace struct {
+	
+	// The number of links seen for each inode so far
+	links map[inodeKey]uint64
+	
+	// The total number of bytes freed so far
+	bytes int64
+}
+
+// Records a filesystem entry that is being removed
+func (freed *freedSpace) add(info fs.FileInfo) {
+	
+	// If we cannot identify the inode then simply count its size
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || info.IsDir() {
+		freed.bytes += info.Size()
+		return
+	}
+	
+	// Only count the inode's size once we have seen all of its links
+	key := inodeKey{device: uint64(stat.Dev), inode: uint64(stat.Ino)}
+	freed.links[key] += 1
+	if freed.links[key] == uint64(stat.Nlink) {
+		freed.bytes += info.Size()
+	}
+}
+
+// Records all of the entries under a path that is being removed
+func (freed *freedSpace) addTree(root string) error {
+	return filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		
+		freed.add(info)
+		return nil
+	})
+}
+
+// Tracks the blobs and layers that are reachable from a set of root descriptors
+type reachability struct {
+	
+	// The ImageUnpacker used to parse blobs
+	unpacker *ImageUnpacker
+	
+	// The descriptors for the reachable blobs, keyed by digest
+	blobs map[digest.Digest]oci.Descriptor
+	
+	// The encoded ChainIDs of the reachable unpacked layers
+	layers map[string]bool
+}
+
+// Determines whether the specified media type denotes an image manifest
+func isManifestMediaType(mediaType string) bool {
+	return mediaType == oci.MediaTypeImageManifest || mediaType == MEDIA_TYPE_DOCKER_MANIFEST
+}
+
+// Determines whether the specified media type denotes an image configuration
+func isConfigMediaType(mediaType string) bool {
+	return mediaType == oci.MediaTypeImageConfig || mediaType == MEDIA_TYPE_DOCKER_CONFIG
+}
+
+// Identifies the type of a blob referenced by a descriptor whose media type is not recognised, by inspecting its contents
+// (Blobs such as artifact manifests may reference other blobs, so a blob that cannot be identified is reported as an error rather than risking the removal of blobs that it references)
+func (reachable *reachability) sniffMediaType(descriptor oci.Descriptor) (string, error) {
+	
+	// Reports that the blob could not be identified
+	unrecognised := func() (string, error) {
+		return "", fmt.Errorf("cannot determine which blobs are referenced by blob %s with unrecognised media type %q", descriptor.Digest, descriptor.MediaType)
+	}
+	
+	// Don't read blobs that are too large to be an image index or image manifest
+	if descriptor.Size > MAX_SNIFF_SIZE {
+		return unrecognised()
+	}
+	
+	// Attempt to parse the blob as JSON
+	data, err := reachable.unpacker.readBlob(descriptor)
+	if err != nil {
+		return "", err
+	}
+	fields := &struct {
+		MediaType string `json:"mediaType"`
+		Manifests json.RawMessage `json:"manifests"`
+		Config json.RawMessage `json:"config"`
+	}{}
+	if err := json.Unmarshal(data, fields); err != nil {
+		return unrecognised()
+	}
+	
+	// Identify the blob from its embedded media type or its fields
+	switch {
+	case isIndexMediaType(fields.MediaType) || isManifestMediaType(fields.MediaType):
+		return fields.MediaType, nil
+	case fields.Manifests != nil:
+		return oci.MediaTypeImageIndex, nil
+	case fields.Config != nil:
+		return oci.MediaTypeImageManifest, nil
+	default:
+		return unrecognised()
+	}
+}
+
+// Marks the blob referenced by the specified descriptor as reachable, along with everything that it references
+func (reachable *reachability) mark(descriptor oci.Descriptor, depth int) error {
+	
+	// Guard against reference cycles between image indexes
+	if depth > MAX_INDEX_DEPTH {
+		return fmt.Errorf("image indexes are nested more than %d levels deep", MAX_INDEX_DEPTH)
+	}
+	
+	// Skip blobs that we have already processed
+	if _, exists := reachable.blobs[descriptor.Digest]; exists {
+		return nil
+	}
+	reachable.blobs[descriptor.Digest] = descriptor
+	
+	// Determine what type of blob the descriptor refers to, inspecting its contents if the media type is not recognised
+	mediaType := descriptor.MediaType
+	if !isIndexMediaType(mediaType) && !isManifestMediaType(mediaType) {
+		sniffed, err := reachable.sniffMediaType(descriptor)
+		if err != nil {
+			return err
+		}
+		mediaType = sniffed
+	}
+	
+	if isIndexMediaType(mediaType) {
+		
+		// Mark the manifests referenced by the image index
+		index := &oci.Index{}
+		if err := reachable.unpacker.parseBlob(descriptor, index); err != nil {
+			return err
+		}
+		for _, manifest := range index.Manifests {
+			if err := reachable.mark(manifest, depth + 1); err != nil {
+				return err
+			}
+		}
+		
+	} else {
+		
+		// Mark the configuration and layers referenced by the image manifest
+		manifest := &oci.Manifest{}
+		if err := reachable.unpacker.parseBlob(descriptor, manifest); err != nil {
+			return err
+		}
+		reachable.blobs[manifest.Config.Digest] = manifest.Config
+		for _, layer := range manifest.Layers {
+			reachable.blobs[layer.Digest] = layer
+		}
+		
+		// Mark the unpacked layers for the image, using the diff_ids from the image configuration
+		// (Manifests for other types of artifacts have no image configuration and are never unpacked)
+		if isConfigMediaType(manifest.Config.MediaType) {
+			config := &oci.Image{}
+			if err := reachable.unpacker.parseBlob(manifest.Config, config); err != nil {
+				return err
+			}
+			for _, chainID := range ChainIDs(config.RootFS.DiffIDs) {
+				reachable.layers[chainID.Encoded()] = true
+			}
+		}
+	}
+	
+	return nil
+}
+
+// Marks everything that is reachable from the OCI index for an image layout, returning the descriptors for the reachable blobs
+func markImageLayout(imageDir string, unpackDir string, layers map[string]bool) (map[digest.Digest]oci.Descriptor, error) {
+	
+	// Parse the OCI index for the image layout (an index without any image manifests is valid here, and simply means that nothing is reachable)
+	index := &oci.Index{}
+	if err := marshal.UnmarshalJsonFile(filepath.Join(imageDir, "index.json"), index); err != nil {
+		return nil, err
+	}
+	
+	// Mark everything that is reachable from the index
+	reachable := &reachability{
+		unpacker: &ImageUnpacker{imageDir: imageDir, source: os.DirFS(imageDir), unpackDir: unpackDir, index: index},
+		blobs: map[digest.Digest]oci.Descriptor{},
+		layers: layers,
+	}
+	for _, root := range index.Manifests {
+		if err := reachable.mark(root, 0); err != nil {
+			return nil, fmt.Errorf("image layout %s: %w", imageDir, err)
+		}
+	}
+	
+	return reachable.blobs, nil
+}
+
+// Removes the blobs that are not reachable from the OCI index for each of the specified image layouts, and the unpacked layers that are not reachable from any of them
+// (The unpack directory is shared by every image unpacked to it, so every image layout whose images were unpacked there must be specified, or their layers must be retained explicitly)
+// (Garbage collection must not run concurrently with unpacking, since the staging directories of layers that are being unpacked would be removed)
+func CollectGarbage(imageDirs []string, unpackDir string, options GarbageCollectionOptions) (*GarbageCollectionReport, error) {
+	if len(imageDirs) == 0 {
+		return nil, errors.New("at least one image layout must be specified for garbage collection")
+	}
+	
+	// Mark everything that is reachable from each of the image layouts, before removing anything from any of them
+	reachableLayers := map[string]bool{}
+	reachableBlobs := []map[digest.Digest]oci.Descriptor{}
+	for _, imageDir := range imageDirs {
+		blobs, err := markImageLayout(imageDir, unpackDir, reachableLayers)
+		if err != nil {
+			return nil, err
+		}
+		reachableBlobs = append(reachableBlobs, blobs)
+	}
+	for _, chainID := range options.RetainLayers {
+		if err := chainID.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid ChainID %q: %w", chainID, err)
+		}
+		reachableLayers[chainID.Encoded()] = true
+	}
+	
+	report := &GarbageCollectionReport{DryRun: options.DryRun}
+	freed := &freedSpace{links: map[inodeKey]uint64{}}
+	
+	// Identify the unreachable blobs in each image layout
+	for layoutIndex, imageDir := range imageDirs {
+		blobsDir := filepath.Join(imageDir, "blobs")
+		algorithms, err := os.ReadDir(blobsDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, algorithm := range algorithms {
+			if !algorithm.IsDir() {
+				continue
+			}
+			
+			entries, err := os.ReadDir(filepath.Join(blobsDir, algorithm.Name()))
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				blob := digest.NewDigestFromEncoded(digest.Algorithm(algorithm.Name()), entry.Name())
+				if _, exists := reachableBlobs[layoutIndex][blob]; exists {
+					report.ReachableBlobs += 1
+					continue
+				}
+				
+				info, err := entry.Info()
+				if err != nil {
+					return nil, err
+				}
+				freed.add(info)
+				report.RemovedBlobs = append(report.RemovedBlobs, filepath.Join(blobsDir, algorithm.Name(), entry.Name()))
+			}
+		}
+	}
+	
+	// Identify the unreachable unpacked layers and any staging directories left behind by interrupted unpacking operations
+	// (Directories that do not contain a completion record and are not staging directories were not created by us, so we leave them alone)
+	entries, err := os.ReadDir(unpackDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		
+		path := filepath.Join(unpackDir, entry.Name())
+		if !strings.HasSuffix(entry.Name(), STAGING_SUFFIX) {
+			
+			// Verify that the directory holds an unpacked layer
+			record := &LayerRecord{}
+			if err := marshal.UnmarshalJsonFile(filepath.Join(path, LAYER_RECORD_FILENAME), record); err != nil || record.ChainID.Encoded() != entry.Name() {
+				continue
+			}
+			
+			// Retain the layer if it is reachable
+			if reachableLayers[entry.Name()] {
+				report.ReachableLayers += 1
+				continue
+			}
+		}
+		
+		report.RemovedLayers = append(report.RemovedLayers, path)
+	}
+	
+	// Account for the storage used by the layers that will be removed
+	for _, path := range report.RemovedLayers {
+		if err := freed.addTree(path); err != nil {
+			return nil, err
+		}
+	}
+	report.BytesFreed = freed.bytes
+	
+	// Don't remove anything if this is a dry run
+	if options.DryRun {
+		return report, nil
+	}
+	
+	// Remove the unreachable blobs and layers
+	for _, path := range report.RemovedBlobs {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range report.RemovedLayers {
+		if err := os.RemoveAll(path); err != nil {
+			return nil, err
+		}
+	}
+	
+	return report, nil
+}
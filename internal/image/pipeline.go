@@ -0,0 +1,101 @@
+package image
+
+import (
+	"context"
+	"os"
+	"runtime"
+)
+
+// Returns the maximum number of layers that may be extracted concurrently
+func (unpacker *ImageUnpacker) concurrency() int {
+	if unpacker.Concurrency > 0 {
+		return unpacker.Concurrency
+	}
+	
+	return runtime.NumCPU()
+}
+
+// Extracts the specified layers concurrently, starting extractions in layer order and returning a channel for each layer that receives its result
+// (Once the context is cancelled, extractions in progress are interrupted and those not yet started receive the context's error)
+func (unpacker *ImageUnpacker) extractLayersAsync(ctx context.Context, layers []*UnpackedLayer) []<-chan error {
+	
+	// Create a channel to store the result for each layer
+	results := make([]chan error, len(layers))
+	channels := make([]<-chan error, len(layers))
+	for index := range layers {
+		results[index] = make(chan error, 1)
+		channels[index] = results[index]
+	}
+	
+	// Start extractions in layer order, so the layers that will be merged first are extracted first
+	go func() {
+		semaphore := make(chan struct{}, unpacker.concurrency())
+		for index, current := range layers {
+			
+			// Wait for a free extraction slot, unless the context has been cancelled
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				for _, result := range results[index:] {
+					result <- ctx.Err()
+					close(result)
+				}
+				return
+			}
+			
+			// Extract the layer in a separate goroutine, releasing its slot once it completes
+			go func(current *UnpackedLayer, result chan<- error) {
+				defer func() { <-semaphore }()
+				result <- unpacker.prepareLayer(ctx, current)
+				close(result)
+			}(current, results[index])
+		}
+	}()
+	
+	return channels
+}
+
+// Unpacks the layers at the specified indices, extracting them concurrently and applying their diffs sequentially in layer order
+// (The layers preceding each pending layer must either be pending themselves or already complete)
+func (unpacker *ImageUnpacker) unpackLayers(ctx context.Context, layers []UnpackedLayer, pending []int) error {
+	
+	// Start extracting the pending layers
+	pendingLayers := []*UnpackedLayer{}
+	for _, index := range pending {
+		pendingLayers = append(pendingLayers, &layers[index])
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	extractions := unpacker.extractLayersAsync(ctx, pendingLayers)
+	
+	// Apply the diff for each layer as soon as its extraction has completed
+	for position, index := range pending {
+		
+		// Wait for the layer's extraction to complete, and then apply its diff to the merged contents of its parent layer
+		err := <-extractions[position]
+		if err == nil {
+			var parent *UnpackedLayer
+			if index > 0 {
+				parent = &layers[index - 1]
+			}
+			err = unpacker.mergeLayer(ctx, &layers[index], parent)
+		}
+		
+		// If an error occurred then interrupt any extractions in progress and wait for them to finish
+		if err != nil {
+			cancel()
+			for _, extraction := range extractions[position + 1:] {
+				<-extraction
+			}
+			
+			// Remove the staging directories for the incomplete layers, leaving the layers that have already been committed so a subsequent attempt can resume
+			for _, incomplete := range pendingLayers[position:] {
+				os.RemoveAll(unpacker.StagingDir(incomplete.ChainID))
+			}
+			
+			return err
+		}
+	}
+	
+	return nil
+}
@@ -0,0 +1,388 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/cpu"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The media type used by Docker for manifest lists, which are equivalent to OCI image indexes
+const MEDIA_TYPE_DOCKER_MANIFEST_LIST = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+// The maximum depth to which nested image indexes will be followed (which guards against reference cycles)
+const MAX_INDEX_DEPTH = 8
+
+// Returns the platform of the host system
+// (For amd64 hosts the variant is the highest microarchitecture level that the CPU supports, so images built for newer levels can still be selected)
+func HostPlatform() oci.Platform {
+	return NormalizePlatform(oci.Platform{
+		OS: runtime.GOOS,
+		Architecture: runtime.GOARCH,
+		Variant: hostVariant(),
+	})
+}
+
+// Determines the variant of the host's architecture, returning an empty string if it cannot be detected
+func hostVariant() string {
+	if runtime.GOARCH != "amd64" {
+		return ""
+	}
+	
+	// Determine the amd64 microarchitecture level based on the CPU features that each level requires
+	x86 := cpu.X86
+	if !(x86.HasPOPCNT && x86.HasSSE3 && x86.HasSSSE3 && x86.HasSSE41 && x86.HasSSE42) {
+		return "v1"
+	}
+	if !(x86.HasAVX && x86.HasAVX2 && x86.HasBMI1 && x86.HasBMI2 && x86.HasFMA && x86.HasOSXSAVE) {
+		return "v2"
+	}
+	if !(x86.HasAVX512F && x86.HasAVX512BW && x86.HasAVX512CD && x86.HasAVX512DQ && x86.HasAVX512VL) {
+		return "v3"
+	}
+
+	return "v4"
+}
+
+// The platform fields of an image configuration
+// (The version of the OCI image specification that we depend upon predates the variant and OS version fields)
+type configPlatform struct {
+	
+	// The operating system
+	OS string `json:"os"`
+	
+	// The CPU architecture
+	Architecture string `json:"architecture"`
+	
+	// The variant of the CPU architecture
+	Variant string `json:"variant,omitempty"`
+	
+	// The version of the operating system
+	OSVersion string `json:"os.version,omitempty"`
+	
+	// The operating system features required by the image
+	OSFeatures []string `json:"os.features,omitempty"`
+}
+
+// Parses the platform targeted by an image from its image configuration
+func parseConfigPlatform(data []byte) (oci.Platform, error) {
+	config := &configPlatform{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return oci.Platform{}, err
+	}
+	
+	return oci.Platform{
+		OS: config.OS,
+		Architecture: config.Architecture,
+		Variant: config.Variant,
+		OSVersion: config.OSVersion,
+		OSFeatures: config.OSFeatures,
+	}, nil
+}
+
+// Normalizes the OS, architecture and variant of a platform so that equivalent platforms compare equal
+// (e.g. "aarch64" becomes "arm64/v8" and "arm" becomes "arm/v7")
+func NormalizePlatform(platform oci.Platform) oci.Platform {
+	
+	// Normalize the OS name
+	platform.OS = strings.ToLower(platform.OS)
+	if platform.OS == "macos" {
+		platform.OS = "darwin"
+	}
+	
+	// Normalize the architecture name and apply the default variant for architectures that have one
+	platform.Architecture = strings.ToLower(platform.Architecture)
+	platform.Variant = strings.ToLower(platform.Variant)
+	switch platform.Architecture {
+	
+	case "i386":
+		platform.Architecture = "386"
+	
+	case "x86_64", "x86-64", "amd64":
+		platform.Architecture = "amd64"
+		if platform.Variant == "" {
+			platform.Variant = "v1"
+		}
+	
+	case "aarch64", "arm64":
+		platform.Architecture = "arm64"
+		if platform.Variant == "" || platform.Variant == "8" {
+			platform.Variant = "v8"
+		}
+	
+	case "armhf", "armel", "arm":
+		if platform.Variant == "" {
+			if platform.Architecture == "armel" {
+				platform.Variant = "v6"
+			} else {
+				platform.Variant = "v7"
+			}
+		}
+		platform.Architecture = "arm"
+	}
+	
+	// Ensure numeric variants are prefixed with "v"
+	if _, err := strconv.ParseFloat(platform.Variant, 64); err == nil {
+		platform.Variant = "v" + platform.Variant
+	}
+	
+	return platform
+}
+
+// Parses a variant of the form "v7" or "v8.2" as a number, for comparing variants of the same architecture
+func parseVariant(variant string) (float64, bool) {
+	if !strings.HasPrefix(variant, "v") {
+		return 0, false
+	}
+	
+	value, err := strconv.ParseFloat(strings.TrimPrefix(variant, "v"), 64)
+	return value, err == nil
+}
+
+// Determines whether the OS version of a candidate platform is compatible with the requested OS version
+// (The requested version's components must match the leading components of the candidate's version)
+func osVersionMatches(requested string, candidate string) bool {
+	if requested == "" || candidate == "" {
+		return true
+	}
+	
+	requestedParts := strings.Split(requested, ".")
+	candidateParts := strings.Split(candidate, ".")
+	if len(candidateParts) < len(requestedParts) {
+		return false
+	}
+	
+	for index, part := range requestedParts {
+		if candidateParts[index] != part {
+			return false
+		}
+	}
+	
+	return true
+}
+
+// Determines whether all of the OS features required by a candidate platform are supported by the requested platform
+func osFeaturesMatch(requested []string, candidate []string) bool {
+	supported := map[string]bool{}
+	for _, feature := range requested {
+		supported[feature] = true
+	}
+	
+	for _, feature := range candidate {
+		if !supported[feature] {
+			return false
+		}
+	}
+	
+	return true
+}
+
+// Scores how well a candidate platform matches the requested platform, returning false if the candidate cannot run on the requested platform
+// (Higher scores indicate better matches: an exact variant match scores highest, followed by the closest older compatible variant)
+func MatchPlatform(requested oci.Platform, candidate oci.Platform) (float64, bool) {
+	
+	// The OS and architecture must match exactly
+	requested = NormalizePlatform(requested)
+	candidate = NormalizePlatform(candidate)
+	if requested.OS != candidate.OS || requested.Architecture != candidate.Architecture {
+		return 0, false
+	}
+	
+	// The OS version and features must be compatible
+	if !osVersionMatches(requested.OSVersion, candidate.OSVersion) || !osFeaturesMatch(requested.OSFeatures, candidate.OSFeatures) {
+		return 0, false
+	}
+	
+	// An exact variant match is always the best possible match
+	if requested.Variant == candidate.Variant {
+		return 1000, true
+	}
+	
+	// Older variants can run on newer variants of the same architecture (e.g. an arm/v6 image can run on arm/v7)
+	requestedVariant, requestedOk := parseVariant(requested.Variant)
+	candidateVariant, candidateOk := parseVariant(candidate.Variant)
+	if requestedOk && candidateOk && candidateVariant < requestedVariant {
+		return candidateVariant, true
+	}
+	
+	return 0, false
+}
+
+// Parses a platform string of the form "os/arch[/variant]"
+func ParsePlatform(platform string) (oci.Platform, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return oci.Platform{}, fmt.Errorf("invalid platform %q, expected the format os/arch[/variant]", platform)
+	}
+	
+	parsed := oci.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		parsed.Variant = parts[2]
+	}
+	
+	return parsed, nil
+}
+
+// Formats a platform as a human-readable string
+func FormatPlatform(platform oci.Platform) string {
+	formatted := fmt.Sprintf("%s/%s", platform.OS, platform.Architecture)
+	if platform.Variant != "" {
+		formatted = fmt.Sprintf("%s/%s", formatted, platform.Variant)
+	}
+	if platform.OSVersion != "" {
+		formatted = fmt.Sprintf("%s (%s)", formatted, platform.OSVersion)
+	}
+	
+	return formatted
+}
+
+// Represents an image manifest found while resolving an image index, along with the platform it targets
+type manifestCandidate struct {
+	
+	// The descriptor for the image manifest
+	descriptor oci.Descriptor
+	
+	// The platform targeted by the image manifest
+	platform oci.Platform
+}
+
+// Determines whether the specified media type denotes an image index
+func isIndexMediaType(mediaType string) bool {
+	return mediaType == oci.MediaTypeImageIndex || mediaType == MEDIA_TYPE_DOCKER_MANIFEST_LIST
+}
+
+// Recursively gathers the image manifests referenced by a list of descriptors, following nested image indexes
+func (unpacker *ImageUnpacker) gatherManifests(descriptors []oci.Descriptor, requested *oci.Platform, depth int) ([]manifestCandidate, error) {
+	
+	// Guard against reference cycles between image indexes
+	if depth > MAX_INDEX_DEPTH {
+		return nil, fmt.Errorf("image indexes are nested more than %d levels deep", MAX_INDEX_DEPTH)
+	}
+	
+	candidates := []manifestCandidate{}
+	for index := range descriptors {
+		descriptor := descriptors[index]
+		
+		// Skip any descriptor that specifies a platform that cannot possibly match the requested platform
+		if requested != nil && descriptor.Platform != nil {
+			if _, matches := MatchPlatform(*requested, *descriptor.Platform); !matches {
+				continue
+			}
+		}
+		
+		// Determine whether the descriptor refers to a nested image index
+		if isIndexMediaType(descriptor.MediaType) {
+			
+			// Parse the nested index and gather its image manifests recursively
+			nested := &oci.Index{}
+			if err := unpacker.parseBlob(descriptor, nested); err != nil {
+				return nil, err
+			}
+			nestedCandidates, err := unpacker.gatherManifests(nested.Manifests, requested, depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, nestedCandidates...)
+			
+		} else {
+			
+			// Determine the platform targeted by the image manifest
+			platform, err := unpacker.manifestPlatform(descriptor)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, manifestCandidate{descriptor: descriptor, platform: platform})
+		}
+	}
+	
+	return candidates, nil
+}
+
+// Determines the platform targeted by an image manifest, consulting the image configuration if the descriptor does not specify a platform
+func (unpacker *ImageUnpacker) manifestPlatform(descriptor oci.Descriptor) (oci.Platform, error) {
+	
+	// Use the platform from the descriptor if one was specified
+	if descriptor.Platform != nil {
+		return *descriptor.Platform, nil
+	}
+	
+	// Parse the manifest and the image configuration that it references
+	manifest := &oci.Manifest{}
+	if err := unpacker.parseBlob(descriptor, manifest); err != nil {
+		return oci.Platform{}, err
+	}
+	config, err := unpacker.readBlob(manifest.Config)
+	if err != nil {
+		return oci.Platform{}, err
+	}
+	
+	return parseConfigPlatform(config)
+}
+
+// Gathers the image manifests that best match the specified platform from a list of descriptors, in the order they were found
+// (If no platform is specified then the host platform is used, falling back to the sole image manifest if there is only one)
+func (unpacker *ImageUnpacker) bestManifests(descriptors []oci.Descriptor, platform *oci.Platform) ([]manifestCandidate, error) {
+	
+	// Default to the host platform if no platform was specified
+	requested := platform
+	if requested == nil {
+		host := HostPlatform()
+		requested = &host
+	}
+	
+	// Gather the candidate image manifests, following nested image indexes
+	candidates, err := unpacker.gatherManifests(descriptors, requested, 0)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Identify the candidates that best match the requested platform
+	best := []manifestCandidate{}
+	bestScore := 0.0
+	for _, candidate := range candidates {
+		if score, matches := MatchPlatform(*requested, candidate.platform); matches {
+			if len(best) == 0 || score > bestScore {
+				best = []manifestCandidate{candidate}
+				bestScore = score
+			} else if score == bestScore {
+				best = append(best, candidate)
+			}
+		}
+	}
+	
+	if len(best) > 0 {
+		return best, nil
+	}
+	
+	// Gather all of the available image manifests, regardless of platform
+	all, err := unpacker.gatherManifests(descriptors, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	
+	// If the caller did not request a specific platform and there is only one image manifest then use it
+	if platform == nil && len(all) == 1 {
+		return all, nil
+	}
+	
+	// Report the platforms that are available
+	available := []string{}
+	for _, candidate := range all {
+		available = append(available, FormatPlatform(candidate.platform))
+	}
+	return nil, fmt.Errorf("could not find image manifest matching platform %s (available platforms: %s)", FormatPlatform(*requested), strings.Join(available, ", "))
+}
+
+// Resolves the image manifest that best matches the specified platform from a list of descriptors, preferring the earliest manifest in the event of a tie
+func (unpacker *ImageUnpacker) resolveManifest(descriptors []oci.Descriptor, platform *oci.Platform) (oci.Descriptor, error) {
+	best, err := unpacker.bestManifests(descriptors, platform)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	return best[0].descriptor, nil
+}
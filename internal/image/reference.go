@@ -0,0 +1,141 @@
+package image
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Represents a reference that did not match any of the images in an OCI image layout
+type ReferenceNotFoundError struct {
+	
+	// The reference that was requested
+	Reference string
+	
+	// The reference names that are available in the image layout
+	Available []string
+}
+
+// Formats the error message, listing the available reference names
+func (e *ReferenceNotFoundError) Error() string {
+	if len(e.Available) == 0 {
+		return fmt.Sprintf("could not find an image matching reference %q (the image layout does not contain any named references)", e.Reference)
+	}
+	
+	return fmt.Sprintf("could not find an image matching reference %q (available references: %s)", e.Reference, strings.Join(e.Available, ", "))
+}
+
+// Represents a reference that matched more than one image in an OCI image layout
+type AmbiguousReferenceError struct {
+	
+	// The reference that was requested
+	Reference string
+	
+	// The digests of the image manifests that matched the reference
+	Matches []digest.Digest
+}
+
+// Formats the error message, listing the digests of the matching images
+func (e *AmbiguousReferenceError) Error() string {
+	matches := []string{}
+	for _, match := range e.Matches {
+		matches = append(matches, match.String())
+	}
+	
+	return fmt.Sprintf("reference %q is ambiguous, since it matches multiple images (%s), specify a platform or a digest to select one", e.Reference, strings.Join(matches, ", "))
+}
+
+// Returns the sorted list of distinct reference names in the OCI index
+func (unpacker *ImageUnpacker) References() []string {
+	unique := map[string]bool{}
+	for _, descriptor := range unpacker.index.Manifests {
+		if name, exists := descriptor.Annotations[oci.AnnotationRefName]; exists {
+			unique[name] = true
+		}
+	}
+	
+	references := []string{}
+	for name := range unique {
+		references = append(references, name)
+	}
+	
+	sort.Strings(references)
+	return references
+}
+
+// Selects the descriptors in the OCI index that match the specified reference
+// (The reference may be either the value of an `org.opencontainers.image.ref.name` annotation or a digest)
+func (unpacker *ImageUnpacker) selectReference(reference string) ([]oci.Descriptor, error) {
+	
+	// Determine whether the reference is a digest
+	if parsed, err := digest.Parse(reference); err == nil {
+		
+		// Search the top-level descriptors for the digest
+		for _, descriptor := range unpacker.index.Manifests {
+			if descriptor.Digest == parsed {
+				return []oci.Descriptor{descriptor}, nil
+			}
+		}
+		
+		// Search the image manifests in any nested image indexes for the digest
+		all, err := unpacker.gatherManifests(unpacker.index.Manifests, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range all {
+			if candidate.descriptor.Digest == parsed {
+				return []oci.Descriptor{candidate.descriptor}, nil
+			}
+		}
+		
+		return nil, &ReferenceNotFoundError{Reference: reference, Available: unpacker.References()}
+	}
+	
+	// Select the descriptors whose reference name annotation matches the reference
+	matches := []oci.Descriptor{}
+	for _, descriptor := range unpacker.index.Manifests {
+		if descriptor.Annotations[oci.AnnotationRefName] == reference {
+			matches = append(matches, descriptor)
+		}
+	}
+	
+	if len(matches) == 0 {
+		return nil, &ReferenceNotFoundError{Reference: reference, Available: unpacker.References()}
+	}
+	
+	return matches, nil
+}
+
+// Resolves the image manifest for the specified reference and platform
+func (unpacker *ImageUnpacker) resolveReference(reference string, platform *oci.Platform) (oci.Descriptor, error) {
+	
+	// Select the descriptors that match the reference
+	descriptors, err := unpacker.selectReference(reference)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	// Identify the image manifests that best match the platform
+	best, err := unpacker.bestManifests(descriptors, platform)
+	if err != nil {
+		return oci.Descriptor{}, fmt.Errorf("reference %q: %w", reference, err)
+	}
+	
+	// Verify that the reference and platform identify exactly one image manifest
+	distinct := []digest.Digest{}
+	seen := map[digest.Digest]bool{}
+	for _, candidate := range best {
+		if !seen[candidate.descriptor.Digest] {
+			seen[candidate.descriptor.Digest] = true
+			distinct = append(distinct, candidate.descriptor.Digest)
+		}
+	}
+	if len(distinct) > 1 {
+		return oci.Descriptor{}, &AmbiguousReferenceError{Reference: reference, Matches: distinct}
+	}
+	
+	return best[0].descriptor, nil
+}
@@ -0,0 +1,135 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/macoscontainers/experiments/internal/compression"
+	"github.com/macoscontainers/experiments/internal/layer"
+	digest "github.com/opencontainers/go-digest"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Options that control how the layers of an image are squashed
+type SquashOptions struct {
+	
+	// The index of the first layer to squash (layers below this are preserved unmodified, so the image can continue to share them with its base image)
+	From int
+	
+	// The index after the last layer to squash (defaults to the number of layers if zero, so that all layers from the first layer onwards are squashed)
+	To int
+	
+	// The name of the codec used to compress the squashed layer archive (defaults to gzip if empty)
+	Compression string
+	
+	// The value of the `org.opencontainers.image.ref.name` annotation for the new image (optional)
+	RefName string
+	
+	// The description of the squashed layer, as recorded in the image history (optional)
+	CreatedBy string
+}
+
+// Replaces the history entries for the layers in the specified range with a single entry
+// (History entries for empty layers that fall between the squashed layers are discarded, and if the history does not describe every layer then it is returned unmodified)
+func SquashHistory(history []oci.History, from int, to int, numLayers int, entry oci.History) []oci.History {
+	
+	// Verify that the history describes every layer
+	if len(history) - countEmptyLayers(history) != numLayers {
+		return history
+	}
+	
+	squashed := []oci.History{}
+	layerIndex := 0
+	for _, current := range history {
+		if current.EmptyLayer {
+			
+			// Discard empty layer entries that fall between the entries for the first and last squashed layers
+			if layerIndex <= from || layerIndex >= to {
+				squashed = append(squashed, current)
+			}
+			
+		} else {
+			
+			// Replace the entries for the squashed layers with a single entry at the position of the last squashed layer
+			if layerIndex < from || layerIndex >= to {
+				squashed = append(squashed, current)
+			} else if layerIndex == to - 1 {
+				squashed = append(squashed, entry)
+			}
+			layerIndex += 1
+		}
+	}
+	
+	return squashed
+}
+
+// Counts the number of history entries that do not correspond to filesystem layers
+func countEmptyLayers(history []oci.History) int {
+	count := 0
+	for _, entry := range history {
+		if entry.EmptyLayer {
+			count += 1
+		}
+	}
+	
+	return count
+}
+
+// Squashes a range of layers in an unpacked image into a single layer, returning the descriptor for the new image manifest
+// (The original image and its layers are left intact, and the new image is added to the OCI index)
+func (unpacker *ImageUnpacker) Squash(ctx context.Context, image *UnpackedImage, options SquashOptions) (oci.Descriptor, error) {
+	
+	// Validate the range of layers to squash
+	from, to := options.From, options.To
+	if to == 0 {
+		to = len(image.Layers)
+	}
+	if from < 0 || to > len(image.Layers) || from >= to {
+		return oci.Descriptor{}, fmt.Errorf("invalid range of layers to squash [%d, %d) for an image with %d layers", from, to, len(image.Layers))
+	}
+	
+	// Combine the diffs for the layers into a temporary directory
+	squashedDir, err := os.MkdirTemp(unpacker.unpackDir, ".squash-*")
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	defer os.RemoveAll(squashedDir)
+	squasher := &layer.DiffSquasher{SquashedDir: squashedDir, BaseLayer: from == 0}
+	for _, current := range image.Layers[from:to] {
+		squasher.DiffDirs = append(squasher.DiffDirs, current.DiffDir)
+	}
+	if err := squasher.Squash(ctx); err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	// Pack the combined diff into a layer archive blob
+	codecName := options.Compression
+	if codecName == "" {
+		codecName = compression.CODEC_GZIP
+	}
+	packer := &layer.LayerPacker{DiffDir: squashedDir, IDMappings: unpacker.IDMappings, Xattrs: unpacker.Xattrs}
+	layerDescriptor, diffID, err := unpacker.writeLayerBlob(codecName, func(writer io.Writer) error {
+		return packer.PackContext(ctx, writer)
+	})
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	// Create the updated image configuration, replacing the diff_ids and history entries for the squashed layers
+	now := time.Now().UTC()
+	config := *image.Config
+	config.Created = &now
+	config.RootFS.DiffIDs = append(append(append([]digest.Digest{}, image.Config.RootFS.DiffIDs[:from]...), diffID), image.Config.RootFS.DiffIDs[to:]...)
+	createdBy := options.CreatedBy
+	if createdBy == "" {
+		createdBy = fmt.Sprintf("squashed layers %d to %d", from, to - 1)
+	}
+	config.History = SquashHistory(image.Config.History, from, to, len(image.Layers), oci.History{Created: &now, CreatedBy: createdBy})
+	
+	// Write the new image and add it to the OCI index
+	layers := append(append(append([]oci.Descriptor{}, image.Manifest.Layers[:from]...), layerDescriptor), image.Manifest.Layers[to:]...)
+	return unpacker.writeImage(image, &config, layers, options.RefName)
+}
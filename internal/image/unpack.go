@@ -1,39 +1,124 @@
 package image
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"time"
 
+	"github.com/macoscontainers/experiments/internal/compression"
 	"github.com/macoscontainers/experiments/internal/filesystem"
 	"github.com/macoscontainers/experiments/internal/layer"
-	"github.com/macoscontainers/experiments/internal/marshal"
-	archiver "github.com/mholt/archiver/v3"
+	"github.com/macoscontainers/experiments/internal/progress"
+	digest "github.com/opencontainers/go-digest"
 	oci "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // Provides functionality for unpacking OCI container images
 type ImageUnpacker struct {
 	
-	// The directory containing the OCI directory layout for the container image that we will unpack
+	// The directory containing the OCI directory layout for the container image that we will unpack (empty if the image source is read-only)
 	imageDir string
 	
+	// Provides access to the files in the OCI image layout, relative to the root of the layout
+	source fs.FS
+	
 	// The output directory to which we should unpack filesystem layers
 	unpackDir string
 	
 	// The OCI index for the container image that we will unpack
 	index *oci.Index
+	
+	// The registry used to select decompressors for layer archive blobs (defaults to compression.Default if nil)
+	Codecs *compression.Registry
+	
+	// The maximum number of layers to extract concurrently (defaults to the number of CPU cores if zero)
+	Concurrency int
+	
+	// The limits on the resources that extracting each layer may consume (all resources are unlimited by default)
+	Limits layer.ExtractionLimits
+	
+	// The mappings used to translate the user and group IDs in layer archives to the IDs that will own the unpacked files, and back again when layers are committed (optional)
+	// (Layers that were previously unpacked with different mappings are unpacked again rather than being reused)
+	IDMappings *layer.IDMappings
+	
+	// Determines which extended attributes are extracted from layer archives and written when layers are committed (optional, uses layer.DefaultXattrFilter() if nil)
+	// (Layers that were previously unpacked with a different filter are unpacked again rather than being reused)
+	Xattrs *layer.XattrFilter
+	
+	// The observer that will receive progress events (optional)
+	Observer progress.Observer
 }
 
 // Creates an ImageUnpacker with the specified options
 func UnpackerForImage(imageDir string, unpackDir string) (*ImageUnpacker, error) {
+	unpacker, err := UnpackerForSource(os.DirFS(imageDir), unpackDir)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Images in OCI layout directories can be modified
+	unpacker.imageDir = imageDir
+	return unpacker, nil
+}
+
+// Creates an ImageUnpacker for an `oci-archive` tarball or a `docker save` tarball, reading blobs directly from the archive rather than extracting it
+// (The returned ImageUnpacker is read-only, and should be closed once it is no longer needed in order to close the archive)
+func UnpackerForArchive(archive string, unpackDir string) (*ImageUnpacker, error) {
+	source, err := OpenArchive(archive)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Archives that contain an OCI index are read as-is, and archives that contain a Docker manifest are presented as an OCI image layout
+	var layout fs.FS = source
+	if !source.Exists("index.json") && source.Exists(DOCKER_MANIFEST_FILENAME) {
+		docker, err := newDockerArchiveSource(source)
+		if err != nil {
+			source.Close()
+			return nil, fmt.Errorf("failed to read docker archive %s: %w", archive, err)
+		}
+		layout = docker
+	}
+	
+	unpacker, err := UnpackerForSource(layout, unpackDir)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	
+	return unpacker, nil
+}
+
+// Creates an ImageUnpacker for either an OCI layout directory or an `oci-archive` tarball, depending on the type of the specified path
+func UnpackerForPath(imagePath string, unpackDir string) (*ImageUnpacker, error) {
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	
+	if info.IsDir() {
+		return UnpackerForImage(imagePath, unpackDir)
+	}
+	
+	return UnpackerForArchive(imagePath, unpackDir)
+}
+
+// Creates a read-only ImageUnpacker for an OCI image layout provided by an arbitrary filesystem
+func UnpackerForSource(source fs.FS, unpackDir string) (*ImageUnpacker, error) {
 	
 	// Attempt to parse the OCI index for the specified container image
 	index := &oci.Index{}
-	if err := marshal.UnmarshalJsonFile(filepath.Join(imageDir, "index.json"), index); err != nil {
+	data, err := fs.ReadFile(source, "index.json")
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, index); err != nil {
 		return nil, err
 	}
 	
@@ -44,143 +129,350 @@ func UnpackerForImage(imageDir string, unpackDir string) (*ImageUnpacker, error)
 	
 	// Return a populated ImageUnpacker object
 	return &ImageUnpacker{
-		imageDir: imageDir,
+		source: source,
 		unpackDir: unpackDir,
 		index: index,
 	}, nil
 }
 
-// Returns an unarchiver object for the archive type denoted by the specified MIME type
-func (unpacker *ImageUnpacker) unarchiverForMime(mimetype string) (archiver.Unarchiver, error) {
-	switch mimetype {
+// Closes the image source if it holds any open files (e.g. an `oci-archive` tarball)
+func (unpacker *ImageUnpacker) Close() error {
+	if closer, ok := unpacker.source.(io.Closer); ok {
+		return closer.Close()
+	}
 	
-	case "application/vnd.oci.image.layer.v1.tar":
-		return archiver.NewTar(), nil
+	return nil
+}
+
+// Returns the registry used to select decompressors for layer archive blobs
+func (unpacker *ImageUnpacker) codecs() *compression.Registry {
+	if unpacker.Codecs != nil {
+		return unpacker.Codecs
+	}
 	
-	case "application/vnd.oci.image.layer.v1.tar+gzip":
-		return archiver.NewTarGz(), nil
+	return compression.Default
+}
+
+// Represents the result of unpacking a container image
+type UnpackedImage struct {
 	
-	default:
-		return nil, fmt.Errorf("unsupported archive format %s", mimetype)
-	}
+	// The descriptor for the image manifest
+	Descriptor oci.Descriptor
+	
+	// The image manifest for the unpacked image
+	Manifest *oci.Manifest
+	
+	// The image configuration for the unpacked image
+	Config *oci.Image
+	
+	// The unpacked filesystem layers, in order from the base layer to the topmost layer
+	Layers []UnpackedLayer
 }
 
-// Unpacks the filesystem layers in the version of the image for the specified platform, applying the diffs for each successive layer
-func (unpacker *ImageUnpacker) Unpack(platform *oci.Platform) (*oci.Manifest, error) {
+// The error reported when extracting a filesystem layer exceeds one of the unpacker's extraction limits
+type LayerLimitError struct {
 	
-	// Determine whether we are searching for a manifest that matches the a platform or just using the first available manifest
-	var descriptor *oci.Descriptor
-	if platform == nil {
-		
-		// Use the first manifest in the index
-		descriptor = &unpacker.index.Manifests[0]
+	// The digest of the layer's archive blob
+	Layer digest.Digest
+	
+	// The details of the limit that was exceeded
+	Limit *layer.LimitExceededError
+}
+
+// Formats the error message, naming the layer and the limit that it exceeded
+func (e *LayerLimitError) Error() string {
+	return fmt.Sprintf("layer %s exceeded an extraction limit: %s", e.Layer, e.Limit)
+}
+
+// Returns the details of the limit that was exceeded, so callers can inspect them with errors.As()
+func (e *LayerLimitError) Unwrap() error {
+	return e.Limit
+}
+
+// Extracts the archive blob for a filesystem layer to the specified diff directory, verifying both the blob and its uncompressed contents as they are read
+func (unpacker *ImageUnpacker) extractLayer(ctx context.Context, descriptor oci.Descriptor, diffID digest.Digest, diffDir string, observer progress.Observer) error {
+	
+	// Open the archive blob for the filesystem layer
+	blob, err := unpacker.openBlob(descriptor)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	
+	// Decompress the archive blob based on its media type, reporting any mismatch between the media type and the blob's contents
+	archive, codec, err := unpacker.codecs().Decompress(descriptor.MediaType, blob)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	if mismatch := unpacker.codecs().CheckMediaType(descriptor.MediaType, codec); mismatch != nil {
+		progress.Notify(observer, progress.Event{Type: progress.MediaTypeMismatch, Err: mismatch})
+	}
+	
+	// Compute the digest of the uncompressed contents as they are extracted, reporting progress as we go
+	if err := diffID.Validate(); err != nil {
+		return fmt.Errorf("invalid diff_id %q for layer %s: %w", diffID, descriptor.Digest, err)
+	}
+	digester := diffID.Algorithm().Digester()
+	uncompressed := io.TeeReader(progress.NewReader(archive, observer), digester.Hash())
+	
+	// Bound the total amount of uncompressed data that is read, including any data that follows the end of the archive
+	uncompressed = unpacker.Limits.LimitReader(uncompressed)
+	
+	// Extract the contents of the archive to the diff directory
+	extractor := &layer.LayerExtractor{DiffDir: diffDir, Limits: unpacker.Limits, IDMappings: unpacker.IDMappings, Xattrs: unpacker.Xattrs}
+	if err := extractor.ExtractContext(ctx, uncompressed); err != nil {
 		
-	} else {
+		// If the context was cancelled then report the cancellation rather than attempting to verify the blob
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		
-		// Search for a manifest that matches the specified platform
-		for _, candidate := range unpacker.index.Manifests {
-			if candidate.Platform != nil && candidate.Platform.OS == platform.OS && candidate.Platform.Architecture == platform.Architecture {
-				descriptor = &candidate
-				break
-			}
+		// If an extraction limit was exceeded then abort immediately rather than reading the rest of the blob to verify it
+		var exceeded *layer.LimitExceededError
+		if errors.As(err, &exceeded) {
+			return &LayerLimitError{Layer: descriptor.Digest, Limit: exceeded}
 		}
 		
-		// If no matching manifest was found then stop processing immediately
-		if descriptor == nil {
-			return nil, fmt.Errorf("could not find image manifest matching platform %s/%s", platform.OS, platform.Architecture)
+		return blob.explain(err)
+	}
+	
+	// Consume any uncompressed data that the tar reader did not read (e.g. padding after the end-of-archive marker)
+	// (This must happen before the blob is verified, since verification consumes the rest of the blob without passing it through the diff_id digester)
+	if _, err := io.Copy(io.Discard, uncompressed); err != nil {
+		var exceeded *layer.LimitExceededError
+		if errors.As(err, &exceeded) {
+			return &LayerLimitError{Layer: descriptor.Digest, Limit: exceeded}
 		}
+		return blob.explain(err)
+	}
+	
+	// Verify that the blob's contents match its descriptor
+	if err := blob.Verify(); err != nil {
+		return err
+	}
+	
+	// Verify that the uncompressed contents match the diff_id
+	if actual := digester.Digest(); actual != diffID {
+		return &DiffIDMismatchError{
+			Layer: descriptor.Digest,
+			Expected: diffID,
+			Actual: actual,
+		}
+	}
+	
+	return nil
+}
+
+// Parses the JSON blob referenced by the specified descriptor after verifying its contents
+func (unpacker *ImageUnpacker) parseBlob(descriptor oci.Descriptor, out interface{}) error {
+	
+	// Read and verify the blob
+	data, err := unpacker.readBlob(descriptor)
+	if err != nil {
+		return err
+	}
+	
+	// Parse the JSON data
+	return json.Unmarshal(data, out)
+}
+
+// Parses the image configuration referenced by the specified manifest and verifies that it describes the manifest's layers
+func (unpacker *ImageUnpacker) parseConfig(manifest *oci.Manifest) (*oci.Image, error) {
+	
+	// Parse the image configuration
+	config := &oci.Image{}
+	if err := unpacker.parseBlob(manifest.Config, config); err != nil {
+		return nil, err
 	}
 	
-	// Resolve the path to the directory that holds the blobs for the OCI image
-	blobsDir := filepath.Join(unpacker.imageDir, "blobs", "sha256")
+	// Verify that the configuration specifies a diff_id for each of the filesystem layers
+	if config.RootFS.Type != "layers" {
+		return nil, fmt.Errorf("unsupported rootfs type %q in image configuration %s", config.RootFS.Type, manifest.Config.Digest)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("image configuration %s specifies %d diff_ids but the manifest specifies %d layers", manifest.Config.Digest, len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	
+	return config, nil
+}
+
+// Unpacks the filesystem layers in the version of the image for the specified platform, applying the diffs for each successive layer
+// (If the platform is nil then the version of the image for the host platform is unpacked, or the only version if there is just one)
+func (unpacker *ImageUnpacker) Unpack(platform *oci.Platform) (*UnpackedImage, error) {
+	return unpacker.UnpackContext(context.Background(), platform)
+}
+
+// Performs the same processing as Unpack(), but stops as soon as possible once the specified context is cancelled
+// (Any layers that were not completed are removed, so a subsequent attempt can resume from the last completed layer)
+func (unpacker *ImageUnpacker) UnpackContext(ctx context.Context, platform *oci.Platform) (*UnpackedImage, error) {
+	
+	// Resolve the image manifest for the requested platform
+	descriptor, err := unpacker.resolveManifest(unpacker.index.Manifests, platform)
+	if err != nil {
+		return nil, err
+	}
+	
+	return unpacker.unpackManifest(ctx, descriptor)
+}
+
+// Unpacks the image identified by the specified reference, which may be either the value of an `org.opencontainers.image.ref.name` annotation or a digest
+// (If the reference identifies a multi-platform image then the version for the specified platform is unpacked, as per Unpack())
+func (unpacker *ImageUnpacker) UnpackReference(reference string, platform *oci.Platform) (*UnpackedImage, error) {
+	return unpacker.UnpackReferenceContext(context.Background(), reference, platform)
+}
+
+// Performs the same processing as UnpackReference(), but stops as soon as possible once the specified context is cancelled
+func (unpacker *ImageUnpacker) UnpackReferenceContext(ctx context.Context, reference string, platform *oci.Platform) (*UnpackedImage, error) {
+	
+	// Resolve the image manifest for the requested reference and platform
+	descriptor, err := unpacker.resolveReference(reference, platform)
+	if err != nil {
+		return nil, err
+	}
+	
+	return unpacker.unpackManifest(ctx, descriptor)
+}
+
+// Unpacks the filesystem layers for the image manifest with the specified descriptor
+func (unpacker *ImageUnpacker) unpackManifest(ctx context.Context, descriptor oci.Descriptor) (*UnpackedImage, error) {
 	
 	// Parse the manifest
 	manifest := &oci.Manifest{}
-	if err := marshal.UnmarshalJsonFile(filepath.Join(blobsDir, descriptor.Digest.Hex()), manifest); err != nil {
+	if err := unpacker.parseBlob(descriptor, manifest); err != nil {
 		return nil, err
 	}
 	
-	// Unpack each of the filesystem layers in turn
-	var previousLayer oci.Descriptor
-	for index, layerDetails := range manifest.Layers {
-		
-		// Resolve the path to the diff and merged directories for the current filesystem layer
-		diffDir := filepath.Join(unpacker.unpackDir, layerDetails.Digest.Hex(), "diff")
-		mergedDir := filepath.Join(unpacker.unpackDir, layerDetails.Digest.Hex(), "merged")
-		
-		// Remove the diff directory if it already exists
-		if filesystem.Exists(diffDir) {
-			if err := os.RemoveAll(diffDir); err != nil {
-				return nil, err
-			}
+	// Parse the image configuration before unpacking any filesystem layers
+	config, err := unpacker.parseConfig(manifest)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Identify the filesystem layers that need to be unpacked, reusing any layers that have already been unpacked
+	// (either by a previous run or for another image that shares the same parent layers)
+	layers := unpacker.layersForImage(manifest, config)
+	pending := []int{}
+	for index := range layers {
+		if unpacker.isLayerComplete(&layers[index]) {
+			log.Println("Reusing unpacked layer", layers[index].ChainID.Encoded())
+			progress.Notify(unpacker.Observer, progress.Event{Type: progress.LayerReused, Layer: layers[index].ChainID})
+		} else {
+			pending = append(pending, index)
 		}
-		
-		// Remove the merged directory if it already exists
-		if filesystem.Exists(mergedDir) {
-			if err := os.RemoveAll(mergedDir); err != nil {
-				return nil, err
-			}
+	}
+	
+	// Unpack the pending layers, extracting them concurrently and applying their diffs in order
+	if err := unpacker.unpackLayers(ctx, layers, pending); err != nil {
+		return nil, err
+	}
+	
+	return &UnpackedImage{
+		Descriptor: descriptor,
+		Manifest: manifest,
+		Config: config,
+		Layers: layers,
+	}, nil
+}
+
+// Extracts the archive blob for a filesystem layer to the diff directory in its staging directory, replacing any incomplete results from a previous attempt
+func (unpacker *ImageUnpacker) prepareLayer(ctx context.Context, current *UnpackedLayer) error {
+	
+	// Report the start of the extraction
+	observer := progress.ForLayer(unpacker.Observer, current.ChainID)
+	progress.Notify(observer, progress.Event{Type: progress.LayerExtractStarted})
+	started := time.Now()
+	
+	// Perform the extraction in the layer's staging directory and report the outcome
+	if err := unpacker.prepareLayerImp(ctx, unpacker.stagingLayer(current), observer); err != nil {
+		progress.Notify(observer, progress.Event{Type: progress.Error, Err: err})
+		return err
+	}
+	
+	progress.Notify(observer, progress.Event{Type: progress.LayerExtractFinished, Duration: time.Since(started)})
+	return nil
+}
+
+// The internal implementation of the prepareLayer() function
+func (unpacker *ImageUnpacker) prepareLayerImp(ctx context.Context, current *UnpackedLayer, observer progress.Observer) error {
+	
+	// Remove any incomplete results from a previous attempt to unpack the layer (e.g. one that was interrupted by a crash)
+	if filesystem.Exists(current.Dir) {
+		if err := os.RemoveAll(current.Dir); err != nil {
+			return err
 		}
+	}
+	
+	// Create the staging directory
+	if err := os.MkdirAll(current.Dir, os.ModePerm); err != nil {
+		return err
+	}
+	
+	// Extract the archive blob for the filesystem layer to the diff directory
+	// (If the blob fails verification then remove the extracted contents so they cannot be mistaken for a valid layer)
+	if err := unpacker.extractLayer(ctx, current.Descriptor, current.DiffID, current.DiffDir, observer); err != nil {
+		os.RemoveAll(current.Dir)
+		return err
+	}
+	
+	return nil
+}
+
+// Applies the diff for an extracted filesystem layer to the merged contents of its parent layer, then commits the layer
+func (unpacker *ImageUnpacker) mergeLayer(ctx context.Context, current *UnpackedLayer, parent *UnpackedLayer) error {
+	
+	// Report the start of the merge
+	observer := progress.ForLayer(unpacker.Observer, current.ChainID)
+	progress.Notify(observer, progress.Event{Type: progress.LayerApplyStarted})
+	started := time.Now()
+	
+	// Perform the merge and report the outcome
+	if err := unpacker.mergeLayerImp(ctx, current, parent, observer); err != nil {
+		progress.Notify(observer, progress.Event{Type: progress.Error, Err: err})
+		return err
+	}
+	
+	progress.Notify(observer, progress.Event{Type: progress.LayerApplyFinished, Duration: time.Since(started)})
+	return nil
+}
+
+// The internal implementation of the mergeLayer() function
+func (unpacker *ImageUnpacker) mergeLayerImp(ctx context.Context, current *UnpackedLayer, parent *UnpackedLayer, observer progress.Observer) error {
+	
+	// The merged directory is populated in the layer's staging directory
+	staged := unpacker.stagingLayer(current)
+	
+	// Determine if this is the base filesystem layer
+	if parent == nil {
 		
-		/*
-		// Retrieve an archive extraction object for the filesystem layer's archive blob
-		unarchiver, err := unpacker.unarchiverForMime(layer.MediaType)
-		if err != nil {
-			return nil, err
+		// For the base layer we just symlink the merged directory to the diff directory
+		if err := os.Symlink("./diff", staged.MergedDir); err != nil {
+			return err
 		}
 		
-		// Extract the archive blob for the filesystem layer to the diff directory
-		if err := unarchiver.Unarchive(filepath.Join(blobsDir, layer.Digest.Hex()), diffDir); err != nil {
-			return nil, err
-		}
-		*/
+	} else {
 		
-		// TEMPORARY: use the GNU tar command to perform extraction and preserve attributes
-		if err := os.MkdirAll(diffDir, os.ModePerm); err != nil {
-			return nil, err
+		// Create the merged directory
+		if err := os.Mkdir(staged.MergedDir, os.ModePerm); err != nil {
+			return err
 		}
-		cmd := exec.Command("tar", "--preserve-permissions", "--same-owner", "-xzvf", filepath.Join(blobsDir, layerDetails.Digest.Hex()), "--directory", diffDir)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
 		
-		// Log the command details and run the child process
-		if err := cmd.Run(); err != nil {
-			return nil, err
+		// Create a DiffApplier for the current layer
+		merger := &layer.DiffApplier{
+			BaseDir: parent.MergedDir,
+			DiffDir: staged.DiffDir,
+			MergedDir: staged.MergedDir,
+			Observer: observer,
 		}
 		
-		// Determine if this is the base filesystem layer
-		if index == 0 {
-			
-			// For the base layer we just symlink the merged directory to the diff directory
-			if err := os.Symlink("./diff", mergedDir); err != nil {
-				return nil, err
-			}
-			
-		} else {
-			
-			// Create the merged directory
-			if err := os.Mkdir(mergedDir, os.ModePerm); err != nil {
-				return nil, err
-			}
-			
-			// Create a DiffApplier for the current layer
-			merger := &layer.DiffApplier{
-				BaseDir: filepath.Join(unpacker.unpackDir, previousLayer.Digest.Hex(), "merged"),
-				DiffDir: diffDir,
-				MergedDir: mergedDir,
-			}
-			
-			// Apply the layer's diff to the merged contents of the previous layer
-			log.Println("Apply diff", layerDetails.Digest.Hex(), "against base layer", previousLayer.Digest.Hex(), "...")
-			errorChannel := merger.ApplyRecursive("", nil, false)
-			if err := <-errorChannel; err != nil {
-				return nil, err
-			}
+		// Apply the layer's diff to the merged contents of the parent layer
+		log.Println("Apply diff", current.ChainID.Encoded(), "against base layer", parent.ChainID.Encoded(), "...")
+		errorChannel := merger.ApplyRecursiveContext(ctx, "", nil, false)
+		if err := <-errorChannel; err != nil {
+			return err
 		}
-		
-		// Keep track of the previous layer for each loop iteration
-		previousLayer = layerDetails
 	}
 	
-	return manifest, nil
+	// Mark the layer as complete and move it into place
+	return unpacker.commitLayer(current)
 }
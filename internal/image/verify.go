@@ -0,0 +1,223 @@
+package image
+
+import (
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Represents a blob whose contents do not match the descriptor that references it
+type BlobMismatchError struct {
+	
+	// The digest specified by the descriptor
+	Digest digest.Digest
+	
+	// The size in bytes specified by the descriptor
+	ExpectedSize int64
+	
+	// The actual size of the blob in bytes
+	ActualSize int64
+	
+	// The actual digest of the blob's contents (empty if the size mismatch was detected before the contents were read)
+	ActualDigest digest.Digest
+}
+
+// Formats the error message, naming the digest and the expected and actual sizes
+func (e *BlobMismatchError) Error() string {
+	if e.ActualDigest != "" && e.ActualDigest != e.Digest {
+		return fmt.Sprintf("blob %s failed verification: expected size %d, actual size %d, actual digest %s", e.Digest, e.ExpectedSize, e.ActualSize, e.ActualDigest)
+	}
+	
+	return fmt.Sprintf("blob %s failed verification: expected size %d, actual size %d", e.Digest, e.ExpectedSize, e.ActualSize)
+}
+
+// Represents a filesystem layer whose uncompressed contents do not match the corresponding diff_id in the image configuration
+type DiffIDMismatchError struct {
+	
+	// The digest of the layer's archive blob
+	Layer digest.Digest
+	
+	// The diff_id specified by the image configuration
+	Expected digest.Digest
+	
+	// The actual digest of the layer's uncompressed contents
+	Actual digest.Digest
+}
+
+// Formats the error message, naming the layer and the expected and actual diff_id values
+func (e *DiffIDMismatchError) Error() string {
+	return fmt.Sprintf("layer %s failed verification: expected diff_id %s, actual diff_id %s", e.Layer, e.Expected, e.Actual)
+}
+
+// Provides streaming access to a blob, verifying its contents against its descriptor as they are read
+type verifiedBlob struct {
+	
+	// The underlying file for the blob
+	file fs.File
+	
+	// The descriptor that the blob's contents are verified against
+	descriptor oci.Descriptor
+	
+	// Computes the digest of the blob's contents as they are read
+	digester digest.Digester
+	
+	// The number of bytes read so far
+	bytesRead int64
+}
+
+// Reads from the blob, failing once more data has been read than the descriptor specifies
+func (blob *verifiedBlob) Read(p []byte) (int, error) {
+	n, err := blob.file.Read(p)
+	blob.digester.Hash().Write(p[:n])
+	blob.bytesRead += int64(n)
+	
+	if blob.bytesRead > blob.descriptor.Size {
+		return n, blob.mismatch()
+	}
+	
+	return n, err
+}
+
+// Consumes any remaining data in the blob and verifies that its size and digest match the descriptor
+func (blob *verifiedBlob) Verify() error {
+	
+	// Consume any data that the caller did not read (e.g. padding after the end of a tar archive)
+	if _, err := io.Copy(io.Discard, blob); err != nil {
+		return err
+	}
+	
+	// Verify the size and digest of the blob's contents
+	if blob.bytesRead != blob.descriptor.Size || blob.digester.Digest() != blob.descriptor.Digest {
+		return blob.mismatch()
+	}
+	
+	return nil
+}
+
+// Verifies the blob after an error caused reading it to fail, returning the verification failure if the blob has been corrupted (since this is what caused the error) or the original error otherwise
+func (blob *verifiedBlob) explain(err error) error {
+	var mismatch *BlobMismatchError
+	if verifyErr := blob.Verify(); errors.As(verifyErr, &mismatch) {
+		return verifyErr
+	}
+	
+	return err
+}
+
+// Reads the remaining contents of the blob without retaining them and verifies the blob
+func (blob *verifiedBlob) verifyContents() error {
+	if _, err := io.Copy(io.Discard, blob); err != nil {
+		return err
+	}
+	
+	return blob.Verify()
+}
+
+// Closes the underlying file for the blob
+func (blob *verifiedBlob) Close() error {
+	return blob.file.Close()
+}
+
+// Creates a BlobMismatchError for the blob based on the data read so far
+func (blob *verifiedBlob) mismatch() error {
+	return &BlobMismatchError{
+		Digest: blob.descriptor.Digest,
+		ExpectedSize: blob.descriptor.Size,
+		ActualSize: blob.bytesRead,
+		ActualDigest: blob.digester.Digest(),
+	}
+}
+
+// Resolves the path to the blob referenced by the specified descriptor, relative to the root of the OCI image layout
+func blobName(descriptor oci.Descriptor) (string, error) {
+	
+	// Validate the digest before using it to construct a filesystem path
+	if err := descriptor.Digest.Validate(); err != nil {
+		return "", fmt.Errorf("invalid blob digest %q: %w", descriptor.Digest, err)
+	}
+	
+	return path.Join("blobs", descriptor.Digest.Algorithm().String(), descriptor.Digest.Encoded()), nil
+}
+
+// Resolves the filesystem path to the blob referenced by the specified descriptor in a writable OCI image layout directory
+func (unpacker *ImageUnpacker) blobPath(descriptor oci.Descriptor) (string, error) {
+	if unpacker.imageDir == "" {
+		return "", ErrReadOnlySource
+	}
+	
+	name, err := blobName(descriptor)
+	if err != nil {
+		return "", err
+	}
+	
+	return filepath.Join(unpacker.imageDir, filepath.FromSlash(name)), nil
+}
+
+// Opens the blob referenced by the specified descriptor for verified streaming access
+func (unpacker *ImageUnpacker) openBlob(descriptor oci.Descriptor) (*verifiedBlob, error) {
+	
+	// Resolve the path to the blob
+	name, err := blobName(descriptor)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Attempt to open the blob
+	file, err := unpacker.source.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Verify the size of the blob before reading any of its contents
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() != descriptor.Size {
+		file.Close()
+		return nil, &BlobMismatchError{
+			Digest: descriptor.Digest,
+			ExpectedSize: descriptor.Size,
+			ActualSize: info.Size(),
+		}
+	}
+	
+	return &verifiedBlob{
+		file: file,
+		descriptor: descriptor,
+		digester: descriptor.Digest.Algorithm().Digester(),
+	}, nil
+}
+
+// Reads the entire contents of the blob referenced by the specified descriptor and verifies them
+func (unpacker *ImageUnpacker) readBlob(descriptor oci.Descriptor) ([]byte, error) {
+	
+	// Open the blob
+	blob, err := unpacker.openBlob(descriptor)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	
+	// Read the blob's contents
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Verify the blob's contents
+	if err := blob.Verify(); err != nil {
+		return nil, err
+	}
+	
+	return data, nil
+}
@@ -0,0 +1,159 @@
+package image
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/macoscontainers/experiments/internal/filesystem"
+	"github.com/macoscontainers/experiments/internal/layer"
+	digest "github.com/opencontainers/go-digest"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Writes a blob to the OCI image layout by streaming its contents from the specified function, returning a descriptor for the blob
+// (The contents are written to a temporary file which is only renamed into place once the digest is known, so readers never see a partial blob)
+func (unpacker *ImageUnpacker) ingestBlob(mediaType string, write func(io.Writer) error) (oci.Descriptor, error) {
+	
+	// Verify that the image can be modified
+	if unpacker.imageDir == "" {
+		return oci.Descriptor{}, ErrReadOnlySource
+	}
+	
+	// Create a temporary file alongside the blob directories
+	blobsDir := filepath.Join(unpacker.imageDir, "blobs")
+	if err := os.MkdirAll(blobsDir, os.ModePerm); err != nil {
+		return oci.Descriptor{}, err
+	}
+	temp, err := os.CreateTemp(blobsDir, ".ingest-*")
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+	
+	// Write the blob's contents, computing the digest and size as we go
+	digester := digest.Canonical.Digester()
+	counter := &layer.CountingWriter{}
+	if err := write(io.MultiWriter(temp, digester.Hash(), counter)); err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	// Flush the blob's contents to stable storage
+	if err := temp.Sync(); err != nil {
+		return oci.Descriptor{}, err
+	}
+	if err := temp.Close(); err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	// Move the blob into place
+	descriptor := oci.Descriptor{
+		MediaType: mediaType,
+		Digest: digester.Digest(),
+		Size: counter.Count,
+	}
+	path, err := unpacker.blobPath(descriptor)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return oci.Descriptor{}, err
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	return descriptor, nil
+}
+
+// Serialises a value as JSON and writes it to the OCI image layout as a blob, returning a descriptor for the blob
+func (unpacker *ImageUnpacker) writeJsonBlob(mediaType string, in interface{}) (oci.Descriptor, error) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	return unpacker.ingestBlob(mediaType, func(writer io.Writer) error {
+		_, err := writer.Write(data)
+		return err
+	})
+}
+
+// Adds a descriptor to the OCI index and writes the updated index to disk
+// (If a reference name is specified then it is applied to the descriptor and removed from any existing descriptors, as per a `docker tag`)
+func (unpacker *ImageUnpacker) addToIndex(descriptor oci.Descriptor, refName string) error {
+	
+	// Apply the reference name to the descriptor
+	if refName != "" {
+		annotations := map[string]string{}
+		for key, value := range descriptor.Annotations {
+			annotations[key] = value
+		}
+		annotations[oci.AnnotationRefName] = refName
+		descriptor.Annotations = annotations
+	}
+	
+	// Build the updated list of descriptors, omitting any existing descriptors that the new descriptor replaces
+	manifests := []oci.Descriptor{}
+	for _, existing := range unpacker.index.Manifests {
+		if refName != "" && existing.Annotations[oci.AnnotationRefName] == refName {
+			continue
+		}
+		if refName == "" && existing.Digest == descriptor.Digest && existing.Annotations[oci.AnnotationRefName] == "" {
+			continue
+		}
+		manifests = append(manifests, existing)
+	}
+	manifests = append(manifests, descriptor)
+	
+	// Write the updated index
+	index := *unpacker.index
+	index.Manifests = manifests
+	if err := unpacker.writeIndex(&index); err != nil {
+		return err
+	}
+	
+	unpacker.index = &index
+	return nil
+}
+
+// Atomically replaces the OCI index for the image layout
+func (unpacker *ImageUnpacker) writeIndex(index *oci.Index) error {
+	
+	// Verify that the image can be modified
+	if unpacker.imageDir == "" {
+		return ErrReadOnlySource
+	}
+	
+	// Serialise the index
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	
+	// Write the index to a temporary file and flush it to stable storage
+	temp, err := os.CreateTemp(unpacker.imageDir, ".index-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+	if _, err := temp.Write(data); err != nil {
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	
+	// Rename the temporary file into place
+	if err := os.Rename(temp.Name(), filepath.Join(unpacker.imageDir, "index.json")); err != nil {
+		return err
+	}
+	
+	return filesystem.SyncDir(unpacker.imageDir)
+}
@@ -1,6 +1,7 @@
 package layer
 
 import (
+	"context"
 	"io/fs"
 	"log"
 	"os"
@@ -8,6 +9,7 @@ import (
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/macoscontainers/experiments/internal/filesystem"
+	"github.com/macoscontainers/experiments/internal/progress"
 )
 
 // Provides functionality for applying a filesystem diff against a base filesystem layer
@@ -21,17 +23,26 @@ type DiffApplier struct {
 	
 	// The absolute path to the root directory in which to place the merged output
 	MergedDir string
+	
+	// The observer that will receive progress events (optional)
+	Observer progress.Observer
 }
 
 // Recursively applies the diff for a given filesystem subpath to the contents of the base filesystem layer
 func (apply *DiffApplier) ApplyRecursive(subpath string, subpathDetails fs.DirEntry, whiteoutInParent bool) <-chan error {
+	return apply.ApplyRecursiveContext(context.Background(), subpath, subpathDetails, whiteoutInParent)
+}
+
+// Performs the same processing as ApplyRecursive(), but stops as soon as possible once the specified context is cancelled
+// (The returned channel is only closed once all recursive calls have finished, so no goroutines are left running)
+func (apply *DiffApplier) ApplyRecursiveContext(ctx context.Context, subpath string, subpathDetails fs.DirEntry, whiteoutInParent bool) <-chan error {
 	
 	// Create a channel to store the result
 	result := make(chan error, 1)
 	
 	// Perform processing in a separate goroutine
 	go func() {
-		result <- apply.applyRecursiveImp(subpath, subpathDetails, whiteoutInParent)
+		result <- apply.applyRecursiveImp(ctx, subpath, subpathDetails, whiteoutInParent)
 		close(result)
 	}()
 	
@@ -39,25 +50,44 @@ func (apply *DiffApplier) ApplyRecursive(subpath string, subpathDetails fs.DirEn
 }
 
 // The internal implementation of the ApplyRecursive() function
-func (apply *DiffApplier) applyRecursiveImp(subpath string, subpathDetails fs.DirEntry, whiteoutInParent bool) error {
+func (apply *DiffApplier) applyRecursiveImp(ctx context.Context, subpath string, subpathDetails fs.DirEntry, whiteoutInParent bool) error {
+	
+	// Stop immediately if the context has been cancelled
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	
 	// Gather errors from recursive calls to they can be aggregated for the caller
 	errorChannels := []<-chan error{}
 	
+	// If we return early due to an error then cancel any recursive calls and wait for them to finish, so no goroutines are left running
+	// (Channels that have already been drained are closed, so receiving from them again returns immediately)
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		for _, ch := range errorChannels {
+			<-ch
+		}
+	}()
+	
 	// DEBUG
 	log.Println("Entering subpath", subpath)
 	
 	// Unless this is the root directory, create the appropriate subdirectory in the merged output directory
 	if subpath != "" && subpathDetails != nil {
 		
-		// Create the directory
+		// Create the directory (without following any symlinks that an earlier entry may have placed in the merged output directory)
 		dirPath := filepath.Join(apply.MergedDir, subpath)
-		if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
+		if err := filesystem.MkdirAllNoFollow(apply.MergedDir, dirPath); err != nil {
 			return err
 		}
 		
-		// Copy the directory's attributes
-		if err := CopyAttributes("", dirPath, subpathDetails); err != nil {
+		// Copy the directory's attributes from the diff if the diff contains the directory, or from the base filesystem layer otherwise
+		source := filepath.Join(apply.DiffDir, subpath)
+		if info, err := os.Lstat(source); err != nil || !info.IsDir() {
+			source = filepath.Join(apply.BaseDir, subpath)
+		}
+		if err := CopyAttributes(source, dirPath, subpathDetails); err != nil {
 			return err
 		}
 	}
@@ -86,6 +116,11 @@ func (apply *DiffApplier) applyRecursiveImp(subpath string, subpathDetails fs.Di
 	// Merge the contents of the base filesystem layer into the output directory
 	for filename, details := range baseEntries {
 		
+		// Stop processing if the context has been cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		
 		// Ignore the file or directory if it has been erased or overwritten
 		if !diffEntries.Exists(WhiteoutForFile(filename)) && !diffEntries.Exists(filename) {
 			
@@ -93,7 +128,7 @@ func (apply *DiffApplier) applyRecursiveImp(subpath string, subpathDetails fs.Di
 			if details.IsDir() {
 				
 				// Merge the directory recursively
-				errorChannels = append(errorChannels, apply.ApplyRecursive(filepath.Join(subpath, filename), details, false))
+				errorChannels = append(errorChannels, apply.ApplyRecursiveContext(ctx, filepath.Join(subpath, filename), details, false))
 				
 			} else {
 				
@@ -110,6 +145,16 @@ func (apply *DiffApplier) applyRecursiveImp(subpath string, subpathDetails fs.Di
 	// Merge the contents of the diff into the output directory
 	for filename, details := range diffEntries {
 		
+		// Stop processing if the context has been cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		
+		// Report whiteout files, which have already been taken into account when merging the base filesystem layer
+		if IsWhiteout(filename) {
+			progress.Notify(apply.Observer, progress.Event{Type: progress.WhiteoutProcessed, Path: filepath.Join(subpath, filename)})
+		}
+		
 		// Ignore whiteout files
 		if !IsWhiteout(filename) {
 			
@@ -118,7 +163,7 @@ func (apply *DiffApplier) applyRecursiveImp(subpath string, subpathDetails fs.Di
 				
 				// Merge the directory recursively, indicating whether the directory has been erased to ensure whiteouts propagate to subdirectories
 				erased := ignoreBase || diffEntries.Exists(WhiteoutForFile(filename))
-				errorChannels = append(errorChannels, apply.ApplyRecursive(filepath.Join(subpath, filename), details, erased))
+				errorChannels = append(errorChannels, apply.ApplyRecursiveContext(ctx, filepath.Join(subpath, filename), details, erased))
 				
 			} else {
 				
@@ -137,7 +182,14 @@ func (apply *DiffApplier) applyRecursiveImp(subpath string, subpathDetails fs.Di
 	for _, ch := range errorChannels {
 		err := <- ch
 		if err != nil {
-			aggregated = multierror.Append(err)
+			aggregated = multierror.Append(aggregated, err)
+		}
+	}
+	
+	// Now that all of the directory's contents have been written, restore the timestamps that adding them will have updated
+	if aggregated == nil && subpath != "" && subpathDetails != nil {
+		if err := CopyTimestamps(filepath.Join(apply.MergedDir, subpath), subpathDetails); err != nil {
+			return err
 		}
 	}
 	
@@ -151,6 +203,17 @@ func (apply *DiffApplier) applyFile(origin string, subpath string, filename stri
 	source := filepath.Join(origin, subpath, filename)
 	target := filepath.Join(apply.MergedDir, subpath, filename)
 	
-	// Attempt to mirror the file
-	return MirrorFileWithAttributes(source, target, details)
+	// Attempt to mirror the file, verifying that the target is not reached through a symlink
+	// (A symlink from one layer can collide with a directory from another layer on a case-insensitive filesystem, so an attacker could otherwise redirect writes outside of the merged output directory)
+	err := filesystem.VerifyNoSymlinks(apply.MergedDir, target)
+	if err == nil {
+		err = MirrorFileWithAttributes(source, target, details)
+	}
+	if err != nil {
+		progress.Notify(apply.Observer, progress.Event{Type: progress.Error, Path: filepath.Join(subpath, filename), Err: err})
+		return err
+	}
+	
+	progress.Notify(apply.Observer, progress.Event{Type: progress.FileApplied, Path: filepath.Join(subpath, filename)})
+	return nil
 }
@@ -5,9 +5,12 @@ import (
 	"io/fs"
 	"os"
 	"syscall"
+
+	"github.com/macoscontainers/experiments/internal/filesystem"
 )
 
 // Copies the attributes of the source file or directory to the target file or directory
+// (If the source path is specified then its extended attributes and any override recording attributes that could not be applied to the source are also copied)
 func CopyAttributes(source string, target string, details fs.DirEntry) error {
 	
 	// Retrieve the attributes from the DirEntry object
@@ -29,8 +32,46 @@ func CopyAttributes(source string, target string, details fs.DirEntry) error {
 		}
 	}
 	
-	// Copy ownership information
-	return os.Lchown(target, int(sys.Uid), int(sys.Gid))
+	// Copy ownership information, unless the target already has the correct owner
+	// (Users without privileges can only change the group of files they own, so skipping redundant changes allows them to apply and generate diffs for layers that they own)
+	existing, err := os.Lstat(target)
+	if err != nil {
+		return err
+	}
+	if existingSys, ok := existing.Sys().(*syscall.Stat_t); !ok || existingSys.Uid != sys.Uid || existingSys.Gid != sys.Gid {
+		if err := os.Lchown(target, int(sys.Uid), int(sys.Gid)); err != nil {
+			return err
+		}
+	}
+	
+	// Copy the extended attributes and the override, if any (after changing ownership, since that clears file capabilities)
+	if source != "" {
+		if err := copyXattrs(source, target, details.Type()); err != nil {
+			return err
+		}
+		if err := CopyStatOverride(source, target); err != nil {
+			return err
+		}
+	}
+	
+	// Copy the timestamps last, so that they are not disturbed by any of the other changes
+	return copyTimestamps(target, info)
+}
+
+// Copies the access and modification times of the source file or directory to the target without following symlinks
+// (Directories must have their timestamps copied again once all of their contents have been written, since adding entries updates their modification time)
+func CopyTimestamps(target string, details fs.DirEntry) error {
+	info, err := details.Info()
+	if err != nil {
+		return err
+	}
+	
+	return copyTimestamps(target, info)
+}
+
+// Applies the access and modification times from the specified file attributes to the target
+func copyTimestamps(target string, info fs.FileInfo) error {
+	return filesystem.SetTimes(target, filesystem.AccessTime(info), info.ModTime())
 }
 
 // Mirrors the source file in the target location and preserves its attributes
@@ -56,7 +97,7 @@ func MirrorFileWithAttributes(source string, target string, details fs.DirEntry)
 		
 		// Copy over the attributes of the symlink
 		return CopyAttributes(source, target, details)
-		
+	
 	// Hardlink all other types of files
 	default:
 		return os.Link(source, target)
@@ -0,0 +1,120 @@
+package layer
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Determines whether a file, symlink or directory differs between the base filesystem layer and the modified files
+// (Size, modification time, permissions, file type, ownership, device numbers, symlink targets and extended attributes are compared, and the contents of regular files
+// are compared by digest if requested, which detects modifications that preserve both the size and the modification time of a file, and only extended attributes that the filter includes are compared)
+func entryChanged(basePath string, modifiedPath string, baseDetails fs.DirEntry, modifiedDetails fs.DirEntry, compareContents bool, xattrs *XattrFilter) (bool, error) {
+	
+	// Retrieve the attributes for both entries
+	baseInfo, err := baseDetails.Info()
+	if err != nil {
+		return false, err
+	}
+	modifiedInfo, err := modifiedDetails.Info()
+	if err != nil {
+		return false, err
+	}
+	
+	// Entries that are hardlinks to the same inode cannot differ
+	if os.SameFile(baseInfo, modifiedInfo) {
+		return false, nil
+	}
+	
+	// Compare the effective ownership, permissions, file type and device numbers, taking any overrides into account
+	baseStat, err := ReadEffectiveStat(basePath, baseInfo)
+	if err != nil {
+		return false, err
+	}
+	modifiedStat, err := ReadEffectiveStat(modifiedPath, modifiedInfo)
+	if err != nil {
+		return false, err
+	}
+	if *baseStat != *modifiedStat {
+		return true, nil
+	}
+	
+	// Compare the modification times, and the sizes of anything other than directories (whose sizes depend on the filesystem rather than their contents)
+	if !baseInfo.ModTime().Equal(modifiedInfo.ModTime()) {
+		return true, nil
+	}
+	if !baseInfo.IsDir() && baseInfo.Size() != modifiedInfo.Size() {
+		return true, nil
+	}
+	
+	// Compare the targets of symlinks
+	if baseInfo.Mode() & fs.ModeSymlink != 0 {
+		baseTarget, err := os.Readlink(basePath)
+		if err != nil {
+			return false, err
+		}
+		modifiedTarget, err := os.Readlink(modifiedPath)
+		if err != nil {
+			return false, err
+		}
+		if baseTarget != modifiedTarget {
+			return true, nil
+		}
+	}
+	
+	// Compare the extended attributes
+	if changed, err := xattrsChanged(basePath, modifiedPath, xattrs); err != nil || changed {
+		return changed, err
+	}
+	
+	// Compare the contents of regular files if requested
+	if compareContents && baseInfo.Mode().IsRegular() {
+		baseDigest, err := fileDigest(basePath)
+		if err != nil {
+			return false, err
+		}
+		modifiedDigest, err := fileDigest(modifiedPath)
+		if err != nil {
+			return false, err
+		}
+		return baseDigest != modifiedDigest, nil
+	}
+	
+	return false, nil
+}
+
+// Determines whether the extended attributes of two files differ, ignoring any that the filter excludes
+func xattrsChanged(basePath string, modifiedPath string, filter *XattrFilter) (bool, error) {
+	baseXattrs, err := readXattrs(basePath, filter)
+	if err != nil {
+		return false, err
+	}
+	modifiedXattrs, err := readXattrs(modifiedPath, filter)
+	if err != nil {
+		return false, err
+	}
+	
+	if len(baseXattrs) != len(modifiedXattrs) {
+		return true, nil
+	}
+	for name, value := range baseXattrs {
+		if modifiedValue, ok := modifiedXattrs[name]; !ok || !bytes.Equal(value, modifiedValue) {
+			return true, nil
+		}
+	}
+	
+	return false, nil
+}
+
+// Computes the SHA-256 digest of a file's contents
+func fileDigest(path string) (digest.Digest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	
+	return digest.SHA256.FromReader(file)
+}
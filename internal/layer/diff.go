@@ -1,6 +1,7 @@
 package layer
 
 import (
+	"context"
 	"io/fs"
 	"log"
 	"os"
@@ -8,6 +9,7 @@ import (
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/macoscontainers/experiments/internal/filesystem"
+	"github.com/macoscontainers/experiments/internal/progress"
 )
 
 // Provides functionality for generating a filesystem diff by comparing modified files to a base filesystem layer
@@ -21,17 +23,44 @@ type DiffGenerator struct {
 	
 	// The absolute path to the root directory in which to place the generated filesystem diff
 	DiffDir string
+	
+	// Whether to compare the contents of regular files whose metadata is unchanged, which detects modifications that preserve a file's size and modification time
+	// (This is slower, since every such file must be read in its entirety, but is necessary when modification times are unreliable, e.g. when they have been reset by a build tool)
+	CompareContents bool
+	
+	// The fraction of a directory's original entries that must have been removed or replaced before a single opaque whiteout is generated instead of individual whiteouts,
+	// as happens when a directory is deleted and recreated (optional, defaults to zero, which disables opaque whiteouts, whilst a value of 1 requires every original entry to have been removed or replaced)
+	// (Any original entries that remain unchanged are included in the diff when an opaque whiteout is generated, so values below 1 trade larger diffs for fewer whiteouts)
+	OpaqueWhiteoutThreshold float64
+	
+	// Determines which extended attributes are compared, and which are written when the diff is written directly as a layer archive (optional, uses DefaultXattrFilter() if nil)
+	Xattrs *XattrFilter
+	
+	// The observer that will receive progress events (optional)
+	Observer progress.Observer
 }
 
 // Recursively computes the diff for a given filesystem subpath compared to the contents of the base filesystem layer
 func (diff *DiffGenerator) DiffRecursive(subpath string, subpathDetails fs.DirEntry, dirAdded bool) <-chan error {
+	return diff.DiffRecursiveContext(context.Background(), subpath, subpathDetails, dirAdded)
+}
+
+// Performs the same processing as DiffRecursive(), but stops as soon as possible once the specified context is cancelled
+// (The returned channel is only closed once all recursive calls have finished, so no goroutines are left running)
+func (diff *DiffGenerator) DiffRecursiveContext(ctx context.Context, subpath string, subpathDetails fs.DirEntry, dirAdded bool) <-chan error {
+	return diff.diffRecursiveAsync(ctx, &diffDirOutput{diff: diff}, subpath, subpathDetails, dirAdded, false)
+}
+
+// Performs the processing for DiffRecursiveContext() in a separate goroutine, sending the differences to the specified output and
+// indicating whether the subpath's contents in the base filesystem layer have been erased by a whiteout
+func (diff *DiffGenerator) diffRecursiveAsync(ctx context.Context, output diffOutput, subpath string, subpathDetails fs.DirEntry, dirAdded bool, baseErased bool) <-chan error {
 	
 	// Create a channel to store the result
 	result := make(chan error, 1)
 	
 	// Perform processing in a separate goroutine
 	go func() {
-		result <- diff.diffRecursiveImp(subpath, subpathDetails, dirAdded)
+		result <- diff.diffRecursiveImp(ctx, output, subpath, subpathDetails, dirAdded, baseErased)
 		close(result)
 	}()
 	
@@ -39,115 +68,145 @@ func (diff *DiffGenerator) DiffRecursive(subpath string, subpathDetails fs.DirEn
 }
 
 // The internal implementation of the DiffRecursive() function
-func (diff *DiffGenerator) diffRecursiveImp(subpath string, subpathDetails fs.DirEntry, dirAdded bool) error {
+func (diff *DiffGenerator) diffRecursiveImp(ctx context.Context, output diffOutput, subpath string, subpathDetails fs.DirEntry, dirAdded bool, baseErased bool) error {
+	
+	// Stop immediately if the context has been cancelled
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	
 	// Gather errors from recursive calls to they can be aggregated for the caller
 	errorChannels := []<-chan error{}
 	
+	// If we return early due to an error then cancel any recursive calls and wait for them to finish, so no goroutines are left running
+	// (Channels that have already been drained are closed, so receiving from them again returns immediately)
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		for _, ch := range errorChannels {
+			<-ch
+		}
+	}()
+	
 	// DEBUG
 	log.Println("Entering subpath", subpath)
 	
-	// Unless this is the root directory, create the appropriate subdirectory in the diff directory
+	// Unless this is the root directory, add the appropriate subdirectory to the diff
 	if subpath != "" && subpathDetails != nil {
-		
-		// Create the directory
-		dirPath := filepath.Join(diff.DiffDir, subpath)
-		if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
+		if err := output.addDirectory(subpath, subpathDetails); err != nil {
 			return err
 		}
-		
-		// Copy the directory's attributes
-		if err := CopyAttributes("", dirPath, subpathDetails); err != nil {
+	}
+	
+	// List the directory contents for the subpath in the base filesystem layer, unless they have been erased by a whiteout
+	baseEntries := make(filesystem.DirEntryMap)
+	if !baseErased {
+		var err error
+		baseEntries, err = filesystem.ReadDirAsMap(filepath.Join(diff.BaseDir, subpath))
+		if err != nil {
 			return err
 		}
 	}
 	
-	// List the directory contents for the subpath in the base filesystem layer
-	baseEntries, err := filesystem.ReadDirAsMap(filepath.Join(diff.BaseDir, subpath))
+	// List the directory contents for the subpath in the modified files
+	modifiedEntries, err := filesystem.ReadDirAsMap(filepath.Join(diff.ModifiedDir, subpath))
 	if err != nil {
 		return err
 	}
 	
-	// List the directory contents for the subpath in the modified files
-	modifiedEntries, err := filesystem.ReadDirAsMap(filepath.Join(diff.ModifiedDir, subpath))
+	// Classify each of the entries in the base filesystem layer by comparing it to the corresponding entry in the modified files
+	changes, err := diff.classifyEntries(ctx, subpath, baseEntries, modifiedEntries)
 	if err != nil {
 		return err
 	}
 	
-	// Identify files and subdirectories that have been modified or removed
+	// If enough of the original entries have been removed or replaced then erase them all with an opaque whiteout rather than generating individual whiteouts,
+	// in which case everything in the modified files is treated as an addition, and any subdirectories are also compared as though the base filesystem layer was empty
+	if diff.opaqueWhiteoutRequired(changes, baseEntries) {
+		if err := diff.generateOpaqueWhiteout(output, subpath); err != nil {
+			return err
+		}
+		baseErased = true
+		baseEntries = make(filesystem.DirEntryMap)
+	}
+	
+	// Generate the diff for files and subdirectories that have been modified or removed
 	for filename, baseDetails := range baseEntries {
-		if !modifiedEntries.Exists(filename) {
+		
+		// Stop processing if the context has been cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		
+		modifiedDetails := modifiedEntries[filename]
+		switch changes[filename] {
+		
+		case entryRemoved:
 			
 			// The file or subdirectory has been removed, so generate a whiteout file
-			if err := diff.generateWhiteout(subpath, filename); err != nil {
+			if err := diff.generateWhiteout(output, subpath, filename); err != nil {
 				return err
 			}
+		
+		case entryReplaced:
 			
-		} else {
+			// The original entry has been removed and replaced with an entry of a different type, so generate a whiteout for the original entry
+			if err := diff.generateWhiteout(output, subpath, filename); err != nil {
+				return err
+			}
 			
-			// Compare the file or subdirectory to the original version to determine if they differ
-			modifiedDetails := modifiedEntries[filename]
-			if baseDetails.IsDir() && !modifiedDetails.IsDir() {
+			// Determine whether the new entry is a file or a directory
+			if modifiedDetails.IsDir() {
 				
-				// The original entry was a directory that has been removed and replaced with a file of the same name
+				// Process the directory recursively, ignoring the original entry since it has been erased
+				errorChannels = append(errorChannels, diff.diffRecursiveAsync(ctx, output, filepath.Join(subpath, filename), modifiedDetails, true, true))
 				
-				// Generate a whiteout for the original directory
-				if err := diff.generateWhiteout(subpath, filename); err != nil {
-					return err
-				}
+			} else {
 				
 				// Mirror the new file to the diff
-				if err := diff.mirrorFile(subpath, filename, modifiedDetails); err != nil {
+				if err := diff.mirrorFile(output, subpath, filename, modifiedDetails); err != nil {
 					return err
 				}
+			}
+		
+		default:
+			
+			// The entry has not changed type, so determine whether it is a file or a directory
+			changed := changes[filename] == entryModified
+			if baseDetails.IsDir() {
 				
-			} else if !baseDetails.IsDir() && modifiedDetails.IsDir() {
+				// Process the directory recursively, indicating whether its attributes have changed, in which case it needs to be included in the diff even if its contents have not changed
+				errorChannels = append(errorChannels, diff.diffRecursiveAsync(ctx, output, filepath.Join(subpath, filename), modifiedDetails, changed, false))
 				
-				// The original entry was a file that has been removed and replaced with a directory of the same name
+			} else if changed {
 				
-				// Generate a whiteout for the original file
-				if err := diff.generateWhiteout(subpath, filename); err != nil {
+				// Mirror the modified file to the diff
+				if err := diff.mirrorFile(output, subpath, filename, modifiedDetails); err != nil {
 					return err
 				}
-				
-				// Process the directory recursively
-				errorChannels = append(errorChannels, diff.DiffRecursive(filepath.Join(subpath, filename), modifiedDetails, true))
-				
-			} else if baseDetails.IsDir() && modifiedDetails.IsDir() {
-				
-				// The original entry was a directory and this has not changed
-				
-				// TODO: determine whether the directory's attributes have changed
-				attributesChanged := false
-				
-				// Process the directory recursively
-				errorChannels = append(errorChannels, diff.DiffRecursive(filepath.Join(subpath, filename), modifiedDetails, attributesChanged))
-				
-			} else {
-				
-				// The original entry was a file and this has not changed
-				
-				// TODO: determine whether the file or its attributes have changed
-				//...
-				
 			}
 		}
 	}
 	
 	// Identify files and subdirectories that have been added
 	for filename, details := range modifiedEntries {
+		
+		// Stop processing if the context has been cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if !baseEntries.Exists(filename) {
 			
 			// Determine whether the entry is a file or a directory
 			if details.IsDir() {
 				
 				// Process the directory recursively
-				errorChannels = append(errorChannels, diff.DiffRecursive(filepath.Join(subpath, filename), details, true))
+				errorChannels = append(errorChannels, diff.diffRecursiveAsync(ctx, output, filepath.Join(subpath, filename), details, true, baseErased))
 				
 			} else {
 				
 				// Mirror the file to the diff
-				if err := diff.mirrorFile(subpath, filename, details); err != nil {
+				if err := diff.mirrorFile(output, subpath, filename, details); err != nil {
 					return err
 				}
 				
@@ -160,50 +219,215 @@ func (diff *DiffGenerator) diffRecursiveImp(subpath string, subpathDetails fs.Di
 	for _, ch := range errorChannels {
 		err := <- ch
 		if err != nil {
-			aggregated = multierror.Append(err)
+			aggregated = multierror.Append(aggregated, err)
 		}
 	}
 	
-	// Determine if the directory was an existing directory and should therefore only exist in the diff if it contains differences
-	if !dirAdded {
-		
-		// Retrieve the list of generated differences for the directory that we've just processed
-		diffDir := filepath.Join(diff.DiffDir, subpath)
-		diffEntries, err := filesystem.ReadDirAsMap(diffDir)
-		if err != nil {
+	// Finish the directory once all of its contents have been processed, removing it if it was an existing directory that contains no differences
+	if aggregated == nil {
+		if err := output.finishDirectory(subpath, subpathDetails, !dirAdded); err != nil {
 			return err
 		}
+	}
+	
+	return aggregated
+}
+
+// Describes how an entry in the base filesystem layer differs from the corresponding entry in the modified files
+type entryChange int
+
+const (
+	
+	// The entry is unchanged
+	entryUnchanged entryChange = iota
+	
+	// The entry's contents or attributes have been modified
+	entryModified
+	
+	// The entry has been removed and replaced with an entry of a different type (a file with a directory, or vice versa)
+	entryReplaced
+	
+	// The entry has been removed
+	entryRemoved
+)
+
+// Compares each of the entries in the base filesystem layer to the corresponding entry in the modified files
+func (diff *DiffGenerator) classifyEntries(ctx context.Context, subpath string, baseEntries filesystem.DirEntryMap, modifiedEntries filesystem.DirEntryMap) (map[string]entryChange, error) {
+	changes := map[string]entryChange{}
+	for filename, baseDetails := range baseEntries {
 		
-		// If there were no differences inside the directory and the directory then remove it from the diff
-		if len(diffEntries) == 0 {
-			if err := os.RemoveAll(diffDir); err != nil {
-				return err
+		// Stop processing if the context has been cancelled
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		
+		// Determine whether the entry has been removed or replaced with a different type of entry
+		modifiedDetails, exists := modifiedEntries[filename]
+		if !exists {
+			changes[filename] = entryRemoved
+		} else if baseDetails.IsDir() != modifiedDetails.IsDir() {
+			changes[filename] = entryReplaced
+		} else {
+			
+			// Compare the entry's contents and attributes
+			changed, err := diff.entryChanged(subpath, filename, baseDetails, modifiedDetails)
+			if err != nil {
+				return nil, err
+			}
+			changes[filename] = entryUnchanged
+			if changed {
+				changes[filename] = entryModified
 			}
 		}
 	}
 	
-	return aggregated
+	return changes, nil
+}
+
+// Determines whether enough of a directory's original entries have been removed or replaced to warrant an opaque whiteout
+// (Modified files count as replaced, since a deleted and recreated file is indistinguishable from a modified one, but subdirectories that still exist never do,
+// since their attributes change whenever a child is added or removed and they are likely to still hold some of their original contents)
+func (diff *DiffGenerator) opaqueWhiteoutRequired(changes map[string]entryChange, baseEntries filesystem.DirEntryMap) bool {
+	if diff.OpaqueWhiteoutThreshold <= 0 || len(changes) == 0 {
+		return false
+	}
+	
+	replaced := 0
+	for filename, change := range changes {
+		if change == entryRemoved || change == entryReplaced || (change == entryModified && !baseEntries[filename].IsDir()) {
+			replaced += 1
+		}
+	}
+	
+	return float64(replaced) >= diff.OpaqueWhiteoutThreshold * float64(len(changes))
+}
+
+// Generates an opaque whiteout file for a directory, which erases all of the directory's contents from the layers below the diff
+func (diff *DiffGenerator) generateOpaqueWhiteout(output diffOutput, subpath string) error {
+	if err := output.addOpaqueWhiteout(subpath); err != nil {
+		progress.Notify(diff.Observer, progress.Event{Type: progress.Error, Path: subpath, Err: err})
+		return err
+	}
+	
+	progress.Notify(diff.Observer, progress.Event{Type: progress.WhiteoutGenerated, Path: filepath.Join(subpath, OPAQUE_WHITEOUT_FILENAME)})
+	return nil
 }
 
 // Generates a whiteout file for a file or directory
-func (diff *DiffGenerator) generateWhiteout(subpath string, filename string) error {
+func (diff *DiffGenerator) generateWhiteout(output diffOutput, subpath string, filename string) error {
+	if err := output.addWhiteout(subpath, filename); err != nil {
+		progress.Notify(diff.Observer, progress.Event{Type: progress.Error, Path: filepath.Join(subpath, filename), Err: err})
+		return err
+	}
 	
-	// Attempt to create a whiteout file
-	whiteout, err := os.Create(filepath.Join(diff.DiffDir, subpath, WhiteoutForFile(filename)));
+	progress.Notify(diff.Observer, progress.Event{Type: progress.WhiteoutGenerated, Path: filepath.Join(subpath, filename)})
+	return nil
+}
+
+// Determines whether a file or directory in the modified files differs from the corresponding entry in the base filesystem layer
+func (diff *DiffGenerator) entryChanged(subpath string, filename string, baseDetails fs.DirEntry, modifiedDetails fs.DirEntry) (bool, error) {
+	changed, err := entryChanged(
+		filepath.Join(diff.BaseDir, subpath, filename),
+		filepath.Join(diff.ModifiedDir, subpath, filename),
+		baseDetails,
+		modifiedDetails,
+		diff.CompareContents,
+		diff.Xattrs,
+	)
 	if err != nil {
+		progress.Notify(diff.Observer, progress.Event{Type: progress.Error, Path: filepath.Join(subpath, filename), Err: err})
+	}
+	
+	return changed, err
+}
+
+// Mirrors an individual file from the modified files to the diff
+func (diff *DiffGenerator) mirrorFile(output diffOutput, subpath string, filename string, details fs.DirEntry) error {
+	if err := output.addFile(subpath, filename, details); err != nil {
+		progress.Notify(diff.Observer, progress.Event{Type: progress.Error, Path: filepath.Join(subpath, filename), Err: err})
 		return err
 	}
 	
-	// Close the file if we created it successfully
-	whiteout.Close()
+	progress.Notify(diff.Observer, progress.Event{Type: progress.FileDiffed, Path: filepath.Join(subpath, filename)})
 	return nil
 }
 
-// Mirrors an individual file from the modified files to the diff directory
-func (diff *DiffGenerator) mirrorFile(subpath string, filename string, details fs.DirEntry) error {
+// Receives the differences identified by a DiffGenerator, which are either written to a diff directory or packed into a layer archive
+// (The methods are called concurrently from the goroutines that process each directory, and the contents of a directory are always processed after the directory has been added)
+type diffOutput interface {
+	
+	// Adds a directory from the modified files to the diff, along with its attributes
+	addDirectory(subpath string, details fs.DirEntry) error
+	
+	// Adds a file, symlink or other non-directory entry from the modified files to the diff
+	addFile(subpath string, filename string, details fs.DirEntry) error
+	
+	// Adds a whiteout that erases a file or directory
+	addWhiteout(subpath string, filename string) error
+	
+	// Adds an opaque whiteout that erases all of a directory's original contents
+	addOpaqueWhiteout(subpath string) error
+	
+	// Completes a directory once all of its contents have been processed, removing it from the diff if requested and nothing has been added to it
+	// (The root directory is represented by an empty subpath and nil details)
+	finishDirectory(subpath string, details fs.DirEntry, removeIfEmpty bool) error
+}
+
+// Writes the differences identified by a DiffGenerator to its diff directory, as hardlinks to the modified files and empty whiteout files
+type diffDirOutput struct {
+	
+	// The DiffGenerator whose diff directory is populated
+	diff *DiffGenerator
+}
+
+// Creates the directory in the diff directory and copies its attributes
+func (output *diffDirOutput) addDirectory(subpath string, details fs.DirEntry) error {
+	dirPath := filepath.Join(output.diff.DiffDir, subpath)
+	if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
+		return err
+	}
+	
+	return CopyAttributes(filepath.Join(output.diff.ModifiedDir, subpath), dirPath, details)
+}
+
+// Mirrors the file to the diff directory
+func (output *diffDirOutput) addFile(subpath string, filename string, details fs.DirEntry) error {
 	return MirrorFileWithAttributes(
-		filepath.Join(diff.ModifiedDir, subpath, filename),
-		filepath.Join(diff.DiffDir, subpath, filename),
+		filepath.Join(output.diff.ModifiedDir, subpath, filename),
+		filepath.Join(output.diff.DiffDir, subpath, filename),
 		details,
 	)
 }
+
+// Creates an empty whiteout file in the diff directory
+func (output *diffDirOutput) addWhiteout(subpath string, filename string) error {
+	return createEmptyFile(filepath.Join(output.diff.DiffDir, subpath, WhiteoutForFile(filename)))
+}
+
+// Creates an empty opaque whiteout file in the diff directory
+func (output *diffDirOutput) addOpaqueWhiteout(subpath string) error {
+	return createEmptyFile(filepath.Join(output.diff.DiffDir, subpath, OPAQUE_WHITEOUT_FILENAME))
+}
+
+// Removes the directory from the diff directory if requested and it is empty, or restores its timestamps otherwise
+func (output *diffDirOutput) finishDirectory(subpath string, details fs.DirEntry, removeIfEmpty bool) error {
+	
+	// Retrieve the list of generated differences for the directory
+	diffDir := filepath.Join(output.diff.DiffDir, subpath)
+	diffEntries, err := filesystem.ReadDirAsMap(diffDir)
+	if err != nil {
+		return err
+	}
+	
+	// If there were no differences inside the directory then remove it from the diff
+	if removeIfEmpty && len(diffEntries) == 0 {
+		return os.RemoveAll(diffDir)
+	}
+	
+	// Restore the timestamps that adding the directory's contents will have updated (the root of the diff directory has no corresponding attributes)
+	if subpath != "" && details != nil {
+		return CopyTimestamps(diffDir, details)
+	}
+	
+	return nil
+}
@@ -0,0 +1,360 @@
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/macoscontainers/experiments/internal/filesystem"
+	"golang.org/x/sys/unix"
+)
+
+// Provides functionality for extracting a filesystem layer archive to a diff directory
+type LayerExtractor struct {
+	
+	// The absolute path to the root directory into which the contents of the layer archive will be extracted
+	DiffDir string
+	
+	// The limits on the resources that extraction may consume (all resources are unlimited by default)
+	Limits ExtractionLimits
+	
+	// The mappings used to translate the user and group IDs from the archive to the IDs that will own the extracted files (optional, IDs are preserved verbatim if nil)
+	IDMappings *IDMappings
+	
+	// Determines which extended attributes are extracted from the archive (optional, uses DefaultXattrFilter() if nil)
+	Xattrs *XattrFilter
+}
+
+// Reads from an underlying reader, failing once the specified context has been cancelled
+type contextReader struct {
+	
+	// The context whose cancellation interrupts reading
+	ctx context.Context
+	
+	// The underlying reader
+	reader io.Reader
+}
+
+// Reads from the underlying reader unless the context has been cancelled
+func (reader *contextReader) Read(p []byte) (int, error) {
+	if err := reader.ctx.Err(); err != nil {
+		return 0, err
+	}
+	
+	return reader.reader.Read(p)
+}
+
+// Extracts the contents of an uncompressed tar stream to the diff directory, preserving file attributes
+func (extract *LayerExtractor) Extract(archive io.Reader) error {
+	return extract.ExtractContext(context.Background(), archive)
+}
+
+// Extracts the contents of an uncompressed tar stream to the diff directory, stopping as soon as possible once the specified context is cancelled
+func (extract *LayerExtractor) ExtractContext(ctx context.Context, archive io.Reader) error {
+	
+	// Ensure the diff directory exists
+	if err := os.MkdirAll(extract.DiffDir, os.ModePerm); err != nil {
+		return err
+	}
+	
+	// Keep track of the directories we create, since their timestamps can only be set once all of their children have been extracted
+	directories := []*tar.Header{}
+	directoryPaths := []string{}
+	
+	// Process each of the entries in the archive in turn, enforcing the extraction limits as we go
+	tracker := &limitTracker{limits: extract.Limits}
+	reader := tar.NewReader(&limitedReader{reader: &contextReader{ctx: ctx, reader: archive}, limit: extract.Limits.MaxTotalBytes})
+	for {
+		
+		// Stop processing if the context has been cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		
+		// Retrieve the header for the next entry, stopping when we reach the end of the archive
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		
+		// Verify that the entry does not exceed any of the extraction limits
+		if err := tracker.checkEntry(header); err != nil {
+			return err
+		}
+		
+		// Resolve the target location for the entry, rejecting entries that would be written outside of the diff directory
+		target, err := filesystem.SecureJoin(extract.DiffDir, header.Name)
+		if err != nil {
+			return err
+		}
+		
+		// Extract the entry
+		extracted, err := extract.extractEntry(reader, header, target)
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+		}
+		
+		// Defer setting the timestamps for directories
+		if extracted && header.Typeflag == tar.TypeDir {
+			directories = append(directories, header)
+			directoryPaths = append(directoryPaths, target)
+		}
+	}
+	
+	// Set the timestamps for directories in reverse order, so parent directories are processed after their subdirectories
+	for index := len(directories) - 1; index >= 0; index-- {
+		if err := setTimestamps(directoryPaths[index], directories[index]); err != nil {
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// Extracts an individual archive entry to the specified target location within the diff directory, returning false if the entry was skipped
+// (Symlinks extracted by earlier entries are never followed, so an archive cannot plant a symlink and then write through it)
+func (extract *LayerExtractor) extractEntry(reader io.Reader, header *tar.Header, target string) (bool, error) {
+	
+	// Archives are not required to include entries for parent directories, so create any that are missing
+	// (The diff directory itself has no parents within the root, and can only be the subject of a directory entry that sets its attributes)
+	if target == filepath.Clean(extract.DiffDir) {
+		if header.Typeflag != tar.TypeDir {
+			return false, &filesystem.PathEscapeError{Root: extract.DiffDir, Path: header.Name, Reason: "only a directory entry may refer to the root directory"}
+		}
+	} else if err := filesystem.MkdirAllNoFollow(extract.DiffDir, filepath.Dir(target)); err != nil {
+		return false, err
+	}
+	
+	// Remove any existing filesystem entry that the archive entry replaces (existing directories are only replaced by non-directories)
+	if existing, err := os.Lstat(target); err == nil {
+		if !existing.IsDir() || header.Typeflag != tar.TypeDir {
+			if err := os.RemoveAll(target); err != nil {
+				return false, err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	
+	// Determine what type of entry we are extracting (device nodes are replaced by placeholder files if they cannot be created)
+	placeholder := false
+	switch header.Typeflag {
+	
+	case tar.TypeDir:
+		if err := os.Mkdir(target, os.ModePerm); err != nil && !os.IsExist(err) {
+			return false, err
+		}
+	
+	case tar.TypeReg, tar.TypeRegA:
+		if err := extract.writeFile(reader, target); err != nil {
+			return false, err
+		}
+	
+	case tar.TypeSymlink:
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			return false, err
+		}
+	
+	case tar.TypeLink:
+		
+		// Verify that the file being linked to lies within the diff directory and is not reached through a symlink
+		linked, err := filesystem.SecureJoin(extract.DiffDir, header.Linkname)
+		if err != nil {
+			return false, err
+		}
+		if err := filesystem.VerifyNoSymlinks(extract.DiffDir, linked); err != nil {
+			return false, err
+		}
+		
+		// Hardlinks share the attributes of the file they point to, so there is nothing further to do once the link is created
+		// (If the file being linked to is itself a symlink then the link refers to the symlink rather than following it)
+		return true, unix.Linkat(unix.AT_FDCWD, linked, unix.AT_FDCWD, target, 0)
+	
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := unix.Mknod(target, deviceMode(header), int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)))); err != nil {
+			
+			// If we are not permitted to create device nodes then create an empty file to hold the override that records the device
+			if header.Typeflag == tar.TypeFifo || !isNotPermitted(err) {
+				return false, err
+			}
+			if err := extract.writeFile(&bytes.Buffer{}, target); err != nil {
+				return false, err
+			}
+			placeholder = true
+		}
+	
+	default:
+		
+		// Skip any entry types that do not represent filesystem objects (e.g. global PAX headers), as GNU tar does
+		log.Println("Skipping unsupported archive entry", header.Name, "of type", string(header.Typeflag))
+		return false, nil
+	}
+	
+	// Preserve the attributes of the entry
+	if err := extract.applyHeaderAttributes(target, header, placeholder); err != nil {
+		return false, err
+	}
+	if err := extract.applyXattrs(target, header); err != nil {
+		return false, err
+	}
+	
+	// Set the timestamps for all entries other than directories
+	if header.Typeflag != tar.TypeDir {
+		if err := setTimestamps(target, header); err != nil {
+			return false, err
+		}
+	}
+	
+	return true, nil
+}
+
+// Writes the contents of a regular file
+func (extract *LayerExtractor) writeFile(reader io.Reader, target string) error {
+	
+	// Create the file (permissions are applied once the contents have been written)
+	// (Any existing entry has already been removed, so refusing to open an existing file or follow a symlink guards against anything that replaced it in the meantime)
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL|unix.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	
+	// Copy the file contents from the archive
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		return err
+	}
+	
+	return file.Close()
+}
+
+// Computes the mode value to pass to mknod() for a device node or FIFO
+func deviceMode(header *tar.Header) uint32 {
+	mode := uint32(header.Mode & 07777)
+	switch header.Typeflag {
+	case tar.TypeChar:
+		return mode | unix.S_IFCHR
+	case tar.TypeBlock:
+		return mode | unix.S_IFBLK
+	default:
+		return mode | unix.S_IFIFO
+	}
+}
+
+// Applies the ownership and permissions from an archive entry header to the extracted filesystem entry
+// (Note that numeric IDs are always used, which is equivalent to GNU tar's `--same-owner --numeric-owner` flags, after translating them using the ID mappings)
+// (If the current user is not permitted to apply the attributes, or the entry is a device node that was replaced by a placeholder file, then they are recorded in an override instead)
+func (extract *LayerExtractor) applyHeaderAttributes(target string, header *tar.Header, placeholder bool) error {
+	
+	// Translate the IDs to the IDs that will own the extracted entry
+	uid, gid, err := extract.IDMappings.ToHost(header.Uid, header.Gid)
+	if err != nil {
+		return err
+	}
+	
+	// Describe the intended attributes in case they need to be recorded in an override
+	mode := header.FileInfo().Mode()
+	override := &StatOverride{UID: uid, GID: gid, Mode: mode, Type: overrideType(mode, header.Devmajor, header.Devminor)}
+	needsOverride := placeholder
+	
+	// Copy ownership information first, since changing ownership may clear the setuid and setgid bits
+	if err := os.Lchown(target, uid, gid); err != nil {
+		if !isNotPermitted(err) {
+			return err
+		}
+		needsOverride = true
+	}
+	
+	// Symlinks have no permissions of their own, and on some platforms cannot hold an override, so we record what we can and move on
+	if header.Typeflag == tar.TypeSymlink {
+		if needsOverride {
+			if err := WriteStatOverride(target, override); err != nil && !isSkippableXattrError(err, OVERRIDE_STAT_XATTR, regularFileXattrPrefixes) {
+				return err
+			} else if err != nil {
+				log.Println("Unable to record the ownership of symlink", header.Name, "in an override:", err)
+			}
+		}
+		return nil
+	}
+	
+	// Widen the real permissions if a user without privileges would otherwise be unable to read or traverse the entry
+	permissions := mode
+	if os.Geteuid() != 0 {
+		minimum := fs.FileMode(0600)
+		if header.Typeflag == tar.TypeDir {
+			minimum = 0700
+		}
+		if mode.Perm() & minimum != minimum {
+			permissions |= minimum
+			needsOverride = true
+		}
+	}
+	
+	// Copy permissions
+	if placeholder {
+		permissions = 0600
+	}
+	if err := os.Chmod(target, permissions); err != nil {
+		return err
+	}
+	
+	// Record the intended attributes if they could not be applied
+	if needsOverride {
+		return WriteStatOverride(target, override)
+	}
+	
+	// Existing directories are not replaced, so remove any override that was recorded when an earlier entry created the directory
+	if header.Typeflag == tar.TypeDir {
+		if err := filesystem.RemoveXattr(target, OVERRIDE_STAT_XATTR); err != nil && !filesystem.IsXattrUnsupported(err) {
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// Applies the extended attributes recorded in an archive entry's PAX records, skipping any that the filter excludes
+// (This happens after ownership has been changed, since changing ownership clears file capabilities, and attributes that the filesystem does not support or that the platform does not permit on the type of file are skipped with a warning, but any other attribute that cannot be set is an error)
+func (extract *LayerExtractor) applyXattrs(target string, header *tar.Header) error {
+	for key, value := range header.PAXRecords {
+		
+		// Ignore PAX records that do not hold extended attributes, and attributes that the filter excludes
+		if !strings.HasPrefix(key, PAX_XATTR_PREFIX) {
+			continue
+		}
+		name := strings.TrimPrefix(key, PAX_XATTR_PREFIX)
+		if !extract.Xattrs.Includes(name) {
+			continue
+		}
+		
+		// Set the attribute
+		if err := filesystem.SetXattr(target, name, []byte(value)); err != nil {
+			if !isSkippableXattrError(err, name, skippedXattrPrefixes(header.FileInfo().Mode())) {
+				return err
+			}
+			log.Println("Unable to set extended attribute", name, "on", header.Name+":", err)
+		}
+	}
+	
+	return nil
+}
+
+// Applies the access and modification times from an archive entry header without following symlinks
+func setTimestamps(target string, header *tar.Header) error {
+	
+	// Fall back to the modification time if the archive does not specify an access time
+	accessTime := header.AccessTime
+	if accessTime.IsZero() {
+		accessTime = header.ModTime
+	}
+	
+	return filesystem.SetTimes(target, accessTime, header.ModTime)
+}
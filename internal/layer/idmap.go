@@ -0,0 +1,298 @@
+package layer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// The file listing the subordinate user ID ranges allocated to each user
+const SUBUID_FILENAME = "/etc/subuid"
+
+// The file listing the subordinate group ID ranges allocated to each user
+const SUBGID_FILENAME = "/etc/subgid"
+
+// Maps a contiguous range of user or group IDs inside a container to a contiguous range of IDs on the host, in the same manner as a line of /proc/<pid>/uid_map
+type IDMap struct {
+	
+	// The first ID of the range inside the container
+	ContainerID int `json:"containerID"`
+	
+	// The first ID of the range on the host
+	HostID int `json:"hostID"`
+	
+	// The number of IDs in the range
+	Size int `json:"size"`
+}
+
+// Translates the user and group IDs recorded in layer archives to the IDs that own the corresponding files on the host, and back again
+// (Unpacked layers always store host IDs, so translation happens when archives are extracted and when diffs are packed, and a nil *IDMappings leaves IDs untranslated)
+type IDMappings struct {
+	
+	// The mappings for user IDs
+	UIDs []IDMap `json:"uids"`
+	
+	// The mappings for group IDs
+	GIDs []IDMap `json:"gids"`
+}
+
+// The error reported when an ID has no corresponding mapping
+type UnmappedIDError struct {
+	
+	// The kind of ID ("uid" or "gid")
+	Kind string
+	
+	// The ID that could not be mapped
+	ID int
+	
+	// Whether the ID was being mapped from the container to the host, as opposed to from the host to the container
+	ToHost bool
+}
+
+// Formats the error message, naming the ID and the direction of the mapping
+func (e *UnmappedIDError) Error() string {
+	if e.ToHost {
+		return fmt.Sprintf("container %s %d is not mapped to a host %s", e.Kind, e.ID, e.Kind)
+	}
+	
+	return fmt.Sprintf("host %s %d is not mapped to a container %s", e.Kind, e.ID, e.Kind)
+}
+
+// Translates an ID using a list of mappings, in the specified direction
+func translateID(mappings []IDMap, id int, kind string, toHost bool) (int, error) {
+	for _, mapping := range mappings {
+		from, to := mapping.HostID, mapping.ContainerID
+		if toHost {
+			from, to = mapping.ContainerID, mapping.HostID
+		}
+		
+		if id >= from && id < from + mapping.Size {
+			return to + (id - from), nil
+		}
+	}
+	
+	return -1, &UnmappedIDError{Kind: kind, ID: id, ToHost: toHost}
+}
+
+// Translates the user and group IDs from a layer archive to the IDs that should own the extracted files on the host
+func (mappings *IDMappings) ToHost(uid int, gid int) (int, int, error) {
+	if mappings == nil {
+		return uid, gid, nil
+	}
+	
+	hostUID, err := translateID(mappings.UIDs, uid, "uid", true)
+	if err != nil {
+		return -1, -1, err
+	}
+	hostGID, err := translateID(mappings.GIDs, gid, "gid", true)
+	if err != nil {
+		return -1, -1, err
+	}
+	
+	return hostUID, hostGID, nil
+}
+
+// Translates the user and group IDs that own a file on the host to the IDs that should be recorded in a layer archive
+func (mappings *IDMappings) ToContainer(uid int, gid int) (int, int, error) {
+	if mappings == nil {
+		return uid, gid, nil
+	}
+	
+	containerUID, err := translateID(mappings.UIDs, uid, "uid", false)
+	if err != nil {
+		return -1, -1, err
+	}
+	containerGID, err := translateID(mappings.GIDs, gid, "gid", false)
+	if err != nil {
+		return -1, -1, err
+	}
+	
+	return containerUID, containerGID, nil
+}
+
+// Determines whether two lists of mappings are identical, treating an empty list and a missing list as equal
+func sameIDMaps(a []IDMap, b []IDMap) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	
+	for index := range a {
+		if a[index] != b[index] {
+			return false
+		}
+	}
+	
+	return true
+}
+
+// Determines whether two sets of mappings translate IDs identically, treating empty lists and missing lists (e.g. null and [] in JSON) as equal
+// (A nil *IDMappings leaves IDs untranslated whereas a set of empty lists rejects every ID, so they are never equal to one another)
+func (mappings *IDMappings) Equal(other *IDMappings) bool {
+	if mappings == nil || other == nil {
+		return mappings == nil && other == nil
+	}
+	
+	return sameIDMaps(mappings.UIDs, other.UIDs) && sameIDMaps(mappings.GIDs, other.GIDs)
+}
+
+// Parses a list of ID mappings in the format "containerID:hostID:size[,containerID:hostID:size...]", as accepted by the `--uidmap` and `--gidmap` flags of container tools
+func ParseIDMap(spec string) ([]IDMap, error) {
+	mappings := []IDMap{}
+	for _, entry := range strings.Split(spec, ",") {
+		fields := strings.Split(strings.TrimSpace(entry), ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid ID mapping %q, expected containerID:hostID:size", entry)
+		}
+		
+		values := []int{}
+		for _, field := range fields {
+			value, err := strconv.Atoi(field)
+			if err != nil || value < 0 {
+				return nil, fmt.Errorf("invalid ID mapping %q, values must be non-negative integers", entry)
+			}
+			values = append(values, value)
+		}
+		if values[2] == 0 {
+			return nil, fmt.Errorf("invalid ID mapping %q, size must be greater than zero", entry)
+		}
+		
+		mappings = append(mappings, IDMap{ContainerID: values[0], HostID: values[1], Size: values[2]})
+	}
+	
+	return mappings, nil
+}
+
+// Parses the user and group ID mappings specified by a pair of `--uidmap` and `--gidmap` style flags, returning nil if neither was specified
+func ParseIDMappings(uidSpec string, gidSpec string) (*IDMappings, error) {
+	if uidSpec == "" && gidSpec == "" {
+		return nil, nil
+	} else if uidSpec == "" || gidSpec == "" {
+		return nil, errors.New("user ID mappings and group ID mappings must be specified together")
+	}
+	
+	uids, err := ParseIDMap(uidSpec)
+	if err != nil {
+		return nil, err
+	}
+	gids, err := ParseIDMap(gidSpec)
+	if err != nil {
+		return nil, err
+	}
+	
+	return &IDMappings{UIDs: uids, GIDs: gids}, nil
+}
+
+// Reads the subordinate ID ranges allocated to a user from a file in the format of /etc/subuid or /etc/subgid
+// (Each line has the format "user:start:count", where the user may be specified by either username or numeric user ID, so both are accepted)
+func ReadSubordinateIDs(filename string, username string, uid int) ([]IDMap, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	
+	ranges := []IDMap{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		
+		// Skip blank lines and comments
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		
+		// Parse the line and ignore ranges that belong to other users
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 || (fields[0] != username && fields[0] != strconv.Itoa(uid)) {
+			continue
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid start ID in %s: %q", filename, line)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("invalid ID count in %s: %q", filename, line)
+		}
+		
+		ranges = append(ranges, IDMap{HostID: start, Size: count})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	
+	return ranges, nil
+}
+
+// Appends a user's subordinate ID ranges to a list of mappings, assigning them consecutive container IDs after the IDs that are already mapped
+func appendSubordinateIDs(mappings []IDMap, filename string, username string, uid int) ([]IDMap, error) {
+	ranges, err := ReadSubordinateIDs(filename, username, uid)
+	if err != nil {
+		return nil, err
+	} else if len(ranges) == 0 {
+		return nil, fmt.Errorf("no subordinate ID ranges are allocated to user %s in %s", username, filename)
+	}
+	
+	next := 0
+	for _, mapping := range mappings {
+		if end := mapping.ContainerID + mapping.Size; end > next {
+			next = end
+		}
+	}
+	for _, subordinate := range ranges {
+		subordinate.ContainerID = next
+		mappings = append(mappings, subordinate)
+		next += subordinate.Size
+	}
+	
+	return mappings, nil
+}
+
+// Creates the mappings used by rootless container engines, where root inside the container maps to the specified host user and group,
+// and the remaining container IDs map to the user's subordinate ID ranges from the specified subuid and subgid files, in order
+// (Only root can change the ownership of files to subordinate IDs, so these mappings are intended for preparing layers on behalf of a rootless user, whereas a user
+// without privileges can only use mappings that map every ID in the layer to their own user and group)
+func SubordinateIDMappings(subuidFile string, subgidFile string, username string, uid int, gid int) (*IDMappings, error) {
+	uids, err := appendSubordinateIDs([]IDMap{{ContainerID: 0, HostID: uid, Size: 1}}, subuidFile, username, uid)
+	if err != nil {
+		return nil, err
+	}
+	
+	gids, err := appendSubordinateIDs([]IDMap{{ContainerID: 0, HostID: gid, Size: 1}}, subgidFile, username, uid)
+	if err != nil {
+		return nil, err
+	}
+	
+	return &IDMappings{UIDs: uids, GIDs: gids}, nil
+}
+
+// Creates the rootless mappings for the user with the specified username or numeric user ID, using the user's primary group and the subordinate ID ranges from /etc/subuid and /etc/subgid
+func SubordinateIDMappingsForUser(name string) (*IDMappings, error) {
+	
+	// Look up the user by numeric ID if the name is a number, and by username otherwise
+	var account *user.User
+	var err error
+	if _, numeric := strconv.Atoi(name); numeric == nil {
+		account, err = user.LookupId(name)
+	} else {
+		account, err = user.Lookup(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	uid, err := strconv.Atoi(account.Uid)
+	if err != nil {
+		return nil, fmt.Errorf("user %s has non-numeric user ID %q", name, account.Uid)
+	}
+	gid, err := strconv.Atoi(account.Gid)
+	if err != nil {
+		return nil, fmt.Errorf("user %s has non-numeric group ID %q", name, account.Gid)
+	}
+	
+	return SubordinateIDMappings(SUBUID_FILENAME, SUBGID_FILENAME, account.Username, uid, gid)
+}
@@ -0,0 +1,146 @@
+package layer
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Limits on the resources that extracting a layer archive may consume, which guard against decompression bombs and other hostile archives
+// (A value of zero means that the corresponding resource is unlimited)
+type ExtractionLimits struct {
+	
+	// The maximum number of bytes in the uncompressed tar stream, and the maximum combined size of all of the files that it contains
+	MaxTotalBytes int64
+	
+	// The maximum size of any individual file in bytes
+	MaxFileSize int64
+	
+	// The maximum number of entries in the archive
+	MaxEntries int64
+	
+	// The maximum number of components in the path of any entry (e.g. "usr/bin/env" has a depth of 3)
+	MaxPathDepth int64
+	
+	// The maximum length in bytes of the path of any entry
+	MaxNameLength int64
+}
+
+// The error reported when an archive exceeds one of its extraction limits
+type LimitExceededError struct {
+	
+	// A description of the limit that was exceeded (e.g. "file size")
+	Limit string
+	
+	// The configured value of the limit
+	Maximum int64
+	
+	// The value that exceeded the limit
+	Actual int64
+	
+	// The path of the archive entry that exceeded the limit (empty if the limit applies to the archive as a whole)
+	Path string
+}
+
+// Formats the error message, naming the limit and the offending entry
+func (e *LimitExceededError) Error() string {
+	if e.Path != "" {
+		return fmt.Sprintf("archive entry %q exceeds the %s limit (%d > %d)", e.Path, e.Limit, e.Actual, e.Maximum)
+	}
+	
+	return fmt.Sprintf("archive exceeds the %s limit (%d > %d)", e.Limit, e.Actual, e.Maximum)
+}
+
+// Determines whether a value exceeds a limit, treating a limit of zero as unlimited
+func exceeds(value int64, limit int64) bool {
+	return limit > 0 && value > limit
+}
+
+// Tracks the resources consumed while extracting an archive and enforces the extraction limits
+type limitTracker struct {
+	
+	// The limits to enforce
+	limits ExtractionLimits
+	
+	// The number of entries encountered so far
+	entries int64
+	
+	// The combined size of the files encountered so far
+	totalSize int64
+}
+
+// Checks an archive entry's header against the limits, before any of its contents are written
+// (File sizes are checked against the header rather than the data, since sparse files can expand to far more data than the archive contains)
+func (tracker *limitTracker) checkEntry(header *tar.Header) error {
+	limits := tracker.limits
+	
+	// Check the number of entries
+	tracker.entries += 1
+	if exceeds(tracker.entries, limits.MaxEntries) {
+		return &LimitExceededError{Limit: "entry count", Maximum: limits.MaxEntries, Actual: tracker.entries, Path: header.Name}
+	}
+	
+	// Check the length and depth of the entry's path
+	if length := int64(len(header.Name)); exceeds(length, limits.MaxNameLength) {
+		return &LimitExceededError{Limit: "name length", Maximum: limits.MaxNameLength, Actual: length, Path: header.Name}
+	}
+	if depth := pathDepth(header.Name); exceeds(depth, limits.MaxPathDepth) {
+		return &LimitExceededError{Limit: "path depth", Maximum: limits.MaxPathDepth, Actual: depth, Path: header.Name}
+	}
+	
+	// Check the size of regular files, both individually and in combination
+	if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+		if exceeds(header.Size, limits.MaxFileSize) {
+			return &LimitExceededError{Limit: "file size", Maximum: limits.MaxFileSize, Actual: header.Size, Path: header.Name}
+		}
+		tracker.totalSize += header.Size
+		if exceeds(tracker.totalSize, limits.MaxTotalBytes) {
+			return &LimitExceededError{Limit: "total size", Maximum: limits.MaxTotalBytes, Actual: tracker.totalSize, Path: header.Name}
+		}
+	}
+	
+	return nil
+}
+
+// Computes the number of components in the path of an archive entry
+func pathDepth(name string) int64 {
+	cleaned := path.Clean(strings.TrimPrefix(name, "/"))
+	if cleaned == "." {
+		return 0
+	}
+	
+	return int64(len(strings.Split(cleaned, "/")))
+}
+
+// Reads from an underlying reader, failing once more than the specified number of bytes have been read
+// (This bounds the size of the uncompressed tar stream itself, including headers and padding that do not count towards the size of any file)
+type limitedReader struct {
+	
+	// The underlying reader
+	reader io.Reader
+	
+	// The maximum number of bytes that may be read (zero if unlimited)
+	limit int64
+	
+	// The number of bytes read so far
+	read int64
+}
+
+// Wraps a reader so that reading more than the maximum number of bytes in the uncompressed tar stream fails with a LimitExceededError
+// (This allows callers to bound data that they read from the stream themselves, such as padding after the end-of-archive marker)
+func (limits ExtractionLimits) LimitReader(reader io.Reader) io.Reader {
+	return &limitedReader{reader: reader, limit: limits.MaxTotalBytes}
+}
+
+// Reads from the underlying reader unless the limit has been exceeded
+func (reader *limitedReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.read += int64(n)
+	if exceeds(reader.read, reader.limit) {
+		return n, &LimitExceededError{Limit: "total size", Maximum: reader.limit, Actual: reader.read}
+	}
+	
+	return n, err
+}
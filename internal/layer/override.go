@@ -0,0 +1,243 @@
+package layer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/macoscontainers/experiments/internal/filesystem"
+	"golang.org/x/sys/unix"
+)
+
+// The extended attribute that records the intended ownership, permissions and file type of a file when they cannot be applied directly
+// (This is the same attribute used by fuse-overlayfs and containers/storage for rootless containers, so layers unpacked by either tool are interoperable)
+const OVERRIDE_STAT_XATTR = "user.containers.override_stat"
+
+// The prefix shared by the extended attributes that record overrides, which describe other attributes of a file rather than being attributes in their own right
+const OVERRIDE_XATTR_PREFIX = "user.containers.override_"
+
+// The intended attributes of a file whose real attributes could not be applied, because the required operations are not permitted for the current user
+type StatOverride struct {
+	
+	// The intended user ID of the file's owner
+	UID int
+	
+	// The intended group ID of the file's owner
+	GID int
+	
+	// The intended permission bits of the file, including the setuid, setgid and sticky bits
+	Mode fs.FileMode
+	
+	// The intended type of the file, as represented in the override attribute (e.g. "file", "dir" or "char-1-3")
+	Type string
+	
+	// The intended device major number (only used for character and block devices)
+	Devmajor int64
+	
+	// The intended device minor number (only used for character and block devices)
+	Devminor int64
+}
+
+// Determines whether the override represents a character or block device, which is stored on disk as an empty regular file
+func (override *StatOverride) IsDevice() bool {
+	return strings.HasPrefix(override.Type, "char-") || strings.HasPrefix(override.Type, "block-")
+}
+
+// Returns the string representation of the file type for a mode value, as used in the override attribute
+func overrideType(mode fs.FileMode, devmajor int64, devminor int64) string {
+	switch {
+	case mode.IsDir():
+		return "dir"
+	case mode & fs.ModeSymlink != 0:
+		return "symlink"
+	case mode & fs.ModeNamedPipe != 0:
+		return "pipe"
+	case mode & fs.ModeSocket != 0:
+		return "socket"
+	case mode & fs.ModeCharDevice != 0:
+		return fmt.Sprintf("char-%d-%d", devmajor, devminor)
+	case mode & fs.ModeDevice != 0:
+		return fmt.Sprintf("block-%d-%d", devmajor, devminor)
+	default:
+		return "file"
+	}
+}
+
+// Formats the override in the "uid:gid:mode:type" format of the override attribute, with the mode in octal
+func (override *StatOverride) String() string {
+	return fmt.Sprintf("%d:%d:%04o:%s", override.UID, override.GID, unixPermissions(override.Mode), override.Type)
+}
+
+// Parses an override from the "uid:gid:mode[:type]" format of the override attribute
+func ParseStatOverride(value string) (*StatOverride, error) {
+	fields := strings.SplitN(value, ":", 4)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid override attribute %q", value)
+	}
+	
+	// Parse the ownership and permissions
+	uid, uidErr := strconv.Atoi(fields[0])
+	gid, gidErr := strconv.Atoi(fields[1])
+	mode, modeErr := strconv.ParseUint(fields[2], 8, 32)
+	if uidErr != nil || gidErr != nil || modeErr != nil {
+		return nil, fmt.Errorf("invalid override attribute %q", value)
+	}
+	override := &StatOverride{UID: uid, GID: gid, Mode: permissionsToFileMode(uint32(mode)), Type: "file"}
+	
+	// Parse the file type and device numbers, if present
+	if len(fields) == 4 {
+		override.Type = fields[3]
+		if override.IsDevice() {
+			parts := strings.Split(override.Type, "-")
+			if len(parts) != 3 {
+				return nil, fmt.Errorf("invalid device type in override attribute %q", value)
+			}
+			major, majorErr := strconv.ParseInt(parts[1], 10, 64)
+			minor, minorErr := strconv.ParseInt(parts[2], 10, 64)
+			if majorErr != nil || minorErr != nil {
+				return nil, fmt.Errorf("invalid device type in override attribute %q", value)
+			}
+			override.Devmajor, override.Devminor = major, minor
+		}
+	}
+	
+	return override, nil
+}
+
+// Converts Go file mode permission bits to Unix permission bits, including the setuid, setgid and sticky bits
+func unixPermissions(mode fs.FileMode) uint32 {
+	permissions := uint32(mode.Perm())
+	if mode & fs.ModeSetuid != 0 {
+		permissions |= unix.S_ISUID
+	}
+	if mode & fs.ModeSetgid != 0 {
+		permissions |= unix.S_ISGID
+	}
+	if mode & fs.ModeSticky != 0 {
+		permissions |= unix.S_ISVTX
+	}
+	
+	return permissions
+}
+
+// Converts Unix permission bits to Go file mode permission bits, including the setuid, setgid and sticky bits
+func permissionsToFileMode(permissions uint32) fs.FileMode {
+	mode := fs.FileMode(permissions & 0777)
+	if permissions & unix.S_ISUID != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if permissions & unix.S_ISGID != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if permissions & unix.S_ISVTX != 0 {
+		mode |= fs.ModeSticky
+	}
+	
+	return mode
+}
+
+// Reads the override for a file, returning nil if the file has no override
+func ReadStatOverride(path string) (*StatOverride, error) {
+	value, err := filesystem.GetXattr(path, OVERRIDE_STAT_XATTR)
+	if err != nil {
+		
+		// Filesystems and file types that do not support extended attributes cannot have overrides
+		if filesystem.IsXattrUnsupported(err) {
+			return nil, nil
+		}
+		return nil, err
+	} else if value == nil {
+		return nil, nil
+	}
+	
+	return ParseStatOverride(string(value))
+}
+
+// Records the override for a file
+func WriteStatOverride(path string, override *StatOverride) error {
+	return filesystem.SetXattr(path, OVERRIDE_STAT_XATTR, []byte(override.String()))
+}
+
+// Copies the override for a file (if any) to another file, removing any existing override from the target if the source has none
+// (Symlinks and special files cannot hold overrides under Linux, so the target cannot have an existing override to remove if the platform does not permit one)
+func CopyStatOverride(source string, target string) error {
+	value, err := filesystem.GetXattr(source, OVERRIDE_STAT_XATTR)
+	if err != nil && !filesystem.IsXattrUnsupported(err) {
+		return err
+	}
+	
+	if value == nil {
+		info, err := os.Lstat(target)
+		if err != nil {
+			return err
+		}
+		if err := filesystem.RemoveXattr(target, OVERRIDE_STAT_XATTR); err != nil && !isSkippableXattrError(err, OVERRIDE_STAT_XATTR, skippedXattrPrefixes(info.Mode())) {
+			return err
+		}
+		return nil
+	}
+	
+	return filesystem.SetXattr(target, OVERRIDE_STAT_XATTR, value)
+}
+
+// Represents the effective attributes of a file, taking any override into account
+type EffectiveStat struct {
+	
+	// The user ID of the file's owner
+	UID int
+	
+	// The group ID of the file's owner
+	GID int
+	
+	// The file's mode, including its type and permission bits
+	Mode fs.FileMode
+	
+	// The device major number (only used for character and block devices)
+	Devmajor int64
+	
+	// The device minor number (only used for character and block devices)
+	Devminor int64
+}
+
+// Retrieves the effective attributes of a file, preferring any override to the file's real attributes
+func ReadEffectiveStat(path string, info fs.FileInfo) (*EffectiveStat, error) {
+	
+	// Start with the file's real attributes
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, errors.New("fs.FileInfo.Sys() was not a syscall.Stat_t object")
+	}
+	stat := &EffectiveStat{
+		UID: int(sys.Uid),
+		GID: int(sys.Gid),
+		Mode: info.Mode(),
+		Devmajor: int64(unix.Major(uint64(sys.Rdev))),
+		Devminor: int64(unix.Minor(uint64(sys.Rdev))),
+	}
+	
+	// Apply the override, if any
+	override, err := ReadStatOverride(path)
+	if err != nil || override == nil {
+		return stat, err
+	}
+	stat.UID, stat.GID = override.UID, override.GID
+	stat.Mode = (info.Mode() &^ (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)) | override.Mode
+	if override.IsDevice() {
+		stat.Mode = override.Mode | fs.ModeDevice
+		if strings.HasPrefix(override.Type, "char-") {
+			stat.Mode |= fs.ModeCharDevice
+		}
+		stat.Devmajor, stat.Devminor = override.Devmajor, override.Devminor
+	}
+	
+	return stat, nil
+}
+
+// Determines whether an error indicates that the current user is not permitted to perform an operation
+func isNotPermitted(err error) bool {
+	return errors.Is(err, fs.ErrPermission)
+}
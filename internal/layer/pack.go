@@ -0,0 +1,245 @@
+package layer
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/macoscontainers/experiments/internal/filesystem"
+)
+
+// The prefix for the PAX records that hold extended attributes, as used by GNU tar, bsdtar and the OCI image specification
+const PAX_XATTR_PREFIX = "SCHILY.xattr."
+
+// Provides functionality for packing the contents of a diff directory into a filesystem layer archive
+type LayerPacker struct {
+	
+	// The absolute path to the root directory whose contents will be packed into the layer archive
+	DiffDir string
+	
+	// The mappings used to translate the user and group IDs that own the files in the diff directory back to the IDs recorded in the archive (optional, IDs are preserved verbatim if nil)
+	IDMappings *IDMappings
+	
+	// The latest modification time that may be recorded in the archive, with any later timestamps clamped to this value (optional, timestamps are preserved verbatim if zero)
+	// (This is typically populated from the SOURCE_DATE_EPOCH environment variable, so that rebuilding the same files at a later time produces an identical archive)
+	SourceDateEpoch time.Time
+	
+	// Determines which extended attributes are written to the archive (optional, uses DefaultXattrFilter() if nil)
+	Xattrs *XattrFilter
+}
+
+// Identifies a file that has already been written to the archive, so subsequent hardlinks to it can be written as link entries
+type packedInode struct {
+	
+	// The device that holds the file
+	device uint64
+	
+	// The file's inode number
+	inode uint64
+}
+
+// Writes the contents of the diff directory to the specified writer as an uncompressed tar stream, preserving file attributes
+func (pack *LayerPacker) Pack(writer io.Writer) error {
+	return pack.PackContext(context.Background(), writer)
+}
+
+// Performs the same processing as Pack(), but stops as soon as possible once the specified context is cancelled
+// (Entries are written in lexical order, so packing the same directory contents always produces the same archive)
+func (pack *LayerPacker) PackContext(ctx context.Context, writer io.Writer) error {
+	
+	// Keep track of the files we have written, since any hardlinks to files within the diff directory must be written as link entries
+	// (Note that files in a generated diff are typically hardlinked to files outside of the diff directory, so the link count alone is not sufficient)
+	packed := map[packedInode]string{}
+	
+	// If the diff directory does not exist then there are no differences, so write an empty archive
+	// (A DiffGenerator removes the root of the diff directory if it finds no differences)
+	archive := tar.NewWriter(writer)
+	if !filesystem.Exists(pack.DiffDir) {
+		return archive.Close()
+	}
+	
+	// Process each of the entries in the diff directory in turn
+	err := filepath.WalkDir(pack.DiffDir, func(path string, details fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		
+		// Stop processing if the context has been cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		
+		// Skip the root of the diff directory itself
+		name, err := filepath.Rel(pack.DiffDir, path)
+		if err != nil || name == "." {
+			return err
+		}
+		
+		// Write the entry
+		return pack.packEntry(archive, path, filepath.ToSlash(name), packed)
+	})
+	if err != nil {
+		return err
+	}
+	
+	// Write the end-of-archive marker
+	return archive.Close()
+}
+
+// Writes an individual filesystem entry to the archive
+func (pack *LayerPacker) packEntry(archive *tar.Writer, path string, name string, packed map[packedInode]string) error {
+	
+	// Retrieve the attributes for the entry, including any override that records attributes which could not be applied when the entry was created
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.New("fs.FileInfo.Sys() was not a syscall.Stat_t object")
+	}
+	stat, err := ReadEffectiveStat(path, info)
+	if err != nil {
+		return err
+	}
+	
+	// Skip sockets, which cannot be represented in a tar archive
+	if info.Mode() & fs.ModeSocket != 0 {
+		log.Println("Skipping socket", name)
+		return nil
+	}
+	
+	// Whiteout files carry no information other than their names, so write them with fixed attributes to keep the archive reproducible
+	if IsWhiteout(filepath.Base(path)) && info.Mode().IsRegular() {
+		return pack.packWhiteout(archive, name)
+	}
+	
+	// Read the target of the entry if it is a symlink
+	link := ""
+	if info.Mode() & fs.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	
+	// Populate the header for the entry, using numeric IDs (translated back to the IDs used inside the container) rather than user and group names
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Format = tar.FormatPAX
+	header.Name = name
+	header.Uid, header.Gid, err = pack.IDMappings.ToContainer(stat.UID, stat.GID)
+	if err != nil {
+		return err
+	}
+	header.Mode = int64(unixPermissions(stat.Mode))
+	header.Uname = ""
+	header.Gname = ""
+	
+	// Omit access and change times, which vary each time the diff directory is read and would make the archive non-reproducible
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	header.ModTime = pack.clampTime(header.ModTime)
+	if info.IsDir() {
+		header.Name = name + "/"
+	}
+	
+	// Populate the device numbers for device nodes (which may be represented by placeholder files with overrides)
+	if stat.Mode & fs.ModeDevice != 0 {
+		header.Typeflag = tar.TypeBlock
+		if stat.Mode & fs.ModeCharDevice != 0 {
+			header.Typeflag = tar.TypeChar
+		}
+		header.Size = 0
+		header.Devmajor = stat.Devmajor
+		header.Devminor = stat.Devminor
+	}
+	
+	// Write hardlinks to files that have already been written as link entries
+	if header.Typeflag == tar.TypeReg && sys.Nlink > 1 {
+		key := packedInode{device: uint64(sys.Dev), inode: uint64(sys.Ino)}
+		if target, exists := packed[key]; exists {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = target
+			header.Size = 0
+			return archive.WriteHeader(header)
+		}
+		packed[key] = name
+	}
+	
+	// Record the entry's extended attributes as PAX records
+	xattrs, err := readXattrs(path, pack.Xattrs)
+	if err != nil {
+		return err
+	}
+	for xattr, value := range xattrs {
+		if header.PAXRecords == nil {
+			header.PAXRecords = map[string]string{}
+		}
+		header.PAXRecords[PAX_XATTR_PREFIX + xattr] = string(value)
+	}
+	
+	// Write the header
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	
+	// Write the contents of regular files
+	if header.Typeflag == tar.TypeReg {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		
+		if _, err := io.Copy(archive, file); err != nil {
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// Writes a whiteout file to the archive as an empty file owned by root, with a fixed timestamp
+func (pack *LayerPacker) packWhiteout(archive *tar.Writer, name string) error {
+	return archive.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name: name,
+		Mode: 0644,
+		ModTime: time.Unix(0, 0),
+		Format: tar.FormatPAX,
+	})
+}
+
+// Clamps a modification time to the source date epoch, if one was specified
+func (pack *LayerPacker) clampTime(modified time.Time) time.Time {
+	if !pack.SourceDateEpoch.IsZero() && modified.After(pack.SourceDateEpoch) {
+		return pack.SourceDateEpoch
+	}
+	
+	return modified
+}
+
+// Parses the value of the SOURCE_DATE_EPOCH environment variable (an integer number of seconds since the Unix epoch), returning the zero time if the value is empty
+func ParseSourceDateEpoch(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH value %q, expected a non-negative integer number of seconds", value)
+	}
+	
+	return time.Unix(seconds, 0).UTC(), nil
+}
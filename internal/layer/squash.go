@@ -0,0 +1,180 @@
+package layer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/macoscontainers/experiments/internal/filesystem"
+)
+
+// Provides functionality for combining the diffs of a sequence of filesystem layers into a single diff
+type DiffSquasher struct {
+	
+	// The absolute paths to the root directories of the diffs to combine, in order from the lowest layer to the highest layer
+	DiffDirs []string
+	
+	// The absolute path to the root directory in which to place the combined diff
+	SquashedDir string
+	
+	// Whether the combined diff will be used as a base layer, in which case whiteouts are discarded since there are no lower layers for them to erase
+	BaseLayer bool
+}
+
+// Combines the diffs, with the contents of each diff taking precedence over the diffs below it
+// (Whiteouts that erase files from lower diffs are applied to the combined diff, and are also preserved so they continue to erase files from the layers below the combined diff)
+func (squash *DiffSquasher) Squash(ctx context.Context) error {
+	
+	// Create the directory for the combined diff
+	if err := os.MkdirAll(squash.SquashedDir, os.ModePerm); err != nil {
+		return err
+	}
+	
+	// Overlay each diff on the combined diff in turn
+	for _, diffDir := range squash.DiffDirs {
+		if err := squash.overlayRecursive(ctx, diffDir, ""); err != nil {
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// Overlays the contents of a given filesystem subpath from a diff on the combined diff
+func (squash *DiffSquasher) overlayRecursive(ctx context.Context, diffDir string, subpath string) error {
+	
+	// Stop processing if the context has been cancelled
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	// List the directory contents for the subpath in the diff
+	diffEntries, err := filesystem.ReadDirAsMap(filepath.Join(diffDir, subpath))
+	if err != nil {
+		return err
+	}
+	
+	// An opaque whiteout erases everything from the lower diffs in the directory, so remove it from the combined diff and preserve the opaque whiteout
+	combinedPath := filepath.Join(squash.SquashedDir, subpath)
+	if diffEntries.Exists(OPAQUE_WHITEOUT_FILENAME) {
+		if err := squash.clearDirectory(combinedPath); err != nil {
+			return err
+		}
+		if !squash.BaseLayer {
+			if err := createEmptyFile(filepath.Join(combinedPath, OPAQUE_WHITEOUT_FILENAME)); err != nil {
+				return err
+			}
+		}
+	}
+	
+	// Process whiteout files first, so that they cannot erase entries that are added by the same diff
+	for filename := range diffEntries {
+		if IsWhiteout(filename) && filename != OPAQUE_WHITEOUT_FILENAME {
+			
+			// Remove the erased file or directory from the combined diff
+			erased := filename[len(WHITEOUT_FILENAME_PREFIX):]
+			if err := os.RemoveAll(filepath.Join(combinedPath, erased)); err != nil {
+				return err
+			}
+			
+			// Preserve the whiteout
+			if !squash.BaseLayer {
+				if err := createEmptyFile(filepath.Join(combinedPath, filename)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	
+	// Process the files and directories that the diff adds or modifies
+	for filename, details := range diffEntries {
+		if IsWhiteout(filename) {
+			continue
+		}
+		
+		source := filepath.Join(diffDir, subpath, filename)
+		target := filepath.Join(combinedPath, filename)
+		if details.IsDir() {
+			
+			// Create the directory in the combined diff if it does not already exist as a directory
+			existing, err := os.Lstat(target)
+			if err != nil || !existing.IsDir() {
+				
+				// Determine whether the directory replaces a file from a lower diff or an entry that was erased
+				replaced := err == nil || filesystem.Exists(filepath.Join(combinedPath, WhiteoutForFile(filename)))
+				if err := os.RemoveAll(target); err != nil {
+					return err
+				}
+				if err := os.Mkdir(target, os.ModePerm); err != nil {
+					return err
+				}
+				
+				// If so, nothing from the layers below the combined diff may show through it
+				if replaced && !squash.BaseLayer {
+					if err := createEmptyFile(filepath.Join(target, OPAQUE_WHITEOUT_FILENAME)); err != nil {
+						return err
+					}
+				}
+			}
+			
+			// Copy the directory's attributes, since the highest diff determines them
+			if err := CopyAttributes(source, target, details); err != nil {
+				return err
+			}
+			
+			// Overlay the directory's contents recursively
+			if err := squash.overlayRecursive(ctx, diffDir, filepath.Join(subpath, filename)); err != nil {
+				return err
+			}
+			
+			// Restore the directory's timestamps, since overlaying its contents will have updated them
+			if err := CopyTimestamps(target, details); err != nil {
+				return err
+			}
+			
+		} else {
+			
+			// Replace any existing entry in the combined diff with the file
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			if err := MirrorFileWithAttributes(source, target, details); err != nil {
+				return err
+			}
+		}
+	}
+	
+	return nil
+}
+
+// Removes all of the contents of a directory in the combined diff, leaving the directory itself intact
+func (squash *DiffSquasher) clearDirectory(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// Creates an empty file (such as a whiteout file), replacing any existing file
+// (Existing files are removed rather than truncated, since they may be hardlinked to files in other layers)
+func createEmptyFile(path string) error {
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	
+	return file.Close()
+}
+
@@ -0,0 +1,255 @@
+package layer
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/macoscontainers/experiments/internal/compression"
+	"github.com/opencontainers/go-digest"
+)
+
+// Options that control how a DiffGenerator writes the differences it identifies as a layer archive
+type ArchiveOptions struct {
+	
+	// The name of the codec used to compress the archive (defaults to gzip if empty, and ignored when writing an uncompressed archive)
+	Compression string
+	
+	// The mappings used to translate the user and group IDs that own the modified files to the IDs recorded in the archive (optional, IDs are preserved verbatim if nil)
+	IDMappings *IDMappings
+	
+	// The latest modification time that may be recorded in the archive, with any later timestamps clamped to this value (optional, timestamps are preserved verbatim if zero)
+	SourceDateEpoch time.Time
+	
+	// The registry used to select the compressor for the archive (defaults to compression.Default if nil)
+	Codecs *compression.Registry
+}
+
+// Returns the registry used to select the compressor for the archive
+func (options ArchiveOptions) codecs() *compression.Registry {
+	if options.Codecs != nil {
+		return options.Codecs
+	}
+	
+	return compression.Default
+}
+
+// Describes a compressed layer archive written by a DiffGenerator
+type LayerDigests struct {
+	
+	// The OCI media type for the compressed archive
+	MediaType string
+	
+	// The digest of the compressed archive
+	Digest digest.Digest
+	
+	// The size of the compressed archive in bytes
+	Size int64
+	
+	// The digest of the uncompressed archive, as recorded in the diff_ids of an image configuration
+	DiffID digest.Digest
+}
+
+// Compares the modified files to the base filesystem layer and writes the differences directly to the specified writer as an uncompressed layer archive
+func (diff *DiffGenerator) WriteArchive(writer io.Writer, options ArchiveOptions) error {
+	return diff.WriteArchiveContext(context.Background(), writer, options)
+}
+
+// Performs the same processing as WriteArchive(), stopping as soon as possible once the specified context is cancelled
+// (The differences are written directly to the writer without populating the diff directory, and entries are written in the same order as a LayerPacker would write them and with the attributes of the modified files, so identical inputs always produce identical archives)
+func (diff *DiffGenerator) WriteArchiveContext(ctx context.Context, writer io.Writer, options ArchiveOptions) error {
+	
+	// Identify the differences, recording them rather than writing them to the diff directory
+	output := &diffArchiveOutput{modifiedDir: diff.ModifiedDir, entries: map[string]string{}, children: map[string]int{}}
+	if err := <-diff.diffRecursiveAsync(ctx, output, "", nil, false, false); err != nil {
+		return err
+	}
+	
+	// Sort the entries so that the archive is reproducible, regardless of the order in which the differences were identified
+	names := []string{}
+	for name := range output.entries {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i int, j int) bool {
+		return archivePathLess(names[i], names[j])
+	})
+	
+	// Write each of the entries, reading their contents and attributes from the modified files
+	// (Hardlinks between modified files that are both part of the diff are written as link entries, just as they are by a LayerPacker)
+	packer := &LayerPacker{IDMappings: options.IDMappings, SourceDateEpoch: options.SourceDateEpoch, Xattrs: diff.Xattrs}
+	packed := map[packedInode]string{}
+	archive := tar.NewWriter(writer)
+	for _, name := range names {
+		
+		// Stop processing if the context has been cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		
+		// Write the entry, synthesising whiteouts since they have no corresponding modified file
+		source := output.entries[name]
+		if source == "" {
+			if err := packer.packWhiteout(archive, name); err != nil {
+				return err
+			}
+		} else if err := packer.packEntry(archive, source, name, packed); err != nil {
+			return err
+		}
+	}
+	
+	// Write the end-of-archive marker
+	return archive.Close()
+}
+
+// Compares the modified files to the base filesystem layer and writes the differences directly to the specified writer as a compressed layer archive
+func (diff *DiffGenerator) WriteLayer(writer io.Writer, options ArchiveOptions) (*LayerDigests, error) {
+	return diff.WriteLayerContext(context.Background(), writer, options)
+}
+
+// Performs the same processing as WriteArchiveContext(), but compresses the archive and computes the digests needed to reference it from an image manifest and configuration
+func (diff *DiffGenerator) WriteLayerContext(ctx context.Context, writer io.Writer, options ArchiveOptions) (*LayerDigests, error) {
+	
+	// Determine the media type for the layer archive
+	codecName := options.Compression
+	if codecName == "" {
+		codecName = compression.CODEC_GZIP
+	}
+	codec, exists := options.codecs().Codec(codecName)
+	if !exists || codec.LayerMediaType == "" {
+		return nil, fmt.Errorf("codec %q cannot be used to compress layer archives", codecName)
+	}
+	
+	// Compress the archive, computing the digests of both the compressed and uncompressed data as we go
+	compressed := digest.Canonical.Digester()
+	counter := &CountingWriter{}
+	compressor, err := options.codecs().Compress(codecName, io.MultiWriter(writer, compressed.Hash(), counter))
+	if err != nil {
+		return nil, err
+	}
+	diffID := digest.Canonical.Digester()
+	if err := diff.WriteArchiveContext(ctx, io.MultiWriter(compressor, diffID.Hash()), options); err != nil {
+		compressor.Close()
+		return nil, err
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, err
+	}
+	
+	return &LayerDigests{
+		MediaType: codec.LayerMediaType,
+		Digest: compressed.Digest(),
+		Size: counter.Count,
+		DiffID: diffID.Digest(),
+	}, nil
+}
+
+// Records the differences identified by a DiffGenerator so that they can be written to a layer archive in a deterministic order once the comparison is complete
+type diffArchiveOutput struct {
+	
+	// The absolute path to the root directory of the modified files
+	modifiedDir string
+	
+	// Protects the maps below from concurrent access
+	mutex sync.Mutex
+	
+	// The entries in the diff, keyed by their paths in the archive, with values holding the absolute path to the corresponding modified file (or an empty string for whiteouts)
+	entries map[string]string
+	
+	// The number of entries that have been added to each directory in the diff, keyed by the directory's path in the archive
+	children map[string]int
+}
+
+// Converts a path relative to the root of the diff into the path of an archive entry, with the root itself represented by an empty string
+func archivePath(elements ...string) string {
+	name := filepath.ToSlash(filepath.Join(elements...))
+	if name == "." {
+		return ""
+	}
+	
+	return name
+}
+
+// Determines whether one archive path sorts before another when compared component by component, which is the order in which filepath.WalkDir() visits files
+func archivePathLess(a string, b string) bool {
+	aComponents := strings.Split(a, "/")
+	bComponents := strings.Split(b, "/")
+	for index := 0; index < len(aComponents) && index < len(bComponents); index++ {
+		if aComponents[index] != bComponents[index] {
+			return aComponents[index] < bComponents[index]
+		}
+	}
+	
+	return len(aComponents) < len(bComponents)
+}
+
+// Records an entry in the diff
+func (output *diffArchiveOutput) add(subpath string, filename string, source string) {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	output.entries[archivePath(subpath, filename)] = source
+	output.children[archivePath(subpath)] += 1
+}
+
+// Records the directory
+func (output *diffArchiveOutput) addDirectory(subpath string, details fs.DirEntry) error {
+	output.add(filepath.Dir(subpath), filepath.Base(subpath), filepath.Join(output.modifiedDir, subpath))
+	return nil
+}
+
+// Records the file
+func (output *diffArchiveOutput) addFile(subpath string, filename string, details fs.DirEntry) error {
+	output.add(subpath, filename, filepath.Join(output.modifiedDir, subpath, filename))
+	return nil
+}
+
+// Records a whiteout
+func (output *diffArchiveOutput) addWhiteout(subpath string, filename string) error {
+	output.add(subpath, WhiteoutForFile(filename), "")
+	return nil
+}
+
+// Records an opaque whiteout
+func (output *diffArchiveOutput) addOpaqueWhiteout(subpath string) error {
+	output.add(subpath, OPAQUE_WHITEOUT_FILENAME, "")
+	return nil
+}
+
+// Removes the directory from the recorded entries if requested and nothing has been added to it
+// (Timestamps are read from the modified files when the entries are written, so there is nothing to restore)
+func (output *diffArchiveOutput) finishDirectory(subpath string, details fs.DirEntry, removeIfEmpty bool) error {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	
+	// The root directory is never written to the archive
+	name := archivePath(subpath)
+	if name == "" || !removeIfEmpty {
+		return nil
+	}
+	
+	if output.children[name] == 0 {
+		delete(output.entries, name)
+		output.children[archivePath(filepath.Dir(subpath))] -= 1
+	}
+	
+	return nil
+}
+
+// Counts the number of bytes written to it, for computing the size of an archive or blob as it is written
+type CountingWriter struct {
+	
+	// The number of bytes written so far
+	Count int64
+}
+
+// Counts the bytes without storing them
+func (counter *CountingWriter) Write(p []byte) (int, error) {
+	counter.Count += int64(len(p))
+	return len(p), nil
+}
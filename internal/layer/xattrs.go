@@ -0,0 +1,192 @@
+package layer
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/macoscontainers/experiments/internal/filesystem"
+)
+
+// The namespaces of extended attributes that can only be set by privileged users (file capabilities and SELinux labels live in the security namespace)
+var privilegedXattrPrefixes = []string{"security.", "trusted."}
+
+// The namespaces of extended attributes that Linux only permits on regular files and directories, reporting EPERM rather than ENOTSUP for any other type of file
+var regularFileXattrPrefixes = []string{"user."}
+
+// Determines which extended attributes are extracted from layer archives, compared when generating diffs and written to layer archives
+// (Attributes that record overrides are always excluded, since they describe the intended attributes of the file they are attached to, and an archive must never be able to forge them)
+type XattrFilter struct {
+	
+	// The name prefixes of the attributes to include (optional, all attributes are included if empty)
+	Allow []string `json:"allow,omitempty"`
+	
+	// The name prefixes of the attributes to exclude, which take precedence over the allowed prefixes (optional)
+	Deny []string `json:"deny,omitempty"`
+}
+
+// Returns the filter used when none is specified, which excludes the namespaces that the current user is not permitted to set
+func DefaultXattrFilter() *XattrFilter {
+	if os.Geteuid() == 0 {
+		return &XattrFilter{}
+	}
+	
+	return &XattrFilter{Deny: privilegedXattrPrefixes}
+}
+
+// Parses comma-separated lists of allowed and denied name prefixes, returning nil if both are empty so that the default filter is used
+func ParseXattrFilter(allowSpec string, denySpec string) *XattrFilter {
+	if allowSpec == "" && denySpec == "" {
+		return nil
+	}
+	
+	// Splits a comma-separated list, ignoring empty elements
+	split := func(spec string) []string {
+		prefixes := []string{}
+		for _, prefix := range strings.Split(spec, ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		return prefixes
+	}
+	
+	return &XattrFilter{Allow: split(allowSpec), Deny: split(denySpec)}
+}
+
+// Determines whether a name begins with any of the specified prefixes
+func hasAnyPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	
+	return false
+}
+
+// Determines whether the filter includes the specified attribute (a nil filter behaves like the default filter)
+func (filter *XattrFilter) Includes(name string) bool {
+	if filter == nil {
+		filter = DefaultXattrFilter()
+	}
+	
+	if strings.HasPrefix(name, OVERRIDE_XATTR_PREFIX) || hasAnyPrefix(name, filter.Deny) {
+		return false
+	}
+	
+	return len(filter.Allow) == 0 || hasAnyPrefix(name, filter.Allow)
+}
+
+// Returns the namespaces of extended attributes that may be skipped if the current user is not permitted to set or remove them on a file of the specified type
+// (Only the namespaces that the platform does not permit on the file type are skipped, so attributes that the user lacks the privileges to set are always reported as errors)
+func skippedXattrPrefixes(mode fs.FileMode) []string {
+	if mode.IsRegular() || mode.IsDir() {
+		return nil
+	}
+	
+	return regularFileXattrPrefixes
+}
+
+// Determines whether a failure to set or remove an extended attribute can be ignored, either because the filesystem does not support extended attributes,
+// or because the current user is not permitted to modify the attribute and it belongs to one of the namespaces that the caller has chosen to skip
+func isSkippableXattrError(err error, name string, skipped []string) bool {
+	return filesystem.IsXattrUnsupported(err) || (filesystem.IsXattrNotPermitted(err) && hasAnyPrefix(name, skipped))
+}
+
+// Determines whether two lists of name prefixes are identical, treating an empty list and a missing list as equal
+func samePrefixes(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	
+	for index := range a {
+		if a[index] != b[index] {
+			return false
+		}
+	}
+	
+	return true
+}
+
+// Returns the filter itself, or the default filter if the filter is nil
+func (filter *XattrFilter) Resolve() *XattrFilter {
+	if filter == nil {
+		return DefaultXattrFilter()
+	}
+	
+	return filter
+}
+
+// Determines whether two filters include the same attributes, treating a nil filter as the default filter
+func (filter *XattrFilter) Equal(other *XattrFilter) bool {
+	filter, other = filter.Resolve(), other.Resolve()
+	return samePrefixes(filter.Allow, other.Allow) && samePrefixes(filter.Deny, other.Deny)
+}
+
+// Reads the extended attributes of a file without following symlinks, omitting any that the filter excludes
+// (Filesystems that do not support extended attributes are treated as though the file has none)
+func readXattrs(path string, filter *XattrFilter) (map[string][]byte, error) {
+	xattrs := map[string][]byte{}
+	names, err := filesystem.ListXattrs(path)
+	if err != nil {
+		if filesystem.IsXattrUnsupported(err) {
+			return xattrs, nil
+		}
+		return nil, err
+	}
+	
+	for _, name := range names {
+		if !filter.Includes(name) {
+			continue
+		}
+		
+		value, err := filesystem.GetXattr(path, name)
+		if err != nil {
+			return nil, err
+		} else if value != nil {
+			xattrs[name] = value
+		}
+	}
+	
+	return xattrs, nil
+}
+
+// Replaces the extended attributes of the target with those of the source, without following symlinks
+// (Overrides are copied separately by CopyStatOverride(), and attributes that the platform does not permit on the type of file are skipped, but any other attribute that cannot be set is an error, since the source has already been filtered when it was extracted or generated)
+func copyXattrs(source string, target string, mode fs.FileMode) error {
+	skipped := skippedXattrPrefixes(mode)
+	
+	// Read the attributes of the source and target, including all namespaces so that stale attributes are removed from the target
+	included := &XattrFilter{}
+	sourceXattrs, err := readXattrs(source, included)
+	if err != nil {
+		return err
+	}
+	targetXattrs, err := readXattrs(target, included)
+	if err != nil {
+		return err
+	}
+	
+	// Remove any attributes that the source does not have
+	for name := range targetXattrs {
+		if _, exists := sourceXattrs[name]; !exists {
+			if err := filesystem.RemoveXattr(target, name); err != nil && !isSkippableXattrError(err, name, skipped) {
+				return err
+			}
+		}
+	}
+	
+	// Copy the attributes of the source, skipping any that are already identical
+	for name, value := range sourceXattrs {
+		if existing, exists := targetXattrs[name]; exists && bytes.Equal(existing, value) {
+			continue
+		}
+		if err := filesystem.SetXattr(target, name, value); err != nil && !isSkippableXattrError(err, name, skipped) {
+			return err
+		}
+	}
+	
+	return nil
+}
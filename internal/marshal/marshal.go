@@ -21,3 +21,16 @@ func UnmarshalJsonFile(filename string, out interface{}) error {
 	
 	return nil
 }
+
+// Serialises a value to a JSON file
+func MarshalJsonFile(filename string, in interface{}) error {
+	
+	// Attempt to serialise the value
+	jsonData, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	
+	// Attempt to write the JSON data to the file
+	return os.WriteFile(filename, jsonData, 0644)
+}
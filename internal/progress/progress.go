@@ -0,0 +1,180 @@
+package progress
+
+import (
+	"io"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// The types of events that can be reported to an Observer
+type EventType int
+
+const (
+	
+	// A filesystem layer was skipped because it had already been unpacked
+	LayerReused EventType = iota
+	
+	// Extraction of a filesystem layer's archive blob has started
+	LayerExtractStarted
+	
+	// Extraction of a filesystem layer's archive blob has finished
+	LayerExtractFinished
+	
+	// More of a filesystem layer's archive blob has been decompressed (Bytes holds the total decompressed so far)
+	BytesDecompressed
+	
+	// The contents of a filesystem layer's archive blob did not match its media type, and were decompressed with the codec that matched them instead (Err describes the mismatch)
+	MediaTypeMismatch
+	
+	// Application of a filesystem layer's diff to the merged contents of its parent layer has started
+	LayerApplyStarted
+	
+	// Application of a filesystem layer's diff to the merged contents of its parent layer has finished
+	LayerApplyFinished
+	
+	// A file was mirrored into the merged output by a DiffApplier
+	FileApplied
+	
+	// A whiteout file or opaque whiteout file was processed by a DiffApplier
+	WhiteoutProcessed
+	
+	// A file or directory was mirrored into a filesystem diff by a DiffGenerator
+	FileDiffed
+	
+	// A whiteout file was generated by a DiffGenerator
+	WhiteoutGenerated
+	
+	// An operation failed (Err holds the error)
+	Error
+)
+
+// Returns a human-readable name for the event type
+func (eventType EventType) String() string {
+	switch eventType {
+	case LayerReused:
+		return "LayerReused"
+	case LayerExtractStarted:
+		return "LayerExtractStarted"
+	case LayerExtractFinished:
+		return "LayerExtractFinished"
+	case BytesDecompressed:
+		return "BytesDecompressed"
+	case MediaTypeMismatch:
+		return "MediaTypeMismatch"
+	case LayerApplyStarted:
+		return "LayerApplyStarted"
+	case LayerApplyFinished:
+		return "LayerApplyFinished"
+	case FileApplied:
+		return "FileApplied"
+	case WhiteoutProcessed:
+		return "WhiteoutProcessed"
+	case FileDiffed:
+		return "FileDiffed"
+	case WhiteoutGenerated:
+		return "WhiteoutGenerated"
+	case Error:
+		return "Error"
+	default:
+		return "Unknown"
+	}
+}
+
+// Represents an event reported by an ImageUnpacker, DiffApplier or DiffGenerator
+type Event struct {
+	
+	// The type of event
+	Type EventType
+	
+	// The ChainID of the filesystem layer that the event relates to (empty if the layer is not known)
+	Layer digest.Digest
+	
+	// The filesystem subpath that the event relates to, relative to the root of the layer (empty for layer-level events)
+	Path string
+	
+	// The number of bytes processed so far, for events that track data volumes
+	Bytes int64
+	
+	// The time taken by the operation, for events that mark the end of an operation
+	Duration time.Duration
+	
+	// The error that occurred, for Error events (or the details of the mismatch, for MediaTypeMismatch events)
+	Err error
+}
+
+// The interface for receiving events
+// (Note that events may be reported concurrently from multiple goroutines, so implementations must be safe for concurrent use)
+type Observer interface {
+	Observe(event Event)
+}
+
+// Adapts an ordinary function to the Observer interface
+type ObserverFunc func(event Event)
+
+// Calls the underlying function
+func (f ObserverFunc) Observe(event Event) {
+	f(event)
+}
+
+// Reports an event to an observer, doing nothing if the observer is nil
+func Notify(observer Observer, event Event) {
+	if observer != nil {
+		observer.Observe(event)
+	}
+}
+
+// Wraps an observer so that events which do not specify a layer are attributed to the specified layer
+func ForLayer(observer Observer, layer digest.Digest) Observer {
+	if observer == nil {
+		return nil
+	}
+	
+	return ObserverFunc(func(event Event) {
+		if event.Layer == "" {
+			event.Layer = layer
+		}
+		observer.Observe(event)
+	})
+}
+
+// The minimum number of bytes between successive BytesDecompressed events reported by a Reader
+const REPORT_INTERVAL = 1 << 20
+
+// Wraps a reader to periodically report the number of bytes read to an observer as BytesDecompressed events
+type Reader struct {
+	
+	// The underlying reader
+	reader io.Reader
+	
+	// The observer that events will be reported to
+	observer Observer
+	
+	// The total number of bytes read so far
+	total int64
+	
+	// The total at the time of the last report
+	reported int64
+}
+
+// Creates a Reader for the specified reader and observer
+func NewReader(reader io.Reader, observer Observer) *Reader {
+	return &Reader{reader: reader, observer: observer}
+}
+
+// Reads from the underlying reader and reports progress when enough data has been read since the last report
+func (reader *Reader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.total += int64(n)
+	if reader.total - reader.reported >= REPORT_INTERVAL || (err == io.EOF && reader.total > reader.reported) {
+		Notify(reader.observer, Event{Type: BytesDecompressed, Bytes: reader.total})
+		reader.reported = reader.total
+	}
+	
+	return n, err
+}
+
+// Returns the total number of bytes read so far
+func (reader *Reader) Total() int64 {
+	return reader.total
+}
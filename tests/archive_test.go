@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/macoscontainers/experiments/internal/compression"
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/tests/testutil"
+)
+
+// Writes an archive with the specified entries to a file, compressing it with the specified codec
+func writeTestArchive(t *testing.T, filename string, codec string, entries []testutil.ArchiveEntry) {
+	archive, err := testutil.CreateArchive(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	data := archive.Bytes()
+	if codec != compression.CODEC_NONE {
+		data = compressWithCodec(t, codec, data)
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests that archive sources resolve symlinks and hardlinks within the archive, confine entry names to the archive, and reject link cycles and excessive link chains
+func TestArchiveSourceResolvesLinks(t *testing.T) {
+	
+	// Create an archive with a chain of exactly MAX_ARCHIVE_LINKS links and a chain with one more, along with a link cycle and entries whose names and targets attempt to escape the archive
+	entries := []testutil.ArchiveEntry{
+		{Type: tar.TypeReg, Name: "./data/file", Contents: "contents"},
+		{Type: tar.TypeSymlink, Name: "blobs/symlink", Linkname: "../data/file"},
+		{Type: tar.TypeLink, Name: "blobs/hardlink", Linkname: "data/file"},
+		{Type: tar.TypeReg, Name: "../escape", Contents: "escaped"},
+		{Type: tar.TypeSymlink, Name: "outside", Linkname: "../../../escape"},
+		{Type: tar.TypeSymlink, Name: "cycle/a", Linkname: "b"},
+		{Type: tar.TypeSymlink, Name: "cycle/b", Linkname: "a"},
+	}
+	for index := 1; index <= image.MAX_ARCHIVE_LINKS + 1; index++ {
+		entries = append(entries, testutil.ArchiveEntry{Type: tar.TypeSymlink, Name: fmt.Sprintf("chain/%d", index), Linkname: fmt.Sprintf("%d", index - 1)})
+	}
+	entries = append(entries, testutil.ArchiveEntry{Type: tar.TypeReg, Name: "chain/0", Contents: "chained"})
+	filename := filepath.Join(t.TempDir(), "archive.tar")
+	writeTestArchive(t, filename, compression.CODEC_NONE, entries)
+	
+	source, err := image.OpenArchive(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	
+	// Verify that paths and links resolve to the expected files within the archive
+	expected := map[string]string{
+		"data/file": "contents",
+		"blobs/symlink": "contents",
+		"blobs/hardlink": "contents",
+		"escape": "escaped",
+		"outside": "escaped",
+		fmt.Sprintf("chain/%d", image.MAX_ARCHIVE_LINKS): "chained",
+	}
+	for name, contents := range expected {
+		data, err := fs.ReadFile(source, name)
+		if err != nil {
+			t.Errorf("failed to read %s: %v", name, err)
+		} else if string(data) != contents {
+			t.Errorf("expected %s to contain %q, got %q", name, contents, data)
+		}
+	}
+	
+	// Verify that link cycles and chains with too many links are rejected, and that invalid paths cannot be opened
+	for _, name := range []string{"cycle/a", fmt.Sprintf("chain/%d", image.MAX_ARCHIVE_LINKS + 1)} {
+		if _, err := source.Open(name); err == nil || !strings.Contains(err.Error(), "links") {
+			t.Errorf("expected opening %s to fail after following too many links, got: %v", name, err)
+		}
+	}
+	for _, name := range []string{"../escape", "/data/file", "missing"} {
+		if _, err := source.Open(name); err == nil {
+			t.Errorf("expected opening %s to fail", name)
+		}
+	}
+	if _, err := source.Open("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a missing file to be reported as not existing, got: %v", err)
+	}
+}
+
+// Tests that compressed archives are rejected, since files cannot be read from arbitrary offsets within them
+func TestOpenArchiveRejectsCompressedArchives(t *testing.T) {
+	entries := []testutil.ArchiveEntry{{Type: tar.TypeReg, Name: "index.json", Contents: "{}"}}
+	for _, codec := range []string{compression.CODEC_GZIP, compression.CODEC_ZSTD} {
+		filename := filepath.Join(t.TempDir(), "archive.tar." + codec)
+		writeTestArchive(t, filename, codec, entries)
+		if source, err := image.OpenArchive(filename); err == nil || !strings.Contains(err.Error(), "compressed") {
+			t.Errorf("expected a %s-compressed archive to be rejected, got: %v", codec, err)
+			if source != nil {
+				source.Close()
+			}
+		}
+	}
+	
+	// Verify that the same archive is accepted when it is uncompressed
+	filename := filepath.Join(t.TempDir(), "archive.tar")
+	writeTestArchive(t, filename, compression.CODEC_NONE, entries)
+	source, err := image.OpenArchive(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	if data, err := fs.ReadFile(source, "index.json"); err != nil || string(data) != "{}" {
+		t.Errorf("expected to read index.json from the uncompressed archive, got %q (%v)", data, err)
+	}
+}
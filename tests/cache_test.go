@@ -0,0 +1,211 @@
+package tests
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/internal/layer"
+	"github.com/macoscontainers/experiments/internal/progress"
+	"github.com/macoscontainers/experiments/tests/testutil"
+	digest "github.com/opencontainers/go-digest"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Records the ChainIDs of the layers that an unpacker reports as reused
+type reuseRecorder struct {
+	
+	// Protects the list of reused layers, since events may be reported concurrently
+	mutex sync.Mutex
+	
+	// The ChainIDs of the reused layers
+	reused []digest.Digest
+}
+
+// Records LayerReused events
+func (recorder *reuseRecorder) Observe(event progress.Event) {
+	if event.Type == progress.LayerReused {
+		recorder.mutex.Lock()
+		defer recorder.mutex.Unlock()
+		recorder.reused = append(recorder.reused, event.Layer)
+	}
+}
+
+// Generates layer archives that each contain a single file with the specified name
+func createCacheTestArchives(t *testing.T, names ...string) [][]byte {
+	archives := [][]byte{}
+	for _, name := range names {
+		archive, err := testutil.CreateArchive([]testutil.ArchiveEntry{
+			{Type: tar.TypeReg, Name: name, Contents: name},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, archive.Bytes())
+	}
+	
+	return archives
+}
+
+// Tests that unpacked layers are reused by ChainID across images, and unpacked again when the ID mappings or extended attribute filter change
+func TestUnpackReusesLayersByChainID(t *testing.T) {
+	root := t.TempDir()
+	unpackDir := filepath.Join(root, "unpacked")
+	
+	// Create two images that share their base layer, with different top layers
+	imageDir := filepath.Join(root, "image")
+	first, err := testutil.CreateImage(imageDir, oci.MediaTypeImageLayerGzip, createCacheTestArchives(t, "base", "first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := testutil.CreateImage(imageDir, oci.MediaTypeImageLayerGzip, createCacheTestArchives(t, "base", "second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.WriteIndex(imageDir, []oci.Descriptor{withRefName(first, "first"), withRefName(second, "second")}); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Unpacks an image with the specified options, returning the unpacked image and the ChainIDs of the layers that were reused
+	unpack := func(reference string, mappings *layer.IDMappings, xattrs *layer.XattrFilter) (*image.UnpackedImage, []digest.Digest) {
+		unpacker, err := image.UnpackerForImage(imageDir, unpackDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unpacker.Close()
+		
+		recorder := &reuseRecorder{}
+		unpacker.IDMappings = mappings
+		unpacker.Xattrs = xattrs
+		unpacker.Observer = recorder
+		unpacked, err := unpacker.UnpackReference(reference, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		
+		return unpacked, sortDigests(recorder.reused)
+	}
+	
+	// Unpack the first image and verify that nothing was reused and that each layer was unpacked to the directory for its ChainID
+	unpacked, reused := unpack("first", nil, nil)
+	if len(reused) != 0 {
+		t.Errorf("expected no layers to be reused by the first unpack, got %v", reused)
+	}
+	chainIDs := image.ChainIDs(unpacked.Config.RootFS.DiffIDs)
+	base := chainIDs[0]
+	for index, unpackedLayer := range unpacked.Layers {
+		if unpackedLayer.ChainID != chainIDs[index] || unpackedLayer.Dir != filepath.Join(unpackDir, chainIDs[index].Encoded()) {
+			t.Errorf("expected layer %d to be unpacked to the directory for ChainID %s, got %s", index, chainIDs[index], unpackedLayer.Dir)
+		}
+	}
+	
+	// Verify that unpacking the first image again reuses both layers, and that the second image reuses the shared base layer
+	if _, reused := unpack("first", nil, nil); !reflect.DeepEqual(reused, sortDigests(chainIDs)) {
+		t.Errorf("expected both layers to be reused when unpacking the same image again, got %v", reused)
+	}
+	unpacked, reused = unpack("second", nil, nil)
+	if !reflect.DeepEqual(reused, []digest.Digest{base}) {
+		t.Errorf("expected only the shared base layer %s to be reused, got %v", base, reused)
+	}
+	if _, err := os.Stat(filepath.Join(unpacked.Layers[1].MergedDir, "base")); err != nil {
+		t.Errorf("expected the merged contents of the second image to include the reused base layer: %v", err)
+	}
+	
+	// Verify that changing the ID mappings or the extended attribute filter invalidates the cached layers, and that the new options are then cached in turn
+	mappings, err := layer.ParseIDMappings(fmt.Sprintf("%d:%d:1", os.Getuid(), os.Getuid()), fmt.Sprintf("%d:%d:1", os.Getgid(), os.Getgid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	xattrs := &layer.XattrFilter{Deny: []string{"user.test."}}
+	options := []struct {
+		
+		// A description of the options
+		name string
+		
+		// The ID mappings to unpack with
+		mappings *layer.IDMappings
+		
+		// The extended attribute filter to unpack with
+		xattrs *layer.XattrFilter
+	}{
+		{name: "ID mappings", mappings: mappings},
+		{name: "extended attribute filter", xattrs: xattrs},
+		{name: "both", mappings: mappings, xattrs: xattrs},
+	}
+	for _, option := range options {
+		if _, reused := unpack("first", option.mappings, option.xattrs); len(reused) != 0 {
+			t.Errorf("expected changing the %s to invalidate the cached layers, got %v", option.name, reused)
+		}
+		if _, reused := unpack("first", option.mappings, option.xattrs); len(reused) != 2 {
+			t.Errorf("expected the layers unpacked with the changed %s to be reused, got %v", option.name, reused)
+		}
+	}
+}
+
+// Tests that layer records store the resolved default extended attribute filter, so that layers unpacked with the default filter are only reused with a filter that includes the same attributes
+func TestUnpackRecordsResolvedXattrFilter(t *testing.T) {
+	root := t.TempDir()
+	imageDir := filepath.Join(root, "image")
+	unpackDir := filepath.Join(root, "unpacked")
+	if _, err := testutil.CreateLayout(imageDir, oci.MediaTypeImageLayerGzip, createCacheTestArchives(t, "base", "top")...); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Unpacks the image with the specified filter, returning the unpacked image and the ChainIDs of the layers that were reused
+	unpack := func(xattrs *layer.XattrFilter) (*image.UnpackedImage, []digest.Digest) {
+		unpacker, err := image.UnpackerForImage(imageDir, unpackDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unpacker.Close()
+		
+		recorder := &reuseRecorder{}
+		unpacker.Xattrs = xattrs
+		unpacker.Observer = recorder
+		unpacked, err := unpacker.Unpack(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		
+		return unpacked, recorder.reused
+	}
+	
+	// Unpack the image with the default filter and verify that each layer's record stores the filter that the default resolved to
+	unpacked, _ := unpack(nil)
+	for _, unpackedLayer := range unpacked.Layers {
+		data, err := os.ReadFile(filepath.Join(unpackedLayer.Dir, image.LAYER_RECORD_FILENAME))
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := &image.LayerRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Xattrs == nil || !reflect.DeepEqual(record.Xattrs, layer.DefaultXattrFilter()) {
+			t.Errorf("expected the record for layer %s to store the resolved default filter %+v, got %+v", unpackedLayer.ChainID, layer.DefaultXattrFilter(), record.Xattrs)
+		}
+	}
+	
+	// Verify that unpacking with an explicit filter that allows all attributes only reuses the layers if that is what the default filter allows, which is the case for root
+	allowAll := &layer.XattrFilter{}
+	_, reused := unpack(allowAll)
+	if expectReuse := os.Geteuid() == 0; expectReuse && len(reused) != len(unpacked.Layers) {
+		t.Errorf("expected root to reuse the layers unpacked with the default filter when allowing all attributes, got %v", reused)
+	} else if !expectReuse && len(reused) != 0 {
+		t.Errorf("expected layers unpacked by a non-root user with the default filter not to be reused when allowing all attributes, got %v", reused)
+	}
+}
+
+// Returns a sorted copy of a list of digests
+func sortDigests(digests []digest.Digest) []digest.Digest {
+	sorted := append([]digest.Digest{}, digests...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
@@ -0,0 +1,179 @@
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/macoscontainers/experiments/internal/layer"
+	"github.com/macoscontainers/experiments/internal/progress"
+	"github.com/macoscontainers/experiments/tests/testutil"
+)
+
+// The number of files in the trees used to test cancellation, which is large enough that cancelling after the first file leaves most of them unprocessed
+const cancelTestFiles = 64
+
+// Wraps a reader, cancelling a context once the specified number of bytes have been read
+type cancellingReader struct {
+	
+	// The underlying reader
+	reader io.Reader
+	
+	// The function that cancels the context
+	cancel context.CancelFunc
+	
+	// The number of bytes that may be read before the context is cancelled
+	remaining int
+}
+
+// Reads from the underlying reader, cancelling the context once enough data has been read
+func (reader *cancellingReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.remaining -= n
+	if reader.remaining <= 0 {
+		reader.cancel()
+	}
+	
+	return n, err
+}
+
+// Creates a directory containing the specified number of files
+func createCancelTestTree(t *testing.T, dir string, count int) {
+	for index := 0; index < count; index++ {
+		writeFileWithTime(t, filepath.Join(dir, "files", fmt.Sprintf("file%d", index)), "contents", time.Unix(1600000000, 0))
+	}
+}
+
+// Tests that extraction stops and reports cancellation when its context is cancelled, both before and during extraction
+func TestExtractContextStopsWhenCancelled(t *testing.T) {
+	entries := []testutil.ArchiveEntry{{Type: tar.TypeDir, Name: "files/"}}
+	for index := 0; index < cancelTestFiles; index++ {
+		entries = append(entries, testutil.ArchiveEntry{Type: tar.TypeReg, Name: fmt.Sprintf("files/file%d", index), Contents: "contents"})
+	}
+	archive, err := testutil.CreateArchive(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verify that nothing is extracted when the context has already been cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	diffDir := filepath.Join(t.TempDir(), "cancelled")
+	extractor := &layer.LayerExtractor{DiffDir: diffDir}
+	if err := extractor.ExtractContext(ctx, bytes.NewReader(archive.Bytes())); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected extraction with a cancelled context to report cancellation, got: %v", err)
+	}
+	if extracted := listTree(t, diffDir); len(extracted) != 0 {
+		t.Errorf("expected nothing to be extracted with a cancelled context, got %v", extracted)
+	}
+	
+	// Verify that extraction stops part of the way through the archive when the context is cancelled after the first few entries have been read
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	diffDir = filepath.Join(t.TempDir(), "interrupted")
+	extractor = &layer.LayerExtractor{DiffDir: diffDir}
+	reader := &cancellingReader{reader: bytes.NewReader(archive.Bytes()), cancel: cancel, remaining: 4096}
+	if err := extractor.ExtractContext(ctx, reader); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected interrupted extraction to report cancellation, got: %v", err)
+	}
+	if extracted := listTree(t, diffDir); len(extracted) >= len(entries) {
+		t.Errorf("expected extraction to stop before every entry was extracted, got %d entries", len(extracted))
+	}
+}
+
+// Tests that applying a diff stops and reports cancellation when its context is cancelled, both before and during application
+func TestApplyRecursiveContextStopsWhenCancelled(t *testing.T) {
+	root := t.TempDir()
+	baseDir := filepath.Join(root, "base")
+	diffDir := filepath.Join(root, "diff")
+	if err := os.MkdirAll(baseDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	createCancelTestTree(t, diffDir, cancelTestFiles)
+	
+	for _, cancelled := range []bool{true, false} {
+		
+		// Cancel the context either before the diff is applied or as soon as the first file has been applied
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if cancelled {
+			cancel()
+		}
+		mergedDir := filepath.Join(root, fmt.Sprintf("merged-%v", cancelled))
+		if err := os.MkdirAll(mergedDir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		applier := &layer.DiffApplier{
+			BaseDir: baseDir,
+			DiffDir: diffDir,
+			MergedDir: mergedDir,
+			Observer: progress.ObserverFunc(func(event progress.Event) {
+				if event.Type == progress.FileApplied {
+					cancel()
+				}
+			}),
+		}
+		
+		// Verify that application reports cancellation and stops before every file has been applied
+		if err := <-applier.ApplyRecursiveContext(ctx, "", nil, false); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected applying a diff with a cancelled context (cancelled beforehand: %v) to report cancellation, got: %v", cancelled, err)
+		}
+		if applied := listTree(t, mergedDir); len(applied) > cancelTestFiles {
+			t.Errorf("expected application (cancelled beforehand: %v) to stop before every file was applied, got %d entries", cancelled, len(applied))
+		} else if cancelled && len(applied) != 0 {
+			t.Errorf("expected nothing to be applied with a cancelled context, got %v", applied)
+		}
+	}
+}
+
+// Tests that generating a diff stops and reports cancellation when its context is cancelled, both before and during generation
+func TestDiffRecursiveContextStopsWhenCancelled(t *testing.T) {
+	root := t.TempDir()
+	baseDir := filepath.Join(root, "base")
+	modifiedDir := filepath.Join(root, "modified")
+	if err := os.MkdirAll(baseDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	createCancelTestTree(t, modifiedDir, cancelTestFiles)
+	
+	for _, cancelled := range []bool{true, false} {
+		
+		// Cancel the context either before the diff is generated or as soon as the first file has been mirrored into the diff
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if cancelled {
+			cancel()
+		}
+		diffDir := filepath.Join(root, fmt.Sprintf("diff-%v", cancelled))
+		if err := os.MkdirAll(diffDir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		generator := &layer.DiffGenerator{
+			BaseDir: baseDir,
+			ModifiedDir: modifiedDir,
+			DiffDir: diffDir,
+			Observer: progress.ObserverFunc(func(event progress.Event) {
+				if event.Type == progress.FileDiffed {
+					cancel()
+				}
+			}),
+		}
+		
+		// Verify that generation reports cancellation and stops before every file has been mirrored
+		if err := <-generator.DiffRecursiveContext(ctx, "", nil, false); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected generating a diff with a cancelled context (cancelled beforehand: %v) to report cancellation, got: %v", cancelled, err)
+		}
+		if generated := listTree(t, diffDir); len(generated) > cancelTestFiles {
+			t.Errorf("expected generation (cancelled beforehand: %v) to stop before every file was mirrored, got %d entries", cancelled, len(generated))
+		} else if cancelled && len(generated) != 0 {
+			t.Errorf("expected nothing to be generated with a cancelled context, got %v", generated)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package tests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/internal/layer"
+	"github.com/macoscontainers/experiments/tests/testutil"
+	digest "github.com/opencontainers/go-digest"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Returns the descriptors in the OCI index of an image layout that have the specified reference name
+func descriptorsWithRefName(t *testing.T, imageDir string, name string) []oci.Descriptor {
+	index, err := testutil.ReadIndex(imageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	descriptors := []oci.Descriptor{}
+	for _, descriptor := range index.Manifests {
+		if descriptor.Annotations[oci.AnnotationRefName] == name {
+			descriptors = append(descriptors, descriptor)
+		}
+	}
+	return descriptors
+}
+
+// Tests that committing a diff writes a new layer, image configuration and image manifest that unpack to the modified files, and that committing with an existing reference name replaces the image it refers to
+func TestCommitRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	imageDir := filepath.Join(root, "image")
+	unpackDir := filepath.Join(root, "unpacked")
+	epoch := time.Unix(1700000000, 0).UTC()
+	
+	// Create a base image, along with an existing image with the reference name that the commit will replace
+	base, err := testutil.CreateImage(imageDir, oci.MediaTypeImageLayerGzip, createCacheTestArchives(t, "first", "second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.WriteIndex(imageDir, []oci.Descriptor{withRefName(base, "base"), withRefName(base, "app")}); err != nil {
+		t.Fatal(err)
+	}
+	baseManifest, err := testutil.ReadManifest(imageDir, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseConfig, err := testutil.ReadConfig(imageDir, baseManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Unpack the base image
+	unpacker, err := image.UnpackerForImage(imageDir, unpackDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacked, err := unpacker.UnpackReference("base", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Create a diff that removes a file, modifies a file and adds a file
+	diffDir := filepath.Join(root, "diff")
+	writeFileWithTime(t, filepath.Join(diffDir, layer.WhiteoutForFile("first")), "", epoch)
+	writeFileWithTime(t, filepath.Join(diffDir, "second"), "modified", epoch)
+	writeFileWithTime(t, filepath.Join(diffDir, "added"), "added", epoch)
+	
+	// Commit the diff with the reference name of the existing image
+	options := image.CommitOptions{RefName: "app", CreatedBy: "test command", Comment: "test comment", SourceDateEpoch: epoch}
+	committed, err := unpacker.Commit(context.Background(), unpacked, diffDir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verify that the index holds exactly one image with the reference name, which is the committed image, and that the base image is unaffected
+	if named := descriptorsWithRefName(t, imageDir, "app"); len(named) != 1 || named[0].Digest != committed.Digest {
+		t.Errorf("expected exactly one descriptor for app referring to %s, got %+v", committed.Digest, named)
+	}
+	if named := descriptorsWithRefName(t, imageDir, "base"); len(named) != 1 || named[0].Digest != base.Digest {
+		t.Errorf("expected the base image to remain in the index, got %+v", named)
+	}
+	if committed.Platform == nil || committed.Platform.OS != base.Platform.OS || committed.Platform.Architecture != base.Platform.Architecture {
+		t.Errorf("expected the committed image to have the platform of the base image %+v, got %+v", base.Platform, committed.Platform)
+	}
+	
+	// Verify that the manifest appends the new layer to the base layers, and that the layer blob matches its digest
+	manifest, err := testutil.ReadManifest(imageDir, committed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != len(baseManifest.Layers) + 1 || !reflect.DeepEqual(manifest.Layers[:len(baseManifest.Layers)], baseManifest.Layers) {
+		t.Fatalf("expected the committed manifest to append one layer to %+v, got %+v", baseManifest.Layers, manifest.Layers)
+	}
+	newLayer := manifest.Layers[len(manifest.Layers) - 1]
+	blob, err := os.ReadFile(testutil.BlobPath(imageDir, newLayer.Digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newLayer.MediaType != oci.MediaTypeImageLayerGzip || digest.FromBytes(blob) != newLayer.Digest || int64(len(blob)) != newLayer.Size {
+		t.Errorf("expected the new layer descriptor %+v to describe its gzip-compressed blob", newLayer)
+	}
+	decompressor, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := io.ReadAll(decompressor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verify that the configuration matches the manifest's config descriptor, and appends the new diff_id and history entry
+	config, err := testutil.ReadConfig(imageDir, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configData, err := os.ReadFile(testutil.BlobPath(imageDir, manifest.Config.Digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest.FromBytes(configData) != manifest.Config.Digest || manifest.Config.MediaType != oci.MediaTypeImageConfig {
+		t.Errorf("expected the config descriptor %+v to describe the configuration blob", manifest.Config)
+	}
+	expectedDiffIDs := append(append([]digest.Digest{}, baseConfig.RootFS.DiffIDs...), digest.FromBytes(uncompressed))
+	if !reflect.DeepEqual(config.RootFS.DiffIDs, expectedDiffIDs) {
+		t.Errorf("expected diff_ids %v, got %v", expectedDiffIDs, config.RootFS.DiffIDs)
+	}
+	if len(config.History) != len(baseConfig.History) + 1 {
+		t.Fatalf("expected one history entry to be added to %+v, got %+v", baseConfig.History, config.History)
+	}
+	history := config.History[len(config.History) - 1]
+	if history.CreatedBy != options.CreatedBy || history.Comment != options.Comment || history.Created == nil || !history.Created.Equal(epoch) {
+		t.Errorf("unexpected history entry for the new layer: %+v", history)
+	}
+	if config.Created == nil || !config.Created.Equal(epoch) || config.OS != baseConfig.OS || config.Architecture != baseConfig.Architecture {
+		t.Errorf("unexpected creation time or platform in the committed configuration: %+v", config)
+	}
+	
+	// Unpack the committed image by its reference name and verify its merged contents
+	reopened, err := image.UnpackerForImage(imageDir, unpackDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := reopened.UnpackReference("app", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"second": "modified", "added": "added"}
+	if merged := readTree(t, app.Layers[len(app.Layers) - 1].MergedDir); !reflect.DeepEqual(merged, expected) {
+		t.Errorf("unexpected merged contents for the committed image:\nexpected: %v\nactual:   %v", expected, merged)
+	}
+	
+	// Commit modified files on top of the committed image without a reference name, and verify that the new image is appended without an annotation while the existing images are kept
+	modifiedDir := filepath.Join(root, "modified")
+	writeFileWithTime(t, filepath.Join(modifiedDir, "added"), "added", epoch)
+	generator := &layer.DiffGenerator{BaseDir: app.Layers[len(app.Layers) - 1].MergedDir, ModifiedDir: modifiedDir}
+	appended, err := reopened.CommitModified(context.Background(), app, generator, image.CommitOptions{SourceDateEpoch: epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := testutil.ReadIndex(imageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 3 || index.Manifests[2].Digest != appended.Digest || index.Manifests[2].Annotations[oci.AnnotationRefName] != "" {
+		t.Errorf("expected the unnamed image to be appended to the index, got %+v", index.Manifests)
+	}
+	if named := descriptorsWithRefName(t, imageDir, "app"); len(named) != 1 || named[0].Digest != committed.Digest {
+		t.Errorf("expected committing without a reference name to leave app unchanged, got %+v", named)
+	}
+	
+	// Verify that the image committed from the modified files unpacks to them
+	final, err := reopened.UnpackReference(appended.Digest.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged, modified := readTree(t, final.Layers[len(final.Layers) - 1].MergedDir), readTree(t, modifiedDir); !reflect.DeepEqual(merged, modified) {
+		t.Errorf("unexpected merged contents for the image committed from modified files:\nexpected: %v\nactual:   %v", modified, merged)
+	}
+}
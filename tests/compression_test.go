@@ -0,0 +1,169 @@
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/macoscontainers/experiments/internal/compression"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Generates a small uncompressed layer archive
+func createCompressionTestArchive(t *testing.T) []byte {
+	return createExtractTestArchive(t, []*tar.Header{
+		{Typeflag: tar.TypeReg, Name: "file", Mode: 0644, ModTime: time.Unix(1600000000, 0)},
+	}, map[string]string{"file": "contents"}).Bytes()
+}
+
+// Compresses data with the specified codec from the default registry
+func compressWithCodec(t *testing.T, codec string, data []byte) []byte {
+	compressed := &bytes.Buffer{}
+	writer, err := compression.Default.Compress(codec, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	
+	return compressed.Bytes()
+}
+
+// Tests that codecs are identified by their magic bytes
+func TestRegistrySniff(t *testing.T) {
+	archive := createCompressionTestArchive(t)
+	cases := []struct {
+		
+		// A description of the stream
+		name string
+		
+		// The leading bytes of the stream
+		header []byte
+		
+		// The name of the codec that is expected to match (empty if none is expected)
+		expected string
+	}{
+		{name: "gzip", header: compressWithCodec(t, compression.CODEC_GZIP, archive), expected: compression.CODEC_GZIP},
+		{name: "zstd", header: compressWithCodec(t, compression.CODEC_ZSTD, archive), expected: compression.CODEC_ZSTD},
+		{name: "tar", header: archive, expected: compression.CODEC_NONE},
+		{name: "unrecognised", header: []byte("plain text"), expected: ""},
+		{name: "truncated gzip", header: []byte{0x1f}, expected: ""},
+		{name: "empty", header: []byte{}, expected: ""},
+	}
+	
+	for _, testCase := range cases {
+		actual := ""
+		if codec := compression.Default.Sniff(testCase.header); codec != nil {
+			actual = codec.Name
+		}
+		if actual != testCase.expected {
+			t.Errorf("expected %s stream to match codec %q, got %q", testCase.name, testCase.expected, actual)
+		}
+	}
+}
+
+// Tests that layer data is decompressed with the codec for its media type, falling back to its magic bytes when the media type is unknown or contradicted
+func TestRegistryDecompress(t *testing.T) {
+	archive := createCompressionTestArchive(t)
+	streams := map[string][]byte{
+		compression.CODEC_NONE: archive,
+		compression.CODEC_GZIP: compressWithCodec(t, compression.CODEC_GZIP, archive),
+		compression.CODEC_ZSTD: compressWithCodec(t, compression.CODEC_ZSTD, archive),
+	}
+	
+	cases := []struct {
+		
+		// The declared media type of the layer data
+		mediaType string
+		
+		// The codec that was actually used to compress the layer data
+		codec string
+		
+		// Whether a mismatch between the media type and the data is expected to be reported
+		mismatch bool
+	}{
+		{mediaType: oci.MediaTypeImageLayer, codec: compression.CODEC_NONE},
+		{mediaType: oci.MediaTypeImageLayerGzip, codec: compression.CODEC_GZIP},
+		{mediaType: "application/vnd.oci.image.layer.v1.tar+zstd", codec: compression.CODEC_ZSTD},
+		{mediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip", codec: compression.CODEC_GZIP},
+		{mediaType: oci.MediaTypeImageLayerGzip, codec: compression.CODEC_ZSTD, mismatch: true},
+		{mediaType: oci.MediaTypeImageLayerGzip, codec: compression.CODEC_NONE, mismatch: true},
+		{mediaType: oci.MediaTypeImageLayer, codec: compression.CODEC_GZIP, mismatch: true},
+		{mediaType: "application/x-unknown", codec: compression.CODEC_GZIP},
+		{mediaType: "application/x-unknown", codec: compression.CODEC_NONE},
+		{mediaType: "", codec: compression.CODEC_ZSTD},
+	}
+	
+	for _, testCase := range cases {
+		
+		// Decompress the data and verify that the expected codec was selected
+		reader, codec, err := compression.Default.Decompress(testCase.mediaType, bytes.NewReader(streams[testCase.codec]))
+		if err != nil {
+			t.Errorf("failed to decompress %s data with media type %q: %v", testCase.codec, testCase.mediaType, err)
+			continue
+		}
+		if codec.Name != testCase.codec {
+			t.Errorf("expected %s data with media type %q to be decompressed with codec %s, got %s", testCase.codec, testCase.mediaType, testCase.codec, codec.Name)
+		}
+		
+		// Verify that the decompressed data matches the original archive
+		decompressed, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decompressed, archive) {
+			t.Errorf("unexpected decompressed contents for %s data with media type %q", testCase.codec, testCase.mediaType)
+		}
+		
+		// Verify that mismatches are reported
+		var mismatch *compression.MediaTypeMismatchError
+		err = compression.Default.CheckMediaType(testCase.mediaType, codec)
+		if testCase.mismatch && (!errors.As(err, &mismatch) || mismatch.Actual != testCase.codec) {
+			t.Errorf("expected a mismatch to be reported for %s data with media type %q, got %v", testCase.codec, testCase.mediaType, err)
+		} else if !testCase.mismatch && err != nil {
+			t.Errorf("expected no mismatch for %s data with media type %q, got %v", testCase.codec, testCase.mediaType, err)
+		}
+	}
+}
+
+// Tests that media types cannot be registered for unknown codecs, and that decompression-only codecs cannot compress
+func TestRegistryRejectsInvalidCodecs(t *testing.T) {
+	registry := compression.NewRegistry()
+	registry.RegisterCodec(&compression.Codec{
+		Name: "decompress-only",
+		Magic: []byte{0xde, 0xad},
+		Decompress: func(reader io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(reader), nil
+		},
+	})
+	
+	if err := registry.RegisterMediaType("application/x-test", "unknown"); err == nil {
+		t.Error("expected registering a media type for an unknown codec to fail")
+	}
+	if _, known := registry.CodecForMediaType("application/x-test"); known {
+		t.Error("expected the failed registration to leave the media type unregistered")
+	}
+	if err := registry.RegisterMediaType("application/x-test", "decompress-only"); err != nil {
+		t.Error(err)
+	}
+	
+	if _, err := registry.Compress("decompress-only", io.Discard); err == nil {
+		t.Error("expected compressing with a decompression-only codec to fail")
+	}
+	if _, err := registry.Compress("unknown", io.Discard); err == nil {
+		t.Error("expected compressing with an unknown codec to fail")
+	}
+	
+	// Data that matches no codec cannot be decompressed if the registry has no uncompressed codec to fall back to
+	if _, _, err := registry.Decompress("application/x-unknown", bytes.NewReader([]byte("plain"))); err == nil {
+		t.Error("expected decompressing unidentifiable data without a fallback codec to fail")
+	}
+}
@@ -0,0 +1,370 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/macoscontainers/experiments/internal/filesystem"
+	"github.com/macoscontainers/experiments/internal/layer"
+	"golang.org/x/sys/unix"
+)
+
+// Creates a file with the specified contents and modification time
+func writeFileWithTime(t *testing.T, path string, contents string, modified time.Time) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Creates a symlink with the specified target and modification time
+func symlinkWithTime(t *testing.T, target string, path string, modified time.Time) {
+	if err := os.Symlink(target, path); err != nil {
+		t.Fatal(err)
+	}
+	times := []unix.Timespec{unix.NsecToTimespec(modified.UnixNano()), unix.NsecToTimespec(modified.UnixNano())}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Lists the paths of all entries in a directory tree, relative to its root
+func listTree(t *testing.T, root string) []string {
+	paths := []string{}
+	if !filesystem.Exists(root) {
+		return paths
+	}
+	
+	err := filepath.WalkDir(root, func(path string, details os.DirEntry, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		relative, err := filepath.Rel(root, path)
+		paths = append(paths, relative)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	sort.Strings(paths)
+	return paths
+}
+
+// Runs a DiffGenerator, replacing any previously generated diff
+func generateDiff(t *testing.T, generator *layer.DiffGenerator) {
+	if err := os.RemoveAll(generator.DiffDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(generator.DiffDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-generator.DiffRecursive("", nil, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests that DiffGenerator detects changes to the contents and metadata of files, symlinks and directories that exist in both the base layer and the modified files
+func TestDiffDetectsModifications(t *testing.T) {
+	root := t.TempDir()
+	baseDir := filepath.Join(root, "base")
+	modifiedDir := filepath.Join(root, "modified")
+	timestamp := time.Unix(1600000000, 0)
+	
+	// Populate identical base and modified trees, with files that are independent copies rather than hardlinks
+	files := map[string]string{
+		"unchanged/file.txt": "unchanged",
+		"contents/file.txt": "original",
+		"samesize/file.txt": "original",
+		"mtime/file.txt": "original",
+		"mode/file.txt": "original",
+		"xattr/file.txt": "original",
+	}
+	for _, dir := range []string{baseDir, modifiedDir} {
+		for name, contents := range files {
+			writeFileWithTime(t, filepath.Join(dir, name), contents, timestamp)
+		}
+		symlinkWithTime(t, "unchanged/file.txt", filepath.Join(dir, "link"), timestamp)
+		symlinkWithTime(t, "mtime/file.txt", filepath.Join(dir, "retargeted"), timestamp)
+		if err := os.Mkdir(filepath.Join(dir, "dirmode"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	// Modify the entries in the modified tree
+	writeFileWithTime(t, filepath.Join(modifiedDir, "contents", "file.txt"), "modified contents", timestamp)
+	writeFileWithTime(t, filepath.Join(modifiedDir, "samesize", "file.txt"), "modified", timestamp)
+	writeFileWithTime(t, filepath.Join(modifiedDir, "mtime", "file.txt"), "original", timestamp.Add(time.Second))
+	if err := os.Chmod(filepath.Join(modifiedDir, "mode", "file.txt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(modifiedDir, "retargeted")); err != nil {
+		t.Fatal(err)
+	}
+	symlinkWithTime(t, "xattr/file.txt", filepath.Join(modifiedDir, "retargeted"), timestamp)
+	if err := os.Chmod(filepath.Join(modifiedDir, "dirmode"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	xattrSupported := true
+	if err := filesystem.SetXattr(filepath.Join(modifiedDir, "xattr", "file.txt"), "user.test", []byte("value")); filesystem.IsXattrUnsupported(err) {
+		xattrSupported = false
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Restore the modification times of the directories, since modifying their contents will have updated them
+	for _, dir := range []string{"unchanged", "contents", "samesize", "mtime", "mode", "xattr"} {
+		for _, tree := range []string{baseDir, modifiedDir} {
+			if err := os.Chtimes(filepath.Join(tree, dir), timestamp, timestamp); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	
+	// Generate diffs with and without content comparison
+	for _, compareContents := range []bool{false, true} {
+		diffDir := filepath.Join(root, "diff")
+		generateDiff(t, &layer.DiffGenerator{BaseDir: baseDir, ModifiedDir: modifiedDir, DiffDir: diffDir, CompareContents: compareContents})
+		
+		// Determine which entries we expect the diff to contain
+		expected := map[string]bool{
+			"contents": true,
+			"contents/file.txt": true,
+			"dirmode": true,
+			"mode": true,
+			"mode/file.txt": true,
+			"mtime": true,
+			"mtime/file.txt": true,
+			"retargeted": true,
+			"samesize": compareContents,
+			"samesize/file.txt": compareContents,
+			"xattr": xattrSupported,
+			"xattr/file.txt": xattrSupported,
+		}
+		
+		// Verify that the diff contains exactly the modified entries
+		for _, path := range listTree(t, diffDir) {
+			if !expected[path] {
+				t.Errorf("unexpected entry in diff (compareContents: %v): %s", compareContents, path)
+			}
+			delete(expected, path)
+		}
+		for path, present := range expected {
+			if present {
+				t.Errorf("expected entry missing from diff (compareContents: %v): %s", compareContents, path)
+			}
+		}
+	}
+}
+
+// Tests that DiffGenerator replaces the individual whiteouts for a directory with an opaque whiteout once enough of its original entries have been removed or replaced
+func TestDiffGeneratesOpaqueWhiteouts(t *testing.T) {
+	root := t.TempDir()
+	baseDir := filepath.Join(root, "base")
+	modifiedDir := filepath.Join(root, "modified")
+	timestamp := time.Unix(1600000000, 0)
+	
+	// Populate the base layer with a directory that will be deleted and recreated, a directory that will be partially emptied, and a file that will become a directory
+	for _, name := range []string{"recreated/a", "recreated/b", "partial/kept", "partial/removed", "swapped"} {
+		writeFileWithTime(t, filepath.Join(baseDir, name), "original", timestamp)
+	}
+	for _, dir := range []string{"recreated", "partial"} {
+		if err := os.Chtimes(filepath.Join(baseDir, dir), timestamp, timestamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	// Populate the modified files, preserving the timestamps of the directories so that only their contents differ
+	for _, name := range []string{"recreated/a", "recreated/c", "partial/kept", "swapped/child"} {
+		modified := timestamp
+		if name != "partial/kept" {
+			modified = timestamp.Add(time.Hour)
+		}
+		writeFileWithTime(t, filepath.Join(modifiedDir, name), "original", modified)
+	}
+	for _, dir := range []string{"recreated", "partial"} {
+		if err := os.Chtimes(filepath.Join(modifiedDir, dir), timestamp, timestamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	cases := []struct {
+		
+		// The opaque whiteout threshold to use
+		threshold float64
+		
+		// The entries that the generated diff is expected to contain
+		expected []string
+	}{
+		{
+			threshold: 0,
+			expected: []string{"partial", "partial/.wh.removed", "recreated", "recreated/.wh.b", "recreated/a", "recreated/c", ".wh.swapped", "swapped", "swapped/child"},
+		},
+		{
+			threshold: 1,
+			expected: []string{"partial", "partial/.wh.removed", "recreated", "recreated/.wh..wh..opq", "recreated/a", "recreated/c", ".wh.swapped", "swapped", "swapped/child"},
+		},
+		{
+			threshold: 0.5,
+			expected: []string{"partial", "partial/.wh..wh..opq", "partial/kept", "recreated", "recreated/.wh..wh..opq", "recreated/a", "recreated/c", ".wh.swapped", "swapped", "swapped/child"},
+		},
+	}
+	
+	for _, testCase := range cases {
+		
+		// Generate the diff
+		diffDir := filepath.Join(root, "diff")
+		generateDiff(t, &layer.DiffGenerator{BaseDir: baseDir, ModifiedDir: modifiedDir, DiffDir: diffDir, OpaqueWhiteoutThreshold: testCase.threshold})
+		
+		// Verify that the diff contains the expected entries
+		sort.Strings(testCase.expected)
+		if actual := listTree(t, diffDir); strings.Join(actual, ",") != strings.Join(testCase.expected, ",") {
+			t.Errorf("unexpected diff for threshold %v:\nexpected: %v\nactual:   %v", testCase.threshold, testCase.expected, actual)
+		}
+		
+		// Verify that applying the diff to the base layer reproduces the modified files
+		mergedDir := filepath.Join(root, "merged")
+		if err := os.RemoveAll(mergedDir); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(mergedDir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		applier := &layer.DiffApplier{BaseDir: baseDir, DiffDir: diffDir, MergedDir: mergedDir}
+		if err := <-applier.ApplyRecursive("", nil, false); err != nil {
+			t.Fatal(err)
+		}
+		if merged, modified := listTree(t, mergedDir), listTree(t, modifiedDir); strings.Join(merged, ",") != strings.Join(modified, ",") {
+			t.Errorf("applying the diff for threshold %v did not reproduce the modified files:\nexpected: %v\nactual:   %v", testCase.threshold, modified, merged)
+		}
+	}
+}
+
+// Tests that adding a file to a directory does not cause its ancestors to be erased with opaque whiteouts, even though adding the file changes the directory's modification time
+func TestDiffIgnoresModifiedDirectoriesForOpaqueWhiteouts(t *testing.T) {
+	root := t.TempDir()
+	baseDir := filepath.Join(root, "base")
+	modifiedDir := filepath.Join(root, "modified")
+	timestamp := time.Unix(1600000000, 0)
+	
+	// Populate the base layer and the modified files with the same files, and add a new file to the modified files without preserving the timestamps of any directories
+	for _, dir := range []string{baseDir, modifiedDir} {
+		for _, name := range []string{"opt/app/lib/a", "opt/app/lib/b", "opt/app/lib/c"} {
+			writeFileWithTime(t, filepath.Join(dir, name), "original", timestamp)
+		}
+	}
+	for _, dir := range []string{"opt", "opt/app", "opt/app/lib"} {
+		if err := os.Chtimes(filepath.Join(baseDir, dir), timestamp, timestamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFileWithTime(t, filepath.Join(modifiedDir, "opt", "app", "lib", "new"), "added", time.Now())
+	
+	// Verify that only the new file and its ancestors are included in the diff, for any threshold
+	for _, threshold := range []float64{1, 0.5, 0.01} {
+		diffDir := filepath.Join(root, fmt.Sprintf("diff-%v", threshold))
+		generateDiff(t, &layer.DiffGenerator{BaseDir: baseDir, ModifiedDir: modifiedDir, DiffDir: diffDir, OpaqueWhiteoutThreshold: threshold})
+		expected := []string{"opt", "opt/app", "opt/app/lib", "opt/app/lib/new"}
+		if actual := listTree(t, diffDir); strings.Join(actual, ",") != strings.Join(expected, ",") {
+			t.Errorf("unexpected diff for threshold %v:\nexpected: %v\nactual:   %v", threshold, expected, actual)
+		}
+	}
+}
+
+// Verifies that every entry in a directory tree has the same modification time as the corresponding entry in another tree
+func assertSameModTimes(t *testing.T, expectedRoot string, actualRoot string, paths []string) {
+	for _, path := range paths {
+		expected, err := os.Lstat(filepath.Join(expectedRoot, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := os.Lstat(filepath.Join(actualRoot, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !actual.ModTime().Equal(expected.ModTime()) {
+			t.Errorf("expected the modification time of %s to be %v, got %v", filepath.Join(actualRoot, path), expected.ModTime(), actual.ModTime())
+		}
+	}
+}
+
+// Tests that DiffGenerator and DiffApplier preserve the timestamps of files, symlinks and directories, so that an applied diff reproduces the modified files exactly
+func TestDiffPreservesTimestamps(t *testing.T) {
+	root := t.TempDir()
+	baseDir := filepath.Join(root, "base")
+	modifiedDir := filepath.Join(root, "modified")
+	original := time.Unix(1600000000, 123456789)
+	modified := time.Unix(1650000000, 987654321)
+	
+	// Populate identical base and modified trees
+	for _, dir := range []string{baseDir, modifiedDir} {
+		writeFileWithTime(t, filepath.Join(dir, "kept", "file"), "original", original)
+		writeFileWithTime(t, filepath.Join(dir, "removed", "file"), "original", original)
+		symlinkWithTime(t, "file", filepath.Join(dir, "kept", "link"), original)
+	}
+	
+	// Modify the contents of existing directories and add new ones
+	if err := os.RemoveAll(filepath.Join(modifiedDir, "removed")); err != nil {
+		t.Fatal(err)
+	}
+	writeFileWithTime(t, filepath.Join(modifiedDir, "kept", "added"), "added", modified)
+	writeFileWithTime(t, filepath.Join(modifiedDir, "new", "nested", "file"), "added", modified)
+	symlinkWithTime(t, "nested/file", filepath.Join(modifiedDir, "new", "link"), modified)
+	
+	// Set distinct nanosecond timestamps for each of the directories, now that their contents have been written
+	for index, dir := range []string{"kept", "removed", "new/nested", "new"} {
+		timestamp := original.Add(time.Duration(index + 1) * time.Second + time.Duration(index + 1))
+		for _, tree := range []string{baseDir, modifiedDir} {
+			if path := filepath.Join(tree, dir); filesystem.Exists(path) {
+				if err := filesystem.SetTimes(path, timestamp, timestamp.Add(time.Duration(index))); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	if err := filesystem.SetTimes(filepath.Join(modifiedDir, "kept"), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verify that the generated diff preserves the timestamps of the modified files
+	diffDir := filepath.Join(root, "diff")
+	generateDiff(t, &layer.DiffGenerator{BaseDir: baseDir, ModifiedDir: modifiedDir, DiffDir: diffDir})
+	diffEntries := []string{}
+	for _, path := range listTree(t, diffDir) {
+		if !layer.IsWhiteout(filepath.Base(path)) {
+			diffEntries = append(diffEntries, path)
+		}
+	}
+	if len(diffEntries) == 0 {
+		t.Fatal("expected the diff to contain the modified files")
+	}
+	assertSameModTimes(t, modifiedDir, diffDir, diffEntries)
+	
+	// Verify that applying the diff reproduces the timestamps of the modified files
+	mergedDir := filepath.Join(root, "merged")
+	if err := os.MkdirAll(mergedDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	applier := &layer.DiffApplier{BaseDir: baseDir, DiffDir: diffDir, MergedDir: mergedDir}
+	if err := <-applier.ApplyRecursive("", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	assertSameModTimes(t, modifiedDir, mergedDir, listTree(t, modifiedDir))
+	
+	// Verify that the merged files are indistinguishable from the modified files
+	regenerated := filepath.Join(root, "regenerated")
+	generateDiff(t, &layer.DiffGenerator{BaseDir: mergedDir, ModifiedDir: modifiedDir, DiffDir: regenerated})
+	if entries := listTree(t, regenerated); len(entries) != 0 {
+		t.Errorf("expected no differences between the merged files and the modified files, got %v", entries)
+	}
+}
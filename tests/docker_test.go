@@ -0,0 +1,145 @@
+package tests
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/macoscontainers/experiments/internal/compression"
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/tests/testutil"
+	digest "github.com/opencontainers/go-digest"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Tests that `docker save` tarballs are presented as OCI image layouts, with compressed and uncompressed layers, duplicate layers represented as symlinks, and tags from both the manifest and the legacy repositories file
+func TestDockerArchiveSource(t *testing.T) {
+	
+	// Create an uncompressed layer and a gzip-compressed layer
+	uncompressed := createCompressionTestArchive(t)
+	otherArchive, err := testutil.CreateArchive([]testutil.ArchiveEntry{{Type: tar.TypeReg, Name: "other", Contents: "other"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := compressWithCodec(t, compression.CODEC_GZIP, otherArchive.Bytes())
+	
+	// Generates an image configuration with the specified diff_ids
+	createConfig := func(diffIDs ...digest.Digest) string {
+		data, err := json.Marshal(map[string]interface{}{
+			"architecture": "arm64",
+			"variant": "v8",
+			"os": "linux",
+			"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	
+	// Create a tarball with two images, the second of which reuses the uncompressed layer via a symlink, as `docker save` does for duplicate layers
+	manifest, err := json.Marshal([]map[string]interface{}{
+		{"Config": "first.json", "RepoTags": []string{"example:one"}, "Layers": []string{"l1/layer.tar", "l2/layer.tar"}},
+		{"Config": "./second.json", "RepoTags": nil, "Layers": []string{"l3/layer.tar"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repositories, err := json.Marshal(map[string]map[string]string{
+		"example": {"one": "l2"},
+		"legacy": {"latest": "l3", "stale": "missing"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "docker.tar")
+	writeTestArchive(t, filename, compression.CODEC_NONE, []testutil.ArchiveEntry{
+		{Type: tar.TypeReg, Name: "manifest.json", Contents: string(manifest)},
+		{Type: tar.TypeReg, Name: "repositories", Contents: string(repositories)},
+		{Type: tar.TypeReg, Name: "first.json", Contents: createConfig(digest.FromBytes(uncompressed), digest.FromBytes(otherArchive.Bytes()))},
+		{Type: tar.TypeReg, Name: "second.json", Contents: createConfig(digest.FromBytes(uncompressed))},
+		{Type: tar.TypeReg, Name: "l1/layer.tar", Contents: string(uncompressed)},
+		{Type: tar.TypeReg, Name: "l2/layer.tar", Contents: string(compressed)},
+		{Type: tar.TypeSymlink, Name: "l3/layer.tar", Linkname: "../l1/layer.tar"},
+	})
+	
+	source, err := image.OpenDockerArchive(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	if _, err := fs.Stat(source, oci.ImageLayoutFile); err != nil {
+		t.Errorf("expected the layout marker file to be generated: %v", err)
+	}
+	
+	// Verify that each tag maps to the expected image, and that tags are not duplicated
+	index := &oci.Index{}
+	data, err := fs.ReadFile(source, "index.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		t.Fatal(err)
+	}
+	tags := []string{}
+	manifests := map[string]oci.Descriptor{}
+	for _, descriptor := range index.Manifests {
+		tag := descriptor.Annotations[oci.AnnotationRefName]
+		tags = append(tags, tag)
+		manifests[tag] = descriptor
+		if descriptor.Platform == nil || descriptor.Platform.Architecture != "arm64" || descriptor.Platform.Variant != "v8" {
+			t.Errorf("expected %s to have the platform from its image configuration, got %+v", tag, descriptor.Platform)
+		}
+	}
+	if expected := []string{"example:one", "legacy:latest"}; !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("expected tags %v, got %v", expected, tags)
+	}
+	
+	// Verify the media types and digests of the layers, and that each layer blob can be read and matches its digest
+	expected := map[string][]oci.Descriptor{
+		"example:one": {
+			{MediaType: oci.MediaTypeImageLayer, Digest: digest.FromBytes(uncompressed), Size: int64(len(uncompressed))},
+			{MediaType: oci.MediaTypeImageLayerGzip, Digest: digest.FromBytes(compressed), Size: int64(len(compressed))},
+		},
+		"legacy:latest": {
+			{MediaType: oci.MediaTypeImageLayer, Digest: digest.FromBytes(uncompressed), Size: int64(len(uncompressed))},
+		},
+	}
+	for tag, layers := range expected {
+		manifest := &oci.Manifest{}
+		data, err := fs.ReadFile(source, path.Join("blobs", manifests[tag].Digest.Algorithm().String(), manifests[tag].Digest.Encoded()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, manifest); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(manifest.Layers, layers) {
+			t.Errorf("expected %s to have layers %+v, got %+v", tag, layers, manifest.Layers)
+		}
+		for _, layer := range manifest.Layers {
+			blob, err := fs.ReadFile(source, path.Join("blobs", layer.Digest.Algorithm().String(), layer.Digest.Encoded()))
+			if err != nil {
+				t.Errorf("failed to read layer %s of %s: %v", layer.Digest, tag, err)
+			} else if digest.FromBytes(blob) != layer.Digest {
+				t.Errorf("expected layer %s of %s to match its digest, got %s", layer.Digest, tag, digest.FromBytes(blob))
+			}
+		}
+	}
+	
+	// Verify that images whose configuration does not match their layers are rejected
+	mismatched := filepath.Join(t.TempDir(), "mismatched.tar")
+	writeTestArchive(t, mismatched, compression.CODEC_NONE, []testutil.ArchiveEntry{
+		{Type: tar.TypeReg, Name: "manifest.json", Contents: `[{"Config": "config.json", "Layers": ["l1/layer.tar"]}]`},
+		{Type: tar.TypeReg, Name: "config.json", Contents: createConfig()},
+		{Type: tar.TypeReg, Name: "l1/layer.tar", Contents: string(uncompressed)},
+	})
+	if source, err := image.OpenDockerArchive(mismatched); err == nil {
+		source.Close()
+		t.Error("expected an image whose configuration does not match its layers to be rejected")
+	}
+}
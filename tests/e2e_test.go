@@ -10,7 +10,6 @@ import (
 	"github.com/macoscontainers/experiments/internal/image"
 	"github.com/macoscontainers/experiments/internal/layer"
 	"github.com/macoscontainers/experiments/tests/testutil"
-	oci "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // Removes a file if it exists
@@ -40,35 +39,35 @@ func TestUnpack(t *testing.T) {
 	
 	// Create an ImageUnpacker for the sample image
 	layersDir := filepath.Join(sample.RootDir, "layers")
-	unpacker, err := image.UnpackerForImage(sample.RootDir, layersDir)
+	unpacker, err := image.UnpackerForArchive(sample.ArchivePath, layersDir)
 	if err != nil {
 		t.Error(err)
 		return
 	}
+	defer unpacker.Close()
 	
 	// Attempt to unpack the image
-	manifest, err := unpacker.Unpack(nil)
+	unpacked, err := unpacker.Unpack(nil)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 	
 	// See if we can round-trip the filesystem layer diffs
-	var previousLayer oci.Descriptor
-	for index, layerDetails := range manifest.Layers {
+	for index, layerDetails := range unpacked.Layers {
 		
 		// Skip round-tripping for the base layer
 		if index == 0 {
-			previousLayer = layerDetails
 			continue
 		}
 		
 		// Resolve the path to the merged directories for the previous and current filesystem layer
-		previousMerged := filepath.Join(layersDir, previousLayer.Digest.Hex(), "merged")
-		currentMerged := filepath.Join(layersDir, layerDetails.Digest.Hex(), "merged")
+		previousLayer := unpacked.Layers[index - 1]
+		previousMerged := previousLayer.MergedDir
+		currentMerged := layerDetails.MergedDir
 		
 		// Create a directory to hold the round-tripped diff
-		diffDir := filepath.Join(layersDir, layerDetails.Digest.Hex(), "diff_generated")
+		diffDir := filepath.Join(layerDetails.Dir, "diff_generated")
 		if err := os.MkdirAll(diffDir, os.ModePerm); err != nil {
 			t.Error(err)
 			return
@@ -82,21 +81,18 @@ func TestUnpack(t *testing.T) {
 		}
 		
 		// Generate the layer's diff by comparing it to the merged contents of the previous layer
-		log.Println("Diffing", layerDetails.Digest.Hex(), "against base layer", previousLayer.Digest.Hex(), "...")
+		log.Println("Diffing", layerDetails.ChainID.Encoded(), "against base layer", previousLayer.ChainID.Encoded(), "...")
 		errorChannel := diff.DiffRecursive("", nil, false)
 		if err := <-errorChannel; err != nil {
 			t.Error(err)
 			return
 		}
-		
-		// Keep track of the previous layer for each loop iteration
-		previousLayer = layerDetails
 	}
 	
 	/*
 	// Resolve the paths to the final merged output for the unpacked image and our ground truth filesystem data
 	groundTruth := filepath.Join(sample.RootDir, "ground-truth")
-	finalLayer := filepath.Join(sample.LayersDir, manifest.Layers[len(manifest.Layers) - 1].Digest.Hex(), "merged")
+	finalLayer := unpacked.Layers[len(unpacked.Layers) - 1].MergedDir
 	
 	// Remove file entries that are modified when running an image and therefore should be excluded from our comparison
 	excluded := []string{"/.dockerenv", "/dev/console", "/etc/hostname", "/etc/hosts", "/etc/resolv.conf"}
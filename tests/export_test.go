@@ -0,0 +1,117 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/tests/testutil"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Tests that an exported `oci-archive` tarball unpacks to the same contents as the OCI image layout it was exported from
+func TestExportArchiveRoundTrip(t *testing.T) {
+	for _, mediaType := range []string{oci.MediaTypeImageLayer, oci.MediaTypeImageLayerGzip} {
+		t.Run(mediaType, func(t *testing.T) {
+			root := t.TempDir()
+			imageDir := filepath.Join(root, "image")
+			archive := filepath.Join(root, "image.tar")
+			
+			// Create and unpack the source image
+			descriptor, err := testutil.CreateLayout(imageDir, mediaType, createCacheTestArchives(t, "first", "second", "third")...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			unpacker, err := image.UnpackerForImage(imageDir, filepath.Join(root, "source"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			source, err := unpacker.Unpack(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			
+			// Export the image to an archive
+			output, err := os.Create(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := unpacker.ExportArchive(context.Background(), "", output); err != nil {
+				output.Close()
+				t.Fatal(err)
+			}
+			if err := output.Close(); err != nil {
+				t.Fatal(err)
+			}
+			
+			// Unpack the image from the archive
+			exported, err := image.UnpackerForArchive(archive, filepath.Join(root, "exported"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer exported.Close()
+			unpacked, err := exported.Unpack(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			
+			// Verify that the exported image is the source image and that each of its layers has the same contents
+			if unpacked.Descriptor.Digest != descriptor.Digest {
+				t.Errorf("expected the exported image to have digest %s, got %s", descriptor.Digest, unpacked.Descriptor.Digest)
+			}
+			if len(unpacked.Layers) != len(source.Layers) {
+				t.Fatalf("expected %d layers, got %d", len(source.Layers), len(unpacked.Layers))
+			}
+			for index := range source.Layers {
+				expected := readTree(t, source.Layers[index].MergedDir)
+				if actual := readTree(t, unpacked.Layers[index].MergedDir); !reflect.DeepEqual(actual, expected) {
+					t.Errorf("unexpected contents for layer %d:\nexpected: %v\nactual:   %v", index, expected, actual)
+				}
+			}
+		})
+	}
+}
+
+// Tests that exporting an image with a corrupted blob fails without writing the corrupted contents to the archive
+func TestExportArchiveRejectsCorruptedBlob(t *testing.T) {
+	imageDir := filepath.Join(t.TempDir(), "image")
+	
+	// Create an image and corrupt one of its layer blobs without changing its size
+	descriptor, err := testutil.CreateLayout(imageDir, oci.MediaTypeImageLayer, createCacheTestArchives(t, "first", "second")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := testutil.ReadManifest(imageDir, descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := bytes.Repeat([]byte("corrupted!"), int(manifest.Layers[1].Size) / 10 + 1)[:manifest.Layers[1].Size]
+	if err := os.WriteFile(testutil.BlobPath(imageDir, manifest.Layers[1].Digest), corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verify that the export reports the mismatch
+	unpacker, err := image.UnpackerForImage(imageDir, filepath.Join(t.TempDir(), "unpacked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &bytes.Buffer{}
+	err = unpacker.ExportArchive(context.Background(), "", output)
+	var mismatch *image.BlobMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected a BlobMismatchError, got %v", err)
+	}
+	if mismatch.Digest != manifest.Layers[1].Digest {
+		t.Errorf("expected the mismatch to be reported for %s, got %s", manifest.Layers[1].Digest, mismatch.Digest)
+	}
+	
+	// Verify that none of the corrupted contents were written to the output
+	if bytes.Contains(output.Bytes(), []byte("corrupted!")) {
+		t.Error("expected the corrupted blob contents not to be written to the archive")
+	}
+}
@@ -0,0 +1,126 @@
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/macoscontainers/experiments/internal/layer"
+	"golang.org/x/sys/unix"
+)
+
+// Generates an uncompressed PAX tar archive from the specified headers, writing the contents of any regular files
+func createExtractTestArchive(t *testing.T, headers []*tar.Header, contents map[string]string) *bytes.Buffer {
+	buffer := &bytes.Buffer{}
+	archive := tar.NewWriter(buffer)
+	for _, header := range headers {
+		header.Format = tar.FormatPAX
+		header.Size = int64(len(contents[header.Name]))
+		if err := archive.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write([]byte(contents[header.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	
+	return buffer
+}
+
+// Tests that the extractor reproduces the files, attributes, links, whiteouts and device nodes recorded in a layer archive
+func TestExtractPreservesEntries(t *testing.T) {
+	diffDir := filepath.Join(t.TempDir(), "diff")
+	modified := time.Unix(1600000000, 123456789)
+	uid, gid := os.Getuid(), os.Getgid()
+	
+	// Create an archive containing each type of entry, including whiteouts and an entry with extended attributes recorded in PAX records
+	headers := []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0750, Uid: uid, Gid: gid, ModTime: modified},
+		{Typeflag: tar.TypeReg, Name: "etc/file", Mode: 0640, Uid: uid, Gid: gid, ModTime: modified},
+		{Typeflag: tar.TypeLink, Name: "etc/hardlink", Linkname: "etc/file", Uid: uid, Gid: gid, ModTime: modified},
+		{Typeflag: tar.TypeSymlink, Name: "etc/symlink", Linkname: "file", Mode: 0777, Uid: uid, Gid: gid, ModTime: modified},
+		{Typeflag: tar.TypeReg, Name: "etc/.wh.removed", Mode: 0644, Uid: uid, Gid: gid, ModTime: modified},
+		{Typeflag: tar.TypeReg, Name: "etc/.wh..wh..opq", Mode: 0644, Uid: uid, Gid: gid, ModTime: modified},
+		{Typeflag: tar.TypeReg, Name: "etc/xattr", Mode: 0600, Uid: uid, Gid: gid, ModTime: modified, PAXRecords: map[string]string{"SCHILY.xattr.user.test": "value"}},
+		{Typeflag: tar.TypeFifo, Name: "etc/fifo", Mode: 0644, Uid: uid, Gid: gid, ModTime: modified},
+	}
+	
+	// Device nodes can only be created by root
+	if os.Geteuid() == 0 {
+		headers = append(headers, &tar.Header{Typeflag: tar.TypeChar, Name: "etc/null", Mode: 0666, Devmajor: 1, Devminor: 3, ModTime: modified})
+	}
+	contents := map[string]string{"etc/file": "contents", "etc/xattr": "attributes"}
+	
+	// Extract the archive
+	extractor := &layer.LayerExtractor{DiffDir: diffDir}
+	if err := extractor.Extract(createExtractTestArchive(t, headers, contents)); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verify the type, permissions, modification time and contents of each entry
+	for _, header := range headers {
+		path := filepath.Join(diffDir, header.Name)
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Errorf("expected %s to be extracted: %v", header.Name, err)
+			continue
+		}
+		
+		expected := header.FileInfo().Mode()
+		if header.Typeflag == tar.TypeLink {
+			expected = 0640
+		}
+		if info.Mode() != expected && header.Typeflag != tar.TypeSymlink {
+			t.Errorf("expected %s to have mode %v, got %v", header.Name, expected, info.Mode())
+		} else if header.Typeflag == tar.TypeSymlink && info.Mode().Type() != os.ModeSymlink {
+			t.Errorf("expected %s to be a symlink, got mode %v", header.Name, info.Mode())
+		}
+		if !info.ModTime().Equal(modified) {
+			t.Errorf("expected %s to have modification time %v, got %v", header.Name, modified, info.ModTime())
+		}
+		if info.Mode().IsRegular() {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := header.Name
+			if header.Typeflag == tar.TypeLink {
+				name = header.Linkname
+			}
+			if string(data) != contents[name] {
+				t.Errorf("expected %s to contain %q, got %q", header.Name, contents[name], data)
+			}
+		}
+	}
+	
+	// Verify that the hardlink refers to the same file, and that the symlink has the correct target
+	original, err := os.Stat(filepath.Join(diffDir, "etc", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked, err := os.Stat(filepath.Join(diffDir, "etc", "hardlink")); err != nil || !os.SameFile(original, linked) {
+		t.Errorf("expected etc/hardlink to be a hardlink to etc/file (%v)", err)
+	}
+	if target, err := os.Readlink(filepath.Join(diffDir, "etc", "symlink")); err != nil || target != "file" {
+		t.Errorf("expected etc/symlink to point to file, got %q (%v)", target, err)
+	}
+	
+	// Verify that the device node has the correct device numbers
+	if os.Geteuid() == 0 {
+		info, err := os.Lstat(filepath.Join(diffDir, "etc", "null"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rdev := uint64(info.Sys().(*syscall.Stat_t).Rdev)
+		if unix.Major(rdev) != 1 || unix.Minor(rdev) != 3 {
+			t.Errorf("expected etc/null to have device numbers 1:3, got %d:%d", unix.Major(rdev), unix.Minor(rdev))
+		}
+	}
+}
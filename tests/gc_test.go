@@ -0,0 +1,218 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/macoscontainers/experiments/internal/filesystem"
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/tests/testutil"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Creates an image in an OCI image layout with a layer for each of the specified file names, returning the descriptor for its image manifest and the ChainIDs of its layers
+func createGarbageTestImage(t *testing.T, imageDir string, names ...string) (oci.Descriptor, []digest.Digest) {
+	archives := createCacheTestArchives(t, names...)
+	descriptor, err := testutil.CreateImage(imageDir, oci.MediaTypeImageLayerGzip, archives)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	diffIDs := []digest.Digest{}
+	for _, archive := range archives {
+		diffIDs = append(diffIDs, digest.FromBytes(archive))
+	}
+	return descriptor, image.ChainIDs(diffIDs)
+}
+
+// Unpacks each of the images in an OCI image layout to the specified unpack directory
+func unpackAllImages(t *testing.T, imageDir string, unpackDir string, references ...string) {
+	unpacker, err := image.UnpackerForImage(imageDir, unpackDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unpacker.Close()
+	
+	for _, reference := range references {
+		if _, err := unpacker.UnpackReference(reference, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Tests that garbage collection removes only the blobs and unpacked layers that are unreachable from every specified image layout and the retained layers
+func TestCollectGarbage(t *testing.T) {
+	root := t.TempDir()
+	unpackDir := filepath.Join(root, "unpacked")
+	
+	// Create an image layout with two images, and a second layout with an image that shares the unpack directory
+	firstDir := filepath.Join(root, "first")
+	kept, keptLayers := createGarbageTestImage(t, firstDir, "base", "kept")
+	removed, removedLayers := createGarbageTestImage(t, firstDir, "base", "removed")
+	if err := testutil.WriteIndex(firstDir, []oci.Descriptor{withRefName(kept, "kept"), withRefName(removed, "removed")}); err != nil {
+		t.Fatal(err)
+	}
+	secondDir := filepath.Join(root, "second")
+	shared, sharedLayers := createGarbageTestImage(t, secondDir, "base", "shared")
+	if err := testutil.WriteIndex(secondDir, []oci.Descriptor{withRefName(shared, "shared")}); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Unpack all of the images, then remove the second image from the first layout's index
+	unpackAllImages(t, firstDir, unpackDir, "kept", "removed")
+	unpackAllImages(t, secondDir, unpackDir, "shared")
+	if err := testutil.WriteIndex(firstDir, []oci.Descriptor{withRefName(kept, "kept")}); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Create a stale staging directory and a directory that was not created by the unpacker
+	staging := filepath.Join(unpackDir, digest.FromString("staging").Encoded() + image.STAGING_SUFFIX)
+	foreign := filepath.Join(unpackDir, "foreign")
+	for _, dir := range []string{staging, foreign} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	// Returns the sorted base names of a list of paths
+	baseNames := func(paths []string) []string {
+		names := []string{}
+		for _, path := range paths {
+			names = append(names, filepath.Base(path))
+		}
+		sort.Strings(names)
+		return names
+	}
+	
+	// Verify that a dry run that only considers the first layout would remove the layer from the second layout, but does not remove anything
+	report, err := image.CollectGarbage([]string{firstDir}, unpackDir, image.GarbageCollectionOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(report.RemovedLayers, " "), sharedLayers[1].Encoded()) {
+		t.Errorf("expected a collection that ignores the second layout to remove its layer, got %v", report.RemovedLayers)
+	}
+	if !report.DryRun || report.BytesFreed == 0 {
+		t.Errorf("expected a dry run report that frees storage, got %+v", report)
+	}
+	if !filesystem.Exists(testutil.BlobPath(firstDir, removed.Digest)) || !filesystem.Exists(staging) {
+		t.Error("expected a dry run not to remove anything")
+	}
+	
+	// Collect garbage for both layouts, retaining the unreachable layer explicitly
+	report, err = image.CollectGarbage([]string{firstDir, secondDir}, unpackDir, image.GarbageCollectionOptions{RetainLayers: []digest.Digest{removedLayers[1]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verify that only the unreachable manifest, configuration and layer blobs were removed from the first layout
+	manifest, err := testutil.ReadManifest(firstDir, removed)
+	if err == nil || !os.IsNotExist(err) {
+		t.Errorf("expected the manifest for the removed image to be collected, got %+v (%v)", manifest, err)
+	}
+	if report.ReachableBlobs != 8 || len(report.RemovedBlobs) != 3 {
+		t.Errorf("expected 8 blobs to be retained and 3 removed, got %d and %v", report.ReachableBlobs, report.RemovedBlobs)
+	}
+	keptManifest, err := testutil.ReadManifest(firstDir, kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, descriptor := range append([]oci.Descriptor{keptManifest.Config}, keptManifest.Layers...) {
+		if !filesystem.Exists(testutil.BlobPath(firstDir, descriptor.Digest)) {
+			t.Errorf("expected reachable blob %s to be retained", descriptor.Digest)
+		}
+	}
+	
+	// Verify that the layers reachable from either layout and the retained layer were kept, and that only the stale staging directory was removed
+	for _, chainID := range append(append(append([]digest.Digest{}, keptLayers...), sharedLayers...), removedLayers[1]) {
+		if !filesystem.Exists(filepath.Join(unpackDir, chainID.Encoded(), image.LAYER_RECORD_FILENAME)) {
+			t.Errorf("expected layer %s to be retained", chainID)
+		}
+	}
+	if removedNames := baseNames(report.RemovedLayers); len(removedNames) != 1 || removedNames[0] != filepath.Base(staging) {
+		t.Errorf("expected only the staging directory to be removed, got %v", report.RemovedLayers)
+	}
+	if filesystem.Exists(staging) || !filesystem.Exists(foreign) {
+		t.Error("expected the staging directory to be removed and the foreign directory to be left alone")
+	}
+	
+	// Verify that the layer is removed once it is no longer retained
+	report, err = image.CollectGarbage([]string{firstDir, secondDir}, unpackDir, image.GarbageCollectionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removedNames := baseNames(report.RemovedLayers); len(removedNames) != 1 || removedNames[0] != removedLayers[1].Encoded() {
+		t.Errorf("expected only the unretained layer to be removed, got %v", report.RemovedLayers)
+	}
+}
+
+// Tests that garbage collection retains the blobs referenced by manifests whose media types are missing or unrecognised, and refuses to collect blobs whose references cannot be determined
+func TestCollectGarbageUnrecognisedMediaTypes(t *testing.T) {
+	root := t.TempDir()
+	imageDir := filepath.Join(root, "image")
+	
+	// Create an image whose manifest descriptor has no media type, and an index with an unrecognised media type that references it
+	descriptor, _ := createGarbageTestImage(t, imageDir, "file")
+	descriptor.MediaType = ""
+	nested, err := testutil.WriteJsonBlob(imageDir, "application/vnd.example.index+json", &oci.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []oci.Descriptor{descriptor},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Create an artifact manifest whose configuration is not an image configuration
+	config, err := testutil.WriteBlob(imageDir, "application/vnd.example.config", []byte("not json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifactBlob, err := testutil.WriteBlob(imageDir, "application/vnd.example.data", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifact, err := testutil.WriteJsonBlob(imageDir, oci.MediaTypeImageManifest, &oci.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config: config,
+		Layers: []oci.Descriptor{artifactBlob},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.WriteIndex(imageDir, []oci.Descriptor{nested, artifact}); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verify that every blob is reachable
+	report, err := image.CollectGarbage([]string{imageDir}, filepath.Join(root, "unpacked"), image.GarbageCollectionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.RemovedBlobs) != 0 || report.ReachableBlobs != 7 {
+		t.Errorf("expected all 7 blobs to be retained, got %d retained and %v removed", report.ReachableBlobs, report.RemovedBlobs)
+	}
+	
+	// Verify that a root whose blob cannot be identified causes garbage collection to fail without removing anything
+	unknown, err := testutil.WriteBlob(imageDir, "application/vnd.example.unknown", []byte("opaque"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan, err := testutil.WriteBlob(imageDir, "application/octet-stream", []byte("orphan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.WriteIndex(imageDir, []oci.Descriptor{nested, artifact, unknown}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := image.CollectGarbage([]string{imageDir}, filepath.Join(root, "unpacked"), image.GarbageCollectionOptions{}); err == nil || !strings.Contains(err.Error(), unknown.Digest.String()) {
+		t.Errorf("expected garbage collection to fail for blob %s with an unrecognised media type, got: %v", unknown.Digest, err)
+	}
+	if !filesystem.Exists(testutil.BlobPath(imageDir, orphan.Digest)) {
+		t.Error("expected a failed garbage collection not to remove anything")
+	}
+}
@@ -0,0 +1,226 @@
+package tests
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/macoscontainers/experiments/internal/filesystem"
+	"github.com/macoscontainers/experiments/internal/layer"
+	"github.com/macoscontainers/experiments/tests/testutil"
+)
+
+// Creates a diff directory to extract into, alongside an "outside" directory that hostile archives will attempt to write to
+func createHostileTestDirs(t *testing.T) (string, string) {
+	root := t.TempDir()
+	diffDir := filepath.Join(root, "layer", "diff")
+	outsideDir := filepath.Join(root, "outside")
+	for _, dir := range []string{diffDir, outsideDir} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	return diffDir, outsideDir
+}
+
+// Verifies that nothing has been written to the "outside" directory
+func assertOutsideUntouched(t *testing.T, outsideDir string) {
+	entries, err := os.ReadDir(outsideDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("hostile archive wrote %s outside of the diff directory", entry.Name())
+	}
+}
+
+// Tests that archive entries which resolve outside of the diff directory are rejected
+func TestExtractRejectsHostileArchives(t *testing.T) {
+	cases := []struct {
+		
+		// The name of the test case
+		name string
+		
+		// The entries of the hostile archive (the placeholder "OUTSIDE" in names and link targets is replaced with the absolute path to the outside directory)
+		entries []testutil.ArchiveEntry
+	}{
+		{
+			name: "parent traversal",
+			entries: []testutil.ArchiveEntry{
+				{Type: tar.TypeReg, Name: "../../outside/passwd", Contents: "pwned"},
+			},
+		},
+		{
+			name: "parent traversal after subdirectory",
+			entries: []testutil.ArchiveEntry{
+				{Type: tar.TypeReg, Name: "etc/../../../outside/passwd", Contents: "pwned"},
+			},
+		},
+		{
+			name: "absolute path",
+			entries: []testutil.ArchiveEntry{
+				{Type: tar.TypeReg, Name: "OUTSIDE/passwd", Contents: "pwned"},
+			},
+		},
+		{
+			name: "write through relative symlink",
+			entries: []testutil.ArchiveEntry{
+				{Type: tar.TypeSymlink, Name: "etc", Linkname: "../../outside"},
+				{Type: tar.TypeReg, Name: "etc/passwd", Contents: "pwned"},
+			},
+		},
+		{
+			name: "write through absolute symlink",
+			entries: []testutil.ArchiveEntry{
+				{Type: tar.TypeSymlink, Name: "etc", Linkname: "OUTSIDE"},
+				{Type: tar.TypeReg, Name: "etc/passwd", Contents: "pwned"},
+			},
+		},
+		{
+			name: "directory through symlink",
+			entries: []testutil.ArchiveEntry{
+				{Type: tar.TypeSymlink, Name: "etc", Linkname: "OUTSIDE"},
+				{Type: tar.TypeDir, Name: "etc/subdir/"},
+			},
+		},
+		{
+			name: "nested write through symlink",
+			entries: []testutil.ArchiveEntry{
+				{Type: tar.TypeDir, Name: "usr/"},
+				{Type: tar.TypeSymlink, Name: "usr/lib", Linkname: "../../../outside"},
+				{Type: tar.TypeReg, Name: "usr/lib/nested/libc.so", Contents: "pwned"},
+			},
+		},
+		{
+			name: "hardlink traversal",
+			entries: []testutil.ArchiveEntry{
+				{Type: tar.TypeLink, Name: "secret", Linkname: "../../outside/secret"},
+			},
+		},
+		{
+			name: "hardlink through symlink",
+			entries: []testutil.ArchiveEntry{
+				{Type: tar.TypeSymlink, Name: "etc", Linkname: "OUTSIDE"},
+				{Type: tar.TypeLink, Name: "secret", Linkname: "etc/secret"},
+			},
+		},
+	}
+	
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			diffDir, outsideDir := createHostileTestDirs(t)
+			
+			// Place a file in the outside directory that hardlinks will attempt to reference
+			secret := filepath.Join(outsideDir, "secret")
+			if err := os.WriteFile(secret, []byte("secret"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			
+			// Generate the hostile archive
+			entries := []testutil.ArchiveEntry{}
+			for _, entry := range testCase.entries {
+				entry.Name = strings.Replace(entry.Name, "OUTSIDE", outsideDir, 1)
+				entry.Linkname = strings.Replace(entry.Linkname, "OUTSIDE", outsideDir, 1)
+				entries = append(entries, entry)
+			}
+			archive, err := testutil.CreateArchive(entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			
+			// Verify that extraction fails with an error that identifies the escape
+			extractor := &layer.LayerExtractor{DiffDir: diffDir}
+			err = extractor.Extract(archive)
+			escape := &filesystem.PathEscapeError{}
+			if !errors.As(err, &escape) {
+				t.Fatalf("expected a PathEscapeError, got: %v", err)
+			}
+			
+			// Verify that nothing other than the pre-existing secret file exists outside the diff directory
+			if err := os.Remove(secret); err != nil {
+				t.Fatal(err)
+			}
+			assertOutsideUntouched(t, outsideDir)
+		})
+	}
+}
+
+// Tests that symlinks pointing outside of the diff directory are extracted as-is, since they are only dangerous when followed
+func TestExtractPreservesEscapingSymlinks(t *testing.T) {
+	diffDir, outsideDir := createHostileTestDirs(t)
+	
+	// Generate an archive containing symlinks that point outside of the diff directory, followed by entries that replace them
+	archive, err := testutil.CreateArchive([]testutil.ArchiveEntry{
+		{Type: tar.TypeSymlink, Name: "relative", Linkname: "../../outside"},
+		{Type: tar.TypeSymlink, Name: "absolute", Linkname: outsideDir},
+		{Type: tar.TypeSymlink, Name: "replaced", Linkname: outsideDir},
+		{Type: tar.TypeReg, Name: "replaced", Contents: "regular file"},
+		{Type: tar.TypeDir, Name: "./"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Extract the archive
+	extractor := &layer.LayerExtractor{DiffDir: diffDir}
+	if err := extractor.Extract(archive); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verify that the symlinks were preserved
+	for name, expected := range map[string]string{"relative": "../../outside", "absolute": outsideDir} {
+		target, err := os.Readlink(filepath.Join(diffDir, name))
+		if err != nil {
+			t.Error(err)
+		} else if target != expected {
+			t.Errorf("expected symlink %s to point to %s, got %s", name, expected, target)
+		}
+	}
+	
+	// Verify that the replaced symlink was removed rather than written through
+	contents, err := os.ReadFile(filepath.Join(diffDir, "replaced"))
+	if err != nil {
+		t.Fatal(err)
+	} else if string(contents) != "regular file" {
+		t.Errorf("unexpected contents for replaced symlink: %q", string(contents))
+	}
+	assertOutsideUntouched(t, outsideDir)
+}
+
+// Tests that applying a diff does not follow symlinks that are already present in the merged output directory
+func TestApplyDoesNotFollowSymlinks(t *testing.T) {
+	root := t.TempDir()
+	baseDir := filepath.Join(root, "base")
+	diffDir := filepath.Join(root, "diff")
+	mergedDir := filepath.Join(root, "merged")
+	outsideDir := filepath.Join(root, "outside")
+	for _, dir := range []string{baseDir, filepath.Join(diffDir, "etc"), mergedDir, outsideDir} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	// Add a file to the diff that will be applied inside a directory
+	if err := os.WriteFile(filepath.Join(diffDir, "etc", "passwd"), []byte("pwned"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Place a symlink in the merged output directory where the diff's directory will be created
+	// (This is the situation that arises when a symlink and a directory whose names differ only by case are merged on a case-insensitive filesystem)
+	if err := os.Symlink(outsideDir, filepath.Join(mergedDir, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verify that applying the diff fails
+	applier := &layer.DiffApplier{BaseDir: baseDir, DiffDir: diffDir, MergedDir: mergedDir}
+	err := <-applier.ApplyRecursive("", nil, false)
+	escape := &filesystem.PathEscapeError{}
+	if !errors.As(err, &escape) {
+		t.Fatalf("expected a PathEscapeError, got: %v", err)
+	}
+	assertOutsideUntouched(t, outsideDir)
+}
@@ -0,0 +1,175 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/macoscontainers/experiments/internal/layer"
+)
+
+// Tests that IDs are translated between the container and the host in both directions, and that unmapped IDs are rejected
+func TestIDMappings(t *testing.T) {
+	mappings, err := layer.ParseIDMappings("0:1000:1,1:100000:65536", "0:2000:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verify the translation of mapped IDs from the container to the host and back again
+	cases := [][4]int{
+		{0, 0, 1000, 2000},
+		{1, 0, 100000, 2000},
+		{1000, 0, 100999, 2000},
+		{65536, 0, 165535, 2000},
+	}
+	for _, ids := range cases {
+		uid, gid, err := mappings.ToHost(ids[0], ids[1])
+		if err != nil || uid != ids[2] || gid != ids[3] {
+			t.Errorf("expected container IDs %d:%d to map to host IDs %d:%d, got %d:%d (%v)", ids[0], ids[1], ids[2], ids[3], uid, gid, err)
+		}
+		
+		uid, gid, err = mappings.ToContainer(ids[2], ids[3])
+		if err != nil || uid != ids[0] || gid != ids[1] {
+			t.Errorf("expected host IDs %d:%d to map to container IDs %d:%d, got %d:%d (%v)", ids[2], ids[3], ids[0], ids[1], uid, gid, err)
+		}
+	}
+	
+	// Verify that unmapped IDs are rejected in both directions
+	unmapped := &layer.UnmappedIDError{}
+	if _, _, err := mappings.ToHost(65537, 0); !errors.As(err, &unmapped) || !unmapped.ToHost || unmapped.Kind != "uid" {
+		t.Errorf("expected container uid 65537 to be unmapped, got: %v", err)
+	}
+	if _, _, err := mappings.ToContainer(1000, 0); !errors.As(err, &unmapped) || unmapped.ToHost || unmapped.Kind != "gid" {
+		t.Errorf("expected host gid 0 to be unmapped, got: %v", err)
+	}
+	
+	// Verify that a nil set of mappings preserves IDs verbatim
+	var identity *layer.IDMappings
+	if uid, gid, err := identity.ToHost(33, 44); err != nil || uid != 33 || gid != 44 {
+		t.Errorf("expected nil mappings to preserve IDs, got %d:%d (%v)", uid, gid, err)
+	}
+	
+	// Verify that malformed mappings are rejected
+	for _, spec := range []string{"0:1000", "0:1000:0", "a:b:c", "0:-1:1"} {
+		if _, err := layer.ParseIDMap(spec); err == nil {
+			t.Errorf("expected ID mapping %q to be rejected", spec)
+		}
+	}
+	
+	// Verify that mappings are compared by their contents, with empty and missing lists treated as equal but nil mappings only equal to one another
+	var decoded layer.IDMappings
+	if err := json.Unmarshal([]byte(`{"uids": [{"containerID": 0, "hostID": 1000, "size": 1}], "gids": null}`), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	comparisons := []struct {
+		
+		// The mappings to compare
+		a, b *layer.IDMappings
+		
+		// Whether the mappings are expected to be equal
+		equal bool
+	}{
+		{a: &decoded, b: &layer.IDMappings{UIDs: []layer.IDMap{{ContainerID: 0, HostID: 1000, Size: 1}}, GIDs: []layer.IDMap{}}, equal: true},
+		{a: &layer.IDMappings{}, b: &layer.IDMappings{UIDs: []layer.IDMap{}, GIDs: []layer.IDMap{}}, equal: true},
+		{a: mappings, b: mappings, equal: true},
+		{a: nil, b: nil, equal: true},
+		{a: &decoded, b: mappings, equal: false},
+		{a: nil, b: &layer.IDMappings{}, equal: false},
+		{a: &layer.IDMappings{}, b: nil, equal: false},
+	}
+	for _, comparison := range comparisons {
+		if actual := comparison.a.Equal(comparison.b); actual != comparison.equal {
+			t.Errorf("expected %+v and %+v to be equal: %v, got %v", comparison.a, comparison.b, comparison.equal, actual)
+		}
+	}
+}
+
+// Tests that subordinate ID ranges are read for a user by either username or user ID, skipping comments and the ranges of other users
+func TestReadSubordinateIDs(t *testing.T) {
+	root := t.TempDir()
+	
+	// Writes the specified lines to a file in the format of /etc/subuid
+	writeSubordinateIDs := func(name string, lines ...string) string {
+		filename := filepath.Join(root, name)
+		if err := os.WriteFile(filename, []byte(strings.Join(lines, "\n") + "\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	
+	// Create a file listing ranges for several users, with comments, blank lines and malformed lines that belong to no user
+	subuid := writeSubordinateIDs("subuid",
+		"# Subordinate user IDs",
+		"",
+		"alice:100000:65536",
+		"bob:165536:65536",
+		"  1000:300000:1000  ",
+		"malformed line",
+		"alice:400000:10",
+	)
+	
+	cases := []struct {
+		
+		// The username to look up
+		username string
+		
+		// The user ID to look up
+		uid int
+		
+		// The expected ranges
+		expected []layer.IDMap
+	}{
+		{username: "alice", uid: 1000, expected: []layer.IDMap{{HostID: 100000, Size: 65536}, {HostID: 300000, Size: 1000}, {HostID: 400000, Size: 10}}},
+		{username: "bob", uid: 1001, expected: []layer.IDMap{{HostID: 165536, Size: 65536}}},
+		{username: "carol", uid: 1000, expected: []layer.IDMap{{HostID: 300000, Size: 1000}}},
+		{username: "dave", uid: 1002, expected: []layer.IDMap{}},
+	}
+	for _, testCase := range cases {
+		ranges, err := layer.ReadSubordinateIDs(subuid, testCase.username, testCase.uid)
+		if err != nil {
+			t.Errorf("failed to read subordinate IDs for %s: %v", testCase.username, err)
+		} else if !reflect.DeepEqual(ranges, testCase.expected) {
+			t.Errorf("expected subordinate IDs %+v for %s (%d), got %+v", testCase.expected, testCase.username, testCase.uid, ranges)
+		}
+	}
+	
+	// Verify that malformed ranges for the requested user are rejected, while malformed ranges for other users are ignored
+	for _, line := range []string{"alice:start:65536", "alice:-1:65536", "alice:100000:0", "alice:100000:count"} {
+		filename := writeSubordinateIDs("invalid", "bob:x:y", line)
+		if _, err := layer.ReadSubordinateIDs(filename, "alice", 1000); err == nil {
+			t.Errorf("expected the range %q to be rejected", line)
+		}
+		if _, err := layer.ReadSubordinateIDs(filename, "bob", 1001); err == nil {
+			t.Error("expected the malformed range for bob to be rejected")
+		}
+		if ranges, err := layer.ReadSubordinateIDs(filename, "carol", 1002); err != nil || len(ranges) != 0 {
+			t.Errorf("expected the malformed ranges of other users to be ignored, got %+v (%v)", ranges, err)
+		}
+	}
+	if _, err := layer.ReadSubordinateIDs(filepath.Join(root, "missing"), "alice", 1000); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a missing file to be reported, got: %v", err)
+	}
+	
+	// Verify that the rootless mappings map root to the user and assign the subordinate ranges consecutive container IDs
+	subgid := writeSubordinateIDs("subgid", "alice:200000:65536")
+	mappings, err := layer.SubordinateIDMappings(subuid, subgid, "alice", 1000, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &layer.IDMappings{
+		UIDs: []layer.IDMap{{ContainerID: 0, HostID: 1000, Size: 1}, {ContainerID: 1, HostID: 100000, Size: 65536}, {ContainerID: 65537, HostID: 300000, Size: 1000}, {ContainerID: 66537, HostID: 400000, Size: 10}},
+		GIDs: []layer.IDMap{{ContainerID: 0, HostID: 2000, Size: 1}, {ContainerID: 1, HostID: 200000, Size: 65536}},
+	}
+	if !reflect.DeepEqual(mappings, expected) {
+		t.Errorf("expected rootless mappings %+v, got %+v", expected, mappings)
+	}
+	
+	// Verify that users without any subordinate ranges are rejected
+	if _, err := layer.SubordinateIDMappings(subuid, subgid, "bob", 1001, 1001); err == nil {
+		t.Error("expected a user without subordinate group IDs to be rejected")
+	}
+}
@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/internal/layer"
+	"github.com/macoscontainers/experiments/tests/testutil"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Tests that extraction aborts with an error naming the limit when an archive exceeds one of its extraction limits
+func TestExtractEnforcesLimits(t *testing.T) {
+	
+	// Generate an archive that is well within the limits of all but one test case
+	entries := []testutil.ArchiveEntry{
+		{Type: tar.TypeDir, Name: "a/"},
+		{Type: tar.TypeDir, Name: "a/b/"},
+		{Type: tar.TypeReg, Name: "a/b/file.txt", Contents: strings.Repeat("x", 1000)},
+		{Type: tar.TypeReg, Name: "a/other.txt", Contents: strings.Repeat("y", 1000)},
+	}
+	cases := []struct {
+		
+		// The limits to enforce
+		limits layer.ExtractionLimits
+		
+		// The description of the limit that is expected to be exceeded (empty if extraction should succeed)
+		expected string
+	}{
+		{limits: layer.ExtractionLimits{MaxTotalBytes: 100000, MaxFileSize: 1000, MaxEntries: 4, MaxPathDepth: 3, MaxNameLength: 12}, expected: ""},
+		{limits: layer.ExtractionLimits{MaxTotalBytes: 1500}, expected: "total size"},
+		{limits: layer.ExtractionLimits{MaxFileSize: 999}, expected: "file size"},
+		{limits: layer.ExtractionLimits{MaxEntries: 3}, expected: "entry count"},
+		{limits: layer.ExtractionLimits{MaxPathDepth: 2}, expected: "path depth"},
+		{limits: layer.ExtractionLimits{MaxNameLength: 11}, expected: "name length"},
+	}
+	
+	for _, testCase := range cases {
+		archive, err := testutil.CreateArchive(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		
+		// Extract the archive and verify that the expected limit was reported
+		extractor := &layer.LayerExtractor{DiffDir: t.TempDir(), Limits: testCase.limits}
+		err = extractor.Extract(archive)
+		exceeded := &layer.LimitExceededError{}
+		if testCase.expected == "" && err != nil {
+			t.Errorf("expected extraction within limits %+v to succeed, got: %v", testCase.limits, err)
+		} else if testCase.expected != "" && (!errors.As(err, &exceeded) || exceeded.Limit != testCase.expected) {
+			t.Errorf("expected the %s limit to be exceeded, got: %v", testCase.expected, err)
+		}
+	}
+}
+
+// Tests that the combined size limit is enforced against the sizes declared by file headers, before any data is written
+// (This is what prevents a small sparse or truncated archive from declaring an enormous file)
+func TestExtractRejectsOversizedHeaders(t *testing.T) {
+	
+	// Generate an archive whose only file declares a size far larger than the data that follows it
+	// (The archive is deliberately left truncated after the header, since the contents should never be read)
+	archive := &bytes.Buffer{}
+	writer := tar.NewWriter(archive)
+	header := &tar.Header{Typeflag: tar.TypeReg, Name: "bomb", Mode: 0644, Size: 1 << 40, Format: tar.FormatPAX}
+	if err := writer.WriteHeader(header); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verify that extraction fails before attempting to read the declared contents
+	extractor := &layer.LayerExtractor{DiffDir: t.TempDir(), Limits: layer.ExtractionLimits{MaxTotalBytes: 1 << 30}}
+	err := extractor.Extract(archive)
+	exceeded := &layer.LimitExceededError{}
+	if !errors.As(err, &exceeded) || exceeded.Limit != "total size" || exceeded.Path != "bomb" {
+		t.Errorf("expected the total size limit to be exceeded by the bomb entry, got: %v", err)
+	}
+}
+
+// Tests that the combined size limit also bounds data that follows the end-of-archive marker, which is decompressed when the rest of the blob is consumed
+func TestUnpackBoundsTrailingData(t *testing.T) {
+	root := t.TempDir()
+	uid, gid := os.Getuid(), os.Getgid()
+	
+	// Create a compressed layer whose archive is followed by far more zeroes than the archive itself contains
+	archive := createExtractTestArchive(t, []*tar.Header{
+		{Typeflag: tar.TypeReg, Name: "file", Mode: 0644, Uid: uid, Gid: gid, ModTime: time.Unix(1600000000, 0)},
+	}, map[string]string{"file": "contents"}).Bytes()
+	archive = append(archive, make([]byte, 8 << 20)...)
+	imageDir := filepath.Join(root, "image")
+	if _, err := testutil.CreateLayout(imageDir, oci.MediaTypeImageLayerGzip, archive); err != nil {
+		t.Fatal(err)
+	}
+	
+	cases := []struct {
+		
+		// The limit on the total size of the uncompressed tar stream
+		maxTotalBytes int64
+		
+		// Whether the limit is expected to be exceeded
+		exceeded bool
+	}{
+		{maxTotalBytes: 1 << 20, exceeded: true},
+		{maxTotalBytes: 16 << 20, exceeded: false},
+	}
+	
+	for index, testCase := range cases {
+		unpacker, err := image.UnpackerForImage(imageDir, filepath.Join(root, fmt.Sprintf("unpacked-%d", index)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpacker.Limits = layer.ExtractionLimits{MaxTotalBytes: testCase.maxTotalBytes}
+		
+		// Verify that the trailing data only causes the unpack to fail when it exceeds the limit
+		_, err = unpacker.Unpack(nil)
+		exceeded := &image.LayerLimitError{}
+		if testCase.exceeded && (!errors.As(err, &exceeded) || exceeded.Limit.Limit != "total size") {
+			t.Errorf("expected the trailing data to exceed the total size limit of %d bytes, got: %v", testCase.maxTotalBytes, err)
+		} else if !testCase.exceeded && err != nil {
+			t.Errorf("expected the image to unpack within the total size limit of %d bytes, got: %v", testCase.maxTotalBytes, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/macoscontainers/experiments/internal/filesystem"
+	"github.com/macoscontainers/experiments/internal/layer"
+)
+
+// Tests that overrides survive a round trip through their string representation, and that malformed values are rejected
+func TestParseStatOverride(t *testing.T) {
+	for _, value := range []string{"0:0:0755:dir", "1000:50:4750:file", "0:0:0666:char-1-3", "0:6:0660:block-8-0", "0:0:0777:symlink"} {
+		override, err := layer.ParseStatOverride(value)
+		if err != nil {
+			t.Errorf("failed to parse override %q: %v", value, err)
+		} else if override.String() != value {
+			t.Errorf("expected override %q to format as itself, got %q", value, override.String())
+		}
+	}
+	
+	// Overrides written by older versions of containers/storage omit the file type
+	if override, err := layer.ParseStatOverride("1:2:0644"); err != nil || override.Type != "file" {
+		t.Errorf("expected an override without a type to describe a regular file, got %+v (%v)", override, err)
+	}
+	
+	for _, value := range []string{"", "0:0", "a:0:0755:dir", "0:0:0999:file", "0:0:0666:char-1"} {
+		if _, err := layer.ParseStatOverride(value); err == nil {
+			t.Errorf("expected override %q to be rejected", value)
+		}
+	}
+}
+
+// Tests that the layer packer writes the attributes recorded in overrides rather than the real attributes of the files
+func TestPackUsesStatOverrides(t *testing.T) {
+	diffDir := filepath.Join(t.TempDir(), "diff")
+	if err := os.MkdirAll(filepath.Join(diffDir, "dev"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Create files whose intended attributes are recorded in overrides, including a placeholder file for a device node
+	overrides := map[string]string{
+		"dev": "0:0:0755:dir",
+		"dev/null": "0:0:0666:char-1-3",
+		"setuid": "1000:50:4750:file",
+	}
+	for name, value := range overrides {
+		path := filepath.Join(diffDir, name)
+		if name != "dev" {
+			if err := os.WriteFile(path, []byte{}, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		
+		override, err := layer.ParseStatOverride(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := layer.WriteStatOverride(path, override); filesystem.IsXattrUnsupported(err) {
+			t.Skip("the filesystem used for temporary directories does not support user extended attributes")
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	// Pack the diff directory
+	archive := &bytes.Buffer{}
+	packer := &layer.LayerPacker{DiffDir: diffDir}
+	if err := packer.Pack(archive); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verify that each entry carries the attributes from its override
+	expected := map[string]tar.Header{
+		"dev/": {Typeflag: tar.TypeDir, Mode: 0755},
+		"dev/null": {Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		"setuid": {Typeflag: tar.TypeReg, Mode: 04750, Uid: 1000, Gid: 50},
+	}
+	reader := tar.NewReader(archive)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		
+		want, ok := expected[header.Name]
+		if !ok {
+			continue
+		}
+		delete(expected, header.Name)
+		if header.Typeflag != want.Typeflag || header.Mode != want.Mode || header.Uid != want.Uid || header.Gid != want.Gid || header.Devmajor != want.Devmajor || header.Devminor != want.Devminor || header.Size != 0 {
+			t.Errorf("unexpected attributes for %s: type %c, mode %04o, owner %d:%d, device %d:%d, size %d", header.Name, header.Typeflag, header.Mode, header.Uid, header.Gid, header.Devmajor, header.Devminor, header.Size)
+		}
+	}
+	for name := range expected {
+		t.Errorf("expected the archive to contain %s", name)
+	}
+}
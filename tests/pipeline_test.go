@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/tests/testutil"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Reads the paths and contents of every entry in a directory tree, representing directories by an empty string
+// (The root is resolved first, since the merged directory for a base layer is a symlink to its diff directory)
+func readTree(t *testing.T, root string) map[string]string {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	tree := map[string]string{}
+	for _, path := range listTree(t, root) {
+		info, err := os.Lstat(filepath.Join(root, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.IsDir() {
+			tree[path] = ""
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(root, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree[path] = string(data)
+	}
+	
+	return tree
+}
+
+// Tests that unpacking produces the same merged contents regardless of how many layers are extracted concurrently, since diffs are always applied in layer order
+func TestUnpackConcurrencyPreservesLayerOrder(t *testing.T) {
+	root := t.TempDir()
+	
+	// Create layers whose whiteouts and replacements only produce the expected result when they are applied in order
+	layers := [][]testutil.ArchiveEntry{
+		{
+			{Type: tar.TypeDir, Name: "dir/"},
+			{Type: tar.TypeReg, Name: "dir/a", Contents: "1"},
+			{Type: tar.TypeReg, Name: "dir/b", Contents: "1"},
+			{Type: tar.TypeReg, Name: "version", Contents: "1"},
+		},
+		{
+			{Type: tar.TypeReg, Name: "dir/.wh.a", Contents: ""},
+			{Type: tar.TypeReg, Name: "version", Contents: "2"},
+			{Type: tar.TypeDir, Name: "replaced/"},
+			{Type: tar.TypeReg, Name: "replaced/child", Contents: "2"},
+		},
+		{
+			{Type: tar.TypeDir, Name: "dir/"},
+			{Type: tar.TypeReg, Name: "dir/.wh..wh..opq", Contents: ""},
+			{Type: tar.TypeReg, Name: "dir/c", Contents: "3"},
+			{Type: tar.TypeReg, Name: "version", Contents: "3"},
+		},
+		{
+			{Type: tar.TypeReg, Name: ".wh.replaced", Contents: ""},
+			{Type: tar.TypeReg, Name: "replaced", Contents: "4"},
+			{Type: tar.TypeReg, Name: "dir/a", Contents: "4"},
+		},
+		{
+			{Type: tar.TypeReg, Name: "dir/.wh.c", Contents: ""},
+			{Type: tar.TypeReg, Name: "version", Contents: "5"},
+		},
+	}
+	archives := [][]byte{}
+	for _, entries := range layers {
+		archive, err := testutil.CreateArchive(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, archive.Bytes())
+	}
+	imageDir := filepath.Join(root, "image")
+	if _, err := testutil.CreateLayout(imageDir, oci.MediaTypeImageLayerGzip, archives...); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Unpack the image to a separate directory with each level of concurrency
+	expected := map[string]string{"dir": "", "dir/a": "4", "replaced": "4", "version": "5"}
+	var sequential []map[string]string
+	for _, concurrency := range []int{1, 2, len(layers)} {
+		unpacker, err := image.UnpackerForImage(imageDir, filepath.Join(root, fmt.Sprintf("unpacked-%d", concurrency)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpacker.Concurrency = concurrency
+		unpacked, err := unpacker.Unpack(nil)
+		if err != nil {
+			t.Fatalf("failed to unpack with concurrency %d: %v", concurrency, err)
+		}
+		
+		// Verify that the merged contents of the top layer reflect every layer applied in order
+		if merged := readTree(t, unpacked.Layers[len(unpacked.Layers) - 1].MergedDir); !reflect.DeepEqual(merged, expected) {
+			t.Errorf("unexpected merged contents with concurrency %d:\nexpected: %v\nactual:   %v", concurrency, expected, merged)
+		}
+		
+		// Verify that the merged contents of every layer are identical to those produced by sequential extraction
+		trees := []map[string]string{}
+		for _, unpackedLayer := range unpacked.Layers {
+			trees = append(trees, readTree(t, unpackedLayer.MergedDir))
+		}
+		if sequential == nil {
+			sequential = trees
+		} else if !reflect.DeepEqual(trees, sequential) {
+			t.Errorf("expected the merged contents of each layer with concurrency %d to match sequential extraction:\nexpected: %v\nactual:   %v", concurrency, sequential, trees)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package tests
+
+import (
+	"archive/tar"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/tests/testutil"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Tests that equivalent spellings of platforms are normalised to the same OS, architecture and variant
+func TestNormalizePlatform(t *testing.T) {
+	cases := map[string]string{
+		"linux/amd64": "linux/amd64/v1",
+		"Linux/x86_64": "linux/amd64/v1",
+		"linux/amd64/v3": "linux/amd64/v3",
+		"linux/aarch64": "linux/arm64/v8",
+		"linux/arm64/8": "linux/arm64/v8",
+		"linux/arm64/v8.2": "linux/arm64/v8.2",
+		"linux/armhf": "linux/arm/v7",
+		"linux/armel": "linux/arm/v6",
+		"linux/arm/7": "linux/arm/v7",
+		"linux/i386": "linux/386",
+		"macos/arm64": "darwin/arm64/v8",
+	}
+	
+	for input, expected := range cases {
+		platform, err := image.ParsePlatform(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := image.FormatPlatform(image.NormalizePlatform(platform)); actual != expected {
+			t.Errorf("expected %s to normalise to %s, got %s", input, expected, actual)
+		}
+	}
+}
+
+// Tests that candidate platforms match when they are compatible with the requested platform, preferring exact and newer compatible variants
+func TestMatchPlatform(t *testing.T) {
+	cases := []struct {
+		
+		// The requested platform
+		requested oci.Platform
+		
+		// The candidate platforms, in order of decreasing preference
+		compatible []oci.Platform
+		
+		// Candidate platforms that must not match
+		incompatible []oci.Platform
+	}{
+		{
+			requested: oci.Platform{OS: "linux", Architecture: "amd64", Variant: "v3"},
+			compatible: []oci.Platform{
+				{OS: "linux", Architecture: "amd64", Variant: "v3"},
+				{OS: "linux", Architecture: "amd64", Variant: "v2"},
+				{OS: "linux", Architecture: "amd64"},
+			},
+			incompatible: []oci.Platform{
+				{OS: "linux", Architecture: "amd64", Variant: "v4"},
+				{OS: "linux", Architecture: "arm64"},
+				{OS: "windows", Architecture: "amd64"},
+			},
+		},
+		{
+			requested: oci.Platform{OS: "linux", Architecture: "amd64"},
+			compatible: []oci.Platform{
+				{OS: "linux", Architecture: "x86_64", Variant: "v1"},
+			},
+			incompatible: []oci.Platform{
+				{OS: "linux", Architecture: "amd64", Variant: "v2"},
+			},
+		},
+		{
+			requested: oci.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+			compatible: []oci.Platform{
+				{OS: "linux", Architecture: "armhf"},
+				{OS: "linux", Architecture: "arm", Variant: "v6"},
+				{OS: "linux", Architecture: "arm", Variant: "v5"},
+			},
+			incompatible: []oci.Platform{
+				{OS: "linux", Architecture: "arm", Variant: "v8"},
+				{OS: "linux", Architecture: "arm64"},
+			},
+		},
+		{
+			requested: oci.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763", OSFeatures: []string{"win32k"}},
+			compatible: []oci.Platform{
+				{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1879", OSFeatures: []string{"win32k"}},
+			},
+			incompatible: []oci.Platform{
+				{OS: "windows", Architecture: "amd64", OSVersion: "10.0.14393.4402"},
+				{OS: "windows", Architecture: "amd64", OSVersion: "10.0"},
+				{OS: "windows", Architecture: "amd64", OSFeatures: []string{"unsupported"}},
+			},
+		},
+	}
+	
+	for _, testCase := range cases {
+		
+		// Verify that the compatible candidates match, in order of decreasing preference
+		previous := 0.0
+		for index, candidate := range testCase.compatible {
+			score, matches := image.MatchPlatform(testCase.requested, candidate)
+			if !matches {
+				t.Errorf("expected %s to match %s", image.FormatPlatform(candidate), image.FormatPlatform(testCase.requested))
+			} else if index > 0 && score >= previous {
+				t.Errorf("expected %s to be a worse match for %s than the previous candidate", image.FormatPlatform(candidate), image.FormatPlatform(testCase.requested))
+			}
+			previous = score
+		}
+		
+		// Verify that the incompatible candidates do not match
+		for _, candidate := range testCase.incompatible {
+			if _, matches := image.MatchPlatform(testCase.requested, candidate); matches {
+				t.Errorf("expected %s not to match %s", image.FormatPlatform(candidate), image.FormatPlatform(testCase.requested))
+			}
+		}
+	}
+}
+
+// Tests that the host platform reports the amd64 microarchitecture level, so that images built for older levels still match
+func TestHostPlatformVariant(t *testing.T) {
+	host := image.HostPlatform()
+	if host.OS != runtime.GOOS {
+		t.Errorf("expected the host OS to be %s, got %s", runtime.GOOS, host.OS)
+	}
+	if runtime.GOARCH != "amd64" {
+		return
+	}
+	
+	if host.Variant < "v1" || host.Variant > "v4" {
+		t.Errorf("expected the host variant to be an amd64 microarchitecture level, got %q", host.Variant)
+	}
+	if _, matches := image.MatchPlatform(host, oci.Platform{OS: runtime.GOOS, Architecture: "amd64"}); !matches {
+		t.Errorf("expected the host platform %s to match images without a variant", image.FormatPlatform(host))
+	}
+	if _, matches := image.MatchPlatform(host, oci.Platform{OS: runtime.GOOS, Architecture: "amd64", Variant: host.Variant}); !matches {
+		t.Errorf("expected the host platform %s to match images for its own variant", image.FormatPlatform(host))
+	}
+}
+
+// Tests that platforms are resolved from the image configuration, including the variant, when image manifest descriptors do not specify them
+func TestUnpackResolvesPlatformFromConfig(t *testing.T) {
+	root := t.TempDir()
+	archive, err := testutil.CreateArchive([]testutil.ArchiveEntry{
+		{Type: tar.TypeReg, Name: "file", Contents: "contents"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Create an image for each variant, omitting the platform from the image manifest descriptors
+	imageDir := filepath.Join(root, "image")
+	descriptors := []oci.Descriptor{}
+	for _, variant := range []string{"v6", "v7"} {
+		platform := oci.Platform{OS: "linux", Architecture: "arm", Variant: variant}
+		descriptor, err := testutil.CreateImageForPlatform(imageDir, platform, oci.MediaTypeImageLayerGzip, [][]byte{archive.Bytes()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		descriptor.Platform = nil
+		descriptors = append(descriptors, descriptor)
+	}
+	if err := testutil.WriteIndex(imageDir, descriptors); err != nil {
+		t.Fatal(err)
+	}
+	
+	unpacker, err := image.UnpackerForImage(imageDir, filepath.Join(root, "unpacked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unpacker.Close()
+	
+	// Verify that each requested variant selects the newest compatible image
+	for requested, expected := range map[string]int{"linux/arm/v7": 1, "linux/arm/v8": 1, "linux/arm/v6": 0} {
+		platform, err := image.ParsePlatform(requested)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpacked, err := unpacker.Unpack(&platform)
+		if err != nil {
+			t.Errorf("failed to unpack image for %s: %v", requested, err)
+		} else if unpacked.Descriptor.Digest != descriptors[expected].Digest {
+			t.Errorf("expected %s to select image %d, got %s", requested, expected, unpacked.Descriptor.Digest)
+		}
+	}
+	
+	// Verify that a variant older than any image is rejected, and that the error lists the variants from the image configurations
+	platform := oci.Platform{OS: "linux", Architecture: "arm", Variant: "v5"}
+	if _, err := unpacker.Unpack(&platform); err == nil || !strings.Contains(err.Error(), "linux/arm/v6, linux/arm/v7") {
+		t.Errorf("expected unpacking for linux/arm/v5 to fail and list the available variants, got: %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package tests
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/internal/progress"
+	"github.com/macoscontainers/experiments/tests/testutil"
+	digest "github.com/opencontainers/go-digest"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Records the layer-level events reported by an unpacker, ignoring events for individual files
+type eventRecorder struct {
+	
+	// Protects the list of events, since events may be reported concurrently
+	mutex sync.Mutex
+	
+	// The recorded events, in the order they were reported
+	events []progress.Event
+}
+
+// Records events other than those for individual files
+func (recorder *eventRecorder) Observe(event progress.Event) {
+	if event.Type == progress.FileApplied || event.Type == progress.WhiteoutProcessed {
+		return
+	}
+	
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.events = append(recorder.events, event)
+}
+
+// Returns the recorded events for the specified layer
+func (recorder *eventRecorder) forLayer(layer digest.Digest) []progress.Event {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	
+	events := []progress.Event{}
+	for _, event := range recorder.events {
+		if event.Layer == layer {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Returns the position of the first recorded event of the specified type for the specified layer, or -1 if there is none
+func (recorder *eventRecorder) indexOf(eventType progress.EventType, layer digest.Digest) int {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	
+	for index, event := range recorder.events {
+		if event.Type == eventType && event.Layer == layer {
+			return index
+		}
+	}
+	return -1
+}
+
+// Returns the types of the specified events, collapsing consecutive BytesDecompressed events into one
+func eventTypes(events []progress.Event) []progress.EventType {
+	types := []progress.EventType{}
+	for _, event := range events {
+		if event.Type == progress.BytesDecompressed && len(types) > 0 && types[len(types) - 1] == progress.BytesDecompressed {
+			continue
+		}
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+// Tests that an unpacker reports the start and end of each stage for each layer in order, along with decompression progress, and reports failures as Error events
+func TestUnpackReportsProgress(t *testing.T) {
+	root := t.TempDir()
+	archives := createCacheTestArchives(t, "first", "second")
+	diffIDs := []digest.Digest{digest.FromBytes(archives[0]), digest.FromBytes(archives[1])}
+	chainIDs := image.ChainIDs(diffIDs)
+	
+	// Unpack an image with two layers
+	imageDir := filepath.Join(root, "image")
+	if _, err := testutil.CreateLayout(imageDir, oci.MediaTypeImageLayerGzip, archives...); err != nil {
+		t.Fatal(err)
+	}
+	unpacker, err := image.UnpackerForImage(imageDir, filepath.Join(root, "unpacked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &eventRecorder{}
+	unpacker.Observer = recorder
+	if _, err := unpacker.Unpack(nil); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verify that each layer reports each stage in order, and that the final decompression progress matches the size of the uncompressed archive
+	expected := []progress.EventType{progress.LayerExtractStarted, progress.BytesDecompressed, progress.LayerExtractFinished, progress.LayerApplyStarted, progress.LayerApplyFinished}
+	for index, chainID := range chainIDs {
+		events := recorder.forLayer(chainID)
+		if types := eventTypes(events); !reflect.DeepEqual(types, expected) {
+			t.Errorf("unexpected events for layer %d:\nexpected: %v\nactual:   %v", index, expected, types)
+			continue
+		}
+		
+		previous := int64(0)
+		for _, event := range events {
+			if event.Type == progress.BytesDecompressed {
+				if event.Bytes <= previous {
+					t.Errorf("expected decompression progress for layer %d to increase, got %d after %d", index, event.Bytes, previous)
+				}
+				previous = event.Bytes
+			}
+			if finished := event.Type == progress.LayerExtractFinished || event.Type == progress.LayerApplyFinished; finished != (event.Duration > 0) {
+				t.Errorf("unexpected duration %v for %v event of layer %d", event.Duration, event.Type, index)
+			}
+			if event.Err != nil {
+				t.Errorf("unexpected error for %v event of layer %d: %v", event.Type, index, event.Err)
+			}
+		}
+		if previous != int64(len(archives[index])) {
+			t.Errorf("expected decompression progress for layer %d to reach %d bytes, got %d", index, len(archives[index]), previous)
+		}
+	}
+	
+	// Verify that diffs are applied in layer order
+	if recorder.indexOf(progress.LayerApplyStarted, chainIDs[1]) < recorder.indexOf(progress.LayerApplyFinished, chainIDs[0]) {
+		t.Error("expected the diff for the second layer to be applied after the diff for the first layer")
+	}
+	
+	// Unpack a copy of the image whose second layer does not match its diff_id
+	failingDir := filepath.Join(root, "failing")
+	failingDescriptor, err := testutil.CreateImage(failingDir, oci.MediaTypeImageLayerGzip, archives)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, config := replaceDiffID(t, failingDir, failingDescriptor, 1, digest.FromString("different contents"))
+	unpacker, err = image.UnpackerForImage(failingDir, filepath.Join(root, "failing-unpacked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder = &eventRecorder{}
+	unpacker.Observer = recorder
+	_, unpackErr := unpacker.Unpack(nil)
+	if unpackErr == nil {
+		t.Fatal("expected unpacking an image with a mismatched diff_id to fail")
+	}
+	
+	// Verify that the first layer completes, and that the failed extraction of the second layer is reported as an Error event holding the mismatch rather than as a finished extraction
+	failingChainIDs := image.ChainIDs(config.RootFS.DiffIDs)
+	if types := eventTypes(recorder.forLayer(failingChainIDs[0])); !reflect.DeepEqual(types, expected) {
+		t.Errorf("unexpected events for the valid layer:\nexpected: %v\nactual:   %v", expected, types)
+	}
+	events := recorder.forLayer(failingChainIDs[1])
+	failed := []progress.EventType{progress.LayerExtractStarted, progress.BytesDecompressed, progress.Error}
+	if types := eventTypes(events); !reflect.DeepEqual(types, failed) {
+		t.Errorf("unexpected events for the mismatched layer:\nexpected: %v\nactual:   %v", failed, types)
+	} else if mismatch := (&image.DiffIDMismatchError{}); !errors.As(events[len(events) - 1].Err, &mismatch) || !errors.Is(unpackErr, events[len(events) - 1].Err) {
+		t.Errorf("expected the Error event to hold the diff_id mismatch returned by the unpacker, got: %v", events[len(events) - 1].Err)
+	}
+}
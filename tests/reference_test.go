@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"archive/tar"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/tests/testutil"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Creates an image in an OCI image layout whose single layer contains a file with the specified contents
+func createReferenceTestImage(t *testing.T, imageDir string, platform oci.Platform, contents string) oci.Descriptor {
+	archive, err := testutil.CreateArchive([]testutil.ArchiveEntry{
+		{Type: tar.TypeReg, Name: "file", Contents: contents},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	descriptor, err := testutil.CreateImageForPlatform(imageDir, platform, oci.MediaTypeImageLayerGzip, [][]byte{archive.Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	return descriptor
+}
+
+// Returns a copy of a descriptor with the specified reference name annotation
+func withRefName(descriptor oci.Descriptor, name string) oci.Descriptor {
+	descriptor.Annotations = map[string]string{oci.AnnotationRefName: name}
+	return descriptor
+}
+
+// Tests that references select images by reference name or digest, following nested image indexes and reporting ambiguous and missing references
+func TestUnpackReference(t *testing.T) {
+	root := t.TempDir()
+	imageDir := filepath.Join(root, "image")
+	host := image.HostPlatform()
+	arm := oci.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	
+	// Create two distinct images for the host platform and one for another platform
+	first := createReferenceTestImage(t, imageDir, host, "first")
+	second := createReferenceTestImage(t, imageDir, host, "second")
+	other := createReferenceTestImage(t, imageDir, arm, "first")
+	
+	// Create a nested image index containing the second image and the image for the other platform
+	nested, err := testutil.WriteJsonBlob(imageDir, oci.MediaTypeImageIndex, &oci.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []oci.Descriptor{second, other},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Create the top-level index, with one reference name shared by two images for the same platform
+	if err := testutil.WriteIndex(imageDir, []oci.Descriptor{
+		withRefName(first, "app:latest"),
+		withRefName(second, "app:latest"),
+		withRefName(first, "base"),
+		withRefName(nested, "multi"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	
+	unpacker, err := image.UnpackerForImage(imageDir, filepath.Join(root, "unpacked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unpacker.Close()
+	
+	// Verify that references resolve to the expected images
+	cases := []struct {
+		
+		// The reference to resolve
+		reference string
+		
+		// The requested platform (nil for the host platform)
+		platform *oci.Platform
+		
+		// The digest of the image that is expected to be selected
+		expected digest.Digest
+	}{
+		{reference: "base", expected: first.Digest},
+		{reference: "multi", expected: second.Digest},
+		{reference: "multi", platform: &arm, expected: other.Digest},
+		{reference: first.Digest.String(), expected: first.Digest},
+		{reference: other.Digest.String(), expected: other.Digest},
+	}
+	for _, testCase := range cases {
+		unpacked, err := unpacker.UnpackReference(testCase.reference, testCase.platform)
+		if err != nil {
+			t.Errorf("failed to unpack reference %s: %v", testCase.reference, err)
+		} else if unpacked.Descriptor.Digest != testCase.expected {
+			t.Errorf("expected reference %s to select image %s, got %s", testCase.reference, testCase.expected, unpacked.Descriptor.Digest)
+		}
+	}
+	
+	// Verify that a reference name shared by images for the same platform is rejected as ambiguous
+	var ambiguous *image.AmbiguousReferenceError
+	if _, err := unpacker.UnpackReference("app:latest", nil); !errors.As(err, &ambiguous) {
+		t.Errorf("expected an ambiguous reference error, got: %v", err)
+	} else if !reflect.DeepEqual(ambiguous.Matches, []digest.Digest{first.Digest, second.Digest}) {
+		t.Errorf("expected the ambiguous reference to list both images, got %v", ambiguous.Matches)
+	}
+	
+	// Verify that missing references, digest prefixes and bare hex digests are not found, and that the error lists the available reference names
+	for _, reference := range []string{"missing", first.Digest.String()[:20], first.Digest.Encoded()} {
+		var notFound *image.ReferenceNotFoundError
+		if _, err := unpacker.UnpackReference(reference, nil); !errors.As(err, &notFound) {
+			t.Errorf("expected reference %s not to be found, got: %v", reference, err)
+		} else if !reflect.DeepEqual(notFound.Available, []string{"app:latest", "base", "multi"}) {
+			t.Errorf("expected the error for reference %s to list the available references, got %v", reference, notFound.Available)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/macoscontainers/experiments/internal/filesystem"
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/internal/progress"
+	"github.com/macoscontainers/experiments/tests/testutil"
+	digest "github.com/opencontainers/go-digest"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Tests that an unpack interrupted by cancelling its context leaves no incomplete layer that can be mistaken for a complete one, and that the next unpack resumes from the last completed layer
+func TestUnpackResumesAfterCancellation(t *testing.T) {
+	root := t.TempDir()
+	unpackDir := filepath.Join(root, "unpacked")
+	
+	// Create an image with three layers
+	imageDir := filepath.Join(root, "image")
+	archives := createCacheTestArchives(t, "first", "second", "third")
+	if _, err := testutil.CreateLayout(imageDir, oci.MediaTypeImageLayerGzip, archives...); err != nil {
+		t.Fatal(err)
+	}
+	unpacker, err := image.UnpackerForImage(imageDir, unpackDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unpacker.Close()
+	
+	// Determine the ChainIDs of the layers
+	diffIDs := []digest.Digest{}
+	for _, archive := range archives {
+		diffIDs = append(diffIDs, digest.FromBytes(archive))
+	}
+	chainIDs := image.ChainIDs(diffIDs)
+	
+	// Unpack the image, cancelling the context as soon as the diff for the second layer starts being applied
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	unpacker.Observer = progress.ObserverFunc(func(event progress.Event) {
+		if event.Type == progress.LayerApplyStarted && event.Layer == chainIDs[1] {
+			cancel()
+		}
+	})
+	if _, err := unpacker.UnpackContext(ctx, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the unpack to be cancelled, got: %v", err)
+	}
+	
+	// Verify that only the first layer was committed, and that the later layers were not moved into place
+	if !filesystem.Exists(filepath.Join(unpacker.LayerDir(chainIDs[0]), image.LAYER_RECORD_FILENAME)) {
+		t.Error("expected the first layer to have been committed before the unpack was cancelled")
+	}
+	for _, chainID := range chainIDs[1:] {
+		if filesystem.Exists(unpacker.LayerDir(chainID)) {
+			t.Errorf("expected the incomplete layer %s not to be moved into place", chainID)
+		}
+	}
+	
+	// Simulate a layer directory left behind without a completion record (e.g. by a crash in an older version of the unpacker)
+	leftover := filepath.Join(unpacker.LayerDir(chainIDs[2]), "merged")
+	if err := os.MkdirAll(leftover, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(leftover, "leftover"), []byte("leftover"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Unpack the image again and verify that only the committed layer was reused
+	recorder := &reuseRecorder{}
+	unpacker.Observer = recorder
+	unpacked, err := unpacker.Unpack(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.reused) != 1 || recorder.reused[0] != chainIDs[0] {
+		t.Errorf("expected only the first layer to be reused, got %v", recorder.reused)
+	}
+	
+	// Verify that the merged contents are complete, that the leftover contents were discarded and that no staging directories remain
+	merged := unpacked.Layers[2].MergedDir
+	for _, name := range []string{"first", "second", "third"} {
+		if !filesystem.Exists(filepath.Join(merged, name)) {
+			t.Errorf("expected the resumed unpack to produce %s", name)
+		}
+	}
+	if filesystem.Exists(filepath.Join(merged, "leftover")) {
+		t.Error("expected the leftover contents of the incomplete layer to be discarded")
+	}
+	for _, chainID := range chainIDs {
+		if filesystem.Exists(unpacker.StagingDir(chainID)) {
+			t.Errorf("expected no staging directory to remain for layer %s", chainID)
+		}
+	}
+}
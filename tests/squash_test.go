@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/internal/layer"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Tests that squashing replaces the history entries for the squashed layers with a single entry, discarding only the empty layer entries between them
+func TestSquashHistory(t *testing.T) {
+	
+	// Creates history entries with the specified descriptions, treating descriptions that begin with "empty" as empty layers
+	entries := func(descriptions ...string) []oci.History {
+		history := []oci.History{}
+		for _, description := range descriptions {
+			history = append(history, oci.History{CreatedBy: description, EmptyLayer: strings.HasPrefix(description, "empty")})
+		}
+		return history
+	}
+	
+	squashed := oci.History{CreatedBy: "squashed"}
+	cases := []struct {
+		
+		// The history to squash
+		history []oci.History
+		
+		// The range of layers to squash
+		from, to int
+		
+		// The number of layers in the image
+		numLayers int
+		
+		// The expected history after squashing
+		expected []oci.History
+	}{
+		{
+			history: entries("L0", "empty-a", "L1", "empty-b", "L2", "empty-c", "L3", "empty-d"),
+			from: 1, to: 3, numLayers: 4,
+			expected: append(entries("L0", "empty-a"), append([]oci.History{squashed}, entries("empty-c", "L3", "empty-d")...)...),
+		},
+		{
+			history: entries("L0", "empty-a", "L1", "empty-b", "L2", "empty-c", "L3", "empty-d"),
+			from: 0, to: 4, numLayers: 4,
+			expected: append([]oci.History{squashed}, entries("empty-d")...),
+		},
+		{
+			history: entries("empty-a", "L0", "L1", "empty-b"),
+			from: 0, to: 1, numLayers: 2,
+			expected: append(entries("empty-a"), append([]oci.History{squashed}, entries("L1", "empty-b")...)...),
+		},
+		{
+			history: entries("L0", "L1"),
+			from: 0, to: 2, numLayers: 3,
+			expected: entries("L0", "L1"),
+		},
+		{
+			history: entries("L0", "empty-a", "L1", "L2"),
+			from: 0, to: 2, numLayers: 4,
+			expected: entries("L0", "empty-a", "L1", "L2"),
+		},
+		{
+			history: []oci.History{},
+			from: 0, to: 2, numLayers: 2,
+			expected: []oci.History{},
+		},
+	}
+	
+	for _, testCase := range cases {
+		if actual := image.SquashHistory(testCase.history, testCase.from, testCase.to, testCase.numLayers, squashed); !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("expected squashing layers [%d, %d) of %+v to produce %+v, got %+v", testCase.from, testCase.to, testCase.history, testCase.expected, actual)
+		}
+	}
+}
+
+// Tests that DiffSquasher applies opaque whiteouts and whiteouts between diffs, marks directories that replace files or erased entries as opaque, and drops whiteouts for base layers
+func TestDiffSquasher(t *testing.T) {
+	root := t.TempDir()
+	timestamp := time.Unix(1600000000, 0)
+	
+	// Creates the specified files in a diff, creating empty files for whiteouts
+	createDiff := func(name string, files ...string) string {
+		diffDir := filepath.Join(root, name)
+		for _, file := range files {
+			writeFileWithTime(t, filepath.Join(diffDir, file), "", timestamp)
+		}
+		return diffDir
+	}
+	
+	// The lowest diff adds files, and erases a file from the layers below the combined diff
+	lower := createDiff("lower", "a/first", "a/second", "b", "c/inner", "d/kept", ".wh.below")
+	
+	// The middle diff replaces the contents of a directory, replaces a file with a directory and erases a directory
+	middle := createDiff("middle", "a/.wh..wh..opq", "a/new", "b/child", ".wh.c")
+	
+	// The highest diff recreates the erased directory
+	upper := createDiff("upper", "c/fresh")
+	
+	cases := []struct {
+		
+		// The name of the directory for the combined diff
+		name string
+		
+		// Whether the combined diff will be used as a base layer
+		baseLayer bool
+		
+		// The expected contents of the combined diff
+		expected []string
+	}{
+		{
+			name: "layer",
+			baseLayer: false,
+			expected: []string{
+				".wh.below", ".wh.c",
+				"a", "a/.wh..wh..opq", "a/new",
+				"b", "b/.wh..wh..opq", "b/child",
+				"c", "c/.wh..wh..opq", "c/fresh",
+				"d", "d/kept",
+			},
+		},
+		{
+			name: "base",
+			baseLayer: true,
+			expected: []string{"a", "a/new", "b", "b/child", "c", "c/fresh", "d", "d/kept"},
+		},
+	}
+	
+	for _, testCase := range cases {
+		squasher := &layer.DiffSquasher{
+			DiffDirs: []string{lower, middle, upper},
+			SquashedDir: filepath.Join(root, "squashed", testCase.name),
+			BaseLayer: testCase.baseLayer,
+		}
+		if err := squasher.Squash(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if actual := listTree(t, squasher.SquashedDir); !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("expected squashing with BaseLayer %v to produce %v, got %v", testCase.baseLayer, testCase.expected, actual)
+		}
+		if info, err := os.Stat(filepath.Join(squasher.SquashedDir, "b")); err != nil || !info.IsDir() {
+			t.Errorf("expected the file replaced by a directory to be a directory (%v)", err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/macoscontainers/experiments/internal/compression"
+	"github.com/macoscontainers/experiments/internal/filesystem"
+	"github.com/macoscontainers/experiments/internal/layer"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Populates base and modified trees whose differences include added, modified and removed files, hardlinks, symlinks and extended attributes, reporting whether extended attributes are supported
+func createStreamTestTrees(t *testing.T, root string) (string, string, bool) {
+	baseDir := filepath.Join(root, "base")
+	modifiedDir := filepath.Join(root, "modified")
+	timestamp := time.Unix(1600000000, 0)
+	
+	// Populate the base layer
+	for _, name := range []string{"etc/config", "etc/removed", "usr/bin/tool", "var/a/file"} {
+		writeFileWithTime(t, filepath.Join(baseDir, name), "original", timestamp)
+	}
+	
+	// Populate the modified files
+	for _, name := range []string{"etc/config", "usr/bin/tool"} {
+		writeFileWithTime(t, filepath.Join(modifiedDir, name), "original", timestamp)
+	}
+	writeFileWithTime(t, filepath.Join(modifiedDir, "usr", "bin", "new"), "added", time.Now())
+	writeFileWithTime(t, filepath.Join(modifiedDir, "var", "a", "file"), "modified", time.Now())
+	writeFileWithTime(t, filepath.Join(modifiedDir, "var", "a.b"), "sorts between var/a and its contents", time.Now())
+	if err := os.Link(filepath.Join(modifiedDir, "usr", "bin", "new"), filepath.Join(modifiedDir, "usr", "bin", "new-link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("new", filepath.Join(modifiedDir, "usr", "bin", "symlink")); err != nil {
+		t.Fatal(err)
+	}
+	xattrSupported := true
+	if err := filesystem.SetXattr(filepath.Join(modifiedDir, "usr", "bin", "new"), "user.test", []byte("value")); filesystem.IsXattrUnsupported(err) {
+		xattrSupported = false
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	
+	return baseDir, modifiedDir, xattrSupported
+}
+
+// Tests that writing a diff directly as a layer archive produces identical results for identical inputs, and matches packing a generated diff directory
+func TestWriteLayerIsReproducible(t *testing.T) {
+	epoch, err := layer.ParseSourceDateEpoch("1700000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Create two copies of the same trees at different times
+	first := t.TempDir()
+	firstBase, firstModified, xattrSupported := createStreamTestTrees(t, first)
+	time.Sleep(10 * time.Millisecond)
+	second := t.TempDir()
+	secondBase, secondModified, _ := createStreamTestTrees(t, second)
+	
+	for _, codec := range []string{compression.CODEC_GZIP, compression.CODEC_ZSTD} {
+		
+		// Write a compressed layer for each copy, and a second time for the first copy
+		digests := []*layer.LayerDigests{}
+		for _, trees := range [][2]string{{firstBase, firstModified}, {firstBase, firstModified}, {secondBase, secondModified}} {
+			generator := &layer.DiffGenerator{BaseDir: trees[0], ModifiedDir: trees[1]}
+			written, err := generator.WriteLayer(io.Discard, layer.ArchiveOptions{Compression: codec, SourceDateEpoch: epoch})
+			if err != nil {
+				t.Fatal(err)
+			}
+			digests = append(digests, written)
+		}
+		
+		// Verify that the layers are identical
+		for _, written := range digests[1:] {
+			if *written != *digests[0] {
+				t.Errorf("expected identical %s layers, got %+v and %+v", codec, digests[0], written)
+			}
+		}
+	}
+	
+	// Write the uncompressed archive directly
+	generator := &layer.DiffGenerator{BaseDir: firstBase, ModifiedDir: firstModified, DiffDir: filepath.Join(first, "diff")}
+	streamed := &bytes.Buffer{}
+	if err := generator.WriteArchive(streamed, layer.ArchiveOptions{SourceDateEpoch: epoch}); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verify that generating a diff directory and packing it produces the same archive
+	generateDiff(t, generator)
+	packed := &bytes.Buffer{}
+	packer := &layer.LayerPacker{DiffDir: generator.DiffDir, SourceDateEpoch: epoch}
+	if err := packer.Pack(packed); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(streamed.Bytes(), packed.Bytes()) {
+		t.Error("expected the streamed archive to match the packed diff directory")
+	}
+	
+	// Verify the order and attributes of the entries
+	expected := []string{"etc/", "etc/.wh.removed", "usr/", "usr/bin/", "usr/bin/new", "usr/bin/new-link", "usr/bin/symlink", "var/", "var/a/", "var/a/file", "var/a.b"}
+	reader := tar.NewReader(streamed)
+	for index := 0; ; index++ {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			if index != len(expected) {
+				t.Errorf("expected %d entries, got %d", len(expected), index)
+			}
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		
+		if index >= len(expected) || header.Name != expected[index] {
+			t.Errorf("unexpected entry %d: %s", index, header.Name)
+		}
+		if header.ModTime.After(epoch) {
+			t.Errorf("expected the timestamp of %s to be clamped to %v, got %v", header.Name, epoch, header.ModTime)
+		}
+		if header.Name == "usr/bin/new-link" && (header.Typeflag != tar.TypeLink || header.Linkname != "usr/bin/new") {
+			t.Errorf("expected %s to be a hardlink to usr/bin/new", header.Name)
+		}
+		if value := header.PAXRecords[layer.PAX_XATTR_PREFIX + "user.test"]; header.Name == "usr/bin/new" && xattrSupported && value != "value" {
+			t.Errorf("unexpected value for extended attribute of %s: %q", header.Name, value)
+		}
+	}
+}
+
+// Wraps a writer, writing a fixed prefix before the first write and the data verbatim thereafter
+type prefixWriter struct {
+	
+	// The underlying writer
+	writer io.Writer
+	
+	// Whether the prefix has been written
+	started bool
+}
+
+// Writes the prefix if it has not yet been written, followed by the data
+func (writer *prefixWriter) Write(p []byte) (int, error) {
+	if !writer.started {
+		writer.started = true
+		if _, err := writer.writer.Write([]byte("PREFIX")); err != nil {
+			return 0, err
+		}
+	}
+	
+	return writer.writer.Write(p)
+}
+
+// Does nothing, since the data is written verbatim
+func (writer *prefixWriter) Close() error {
+	return nil
+}
+
+// Tests that layers are compressed with codecs from the registry specified in the archive options
+func TestWriteLayerUsesCodecRegistry(t *testing.T) {
+	baseDir, modifiedDir, _ := createStreamTestTrees(t, t.TempDir())
+	generator := &layer.DiffGenerator{BaseDir: baseDir, ModifiedDir: modifiedDir}
+	
+	// Create a registry with a codec that is not in the default registry
+	registry := compression.NewRegistry()
+	registry.RegisterCodec(&compression.Codec{
+		Name: "prefix",
+		Magic: []byte("PREFIX"),
+		Decompress: func(reader io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(reader), nil
+		},
+		Compress: func(writer io.Writer) (io.WriteCloser, error) {
+			return &prefixWriter{writer: writer}, nil
+		},
+		LayerMediaType: "application/x-test-layer",
+	})
+	
+	// Verify that the codec is unknown unless the registry is specified
+	if _, err := generator.WriteLayer(io.Discard, layer.ArchiveOptions{Compression: "prefix"}); err == nil {
+		t.Error("expected a codec that is not in the default registry to be rejected")
+	}
+	
+	// Verify that the layer is compressed with the codec from the registry, and that its size and digests describe the compressed and uncompressed data
+	written := &bytes.Buffer{}
+	digests, err := generator.WriteLayer(written, layer.ArchiveOptions{Compression: "prefix", Codecs: registry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(written.Bytes(), []byte("PREFIX")) {
+		t.Error("expected the layer to be compressed with the codec from the registry")
+	}
+	expected := layer.LayerDigests{
+		MediaType: "application/x-test-layer",
+		Digest: digest.FromBytes(written.Bytes()),
+		Size: int64(written.Len()),
+		DiffID: digest.FromBytes(written.Bytes()[len("PREFIX"):]),
+	}
+	if *digests != expected {
+		t.Errorf("expected layer digests %+v, got %+v", expected, *digests)
+	}
+}
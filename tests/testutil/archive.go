@@ -0,0 +1,74 @@
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"time"
+)
+
+// Describes an entry in a tar archive that is generated for testing purposes
+type ArchiveEntry struct {
+	
+	// The type of the entry (e.g. tar.TypeReg or tar.TypeSymlink)
+	Type byte
+	
+	// The path of the entry within the archive, which is used verbatim so that hostile archives can be represented
+	Name string
+	
+	// The target of the entry if it is a symlink or hardlink
+	Linkname string
+	
+	// The contents of the entry if it is a regular file
+	Contents string
+	
+	// The extended attributes of the entry, which are written as PAX records (optional)
+	Xattrs map[string]string
+}
+
+// Generates an uncompressed tar archive containing the specified entries, owned by the current user
+func CreateArchive(entries []ArchiveEntry) (*bytes.Buffer, error) {
+	buffer := &bytes.Buffer{}
+	archive := tar.NewWriter(buffer)
+	for _, entry := range entries {
+		
+		// Use appropriate permissions for the type of entry
+		mode := int64(0644)
+		if entry.Type == tar.TypeDir {
+			mode = 0755
+		} else if entry.Type == tar.TypeSymlink {
+			mode = 0777
+		}
+		
+		// Write the header and contents for the entry
+		header := &tar.Header{
+			Typeflag: entry.Type,
+			Name: entry.Name,
+			Linkname: entry.Linkname,
+			Mode: mode,
+			Size: int64(len(entry.Contents)),
+			Uid: os.Getuid(),
+			Gid: os.Getgid(),
+			ModTime: time.Unix(0, 0),
+			Format: tar.FormatPAX,
+		}
+		for name, value := range entry.Xattrs {
+			if header.PAXRecords == nil {
+				header.PAXRecords = map[string]string{}
+			}
+			header.PAXRecords["SCHILY.xattr." + name] = value
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := archive.Write([]byte(entry.Contents)); err != nil {
+			return nil, err
+		}
+	}
+	
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	
+	return buffer, nil
+}
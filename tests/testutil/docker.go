@@ -28,3 +28,8 @@ func DockerStop(container string) error {
 func DockerCopy(source string, dest string) error {
 	return Run("docker", "cp", "--archive", source, dest)
 }
+
+// Saves a container image to a tarball by invoking the `docker save` command
+func DockerSave(image string, output string) error {
+	return Run("docker", "save", "-o", output, image)
+}
@@ -0,0 +1,158 @@
+package testutil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Writes a blob to the OCI image layout in the specified directory, returning its descriptor
+func WriteBlob(imageDir string, mediaType string, data []byte) (oci.Descriptor, error) {
+	descriptor := oci.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	path := BlobPath(imageDir, descriptor.Digest)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	return descriptor, os.WriteFile(path, data, 0644)
+}
+
+// Returns the filesystem path to the blob with the specified digest in the OCI image layout in the specified directory
+func BlobPath(imageDir string, blob digest.Digest) string {
+	return filepath.Join(imageDir, "blobs", blob.Algorithm().String(), blob.Encoded())
+}
+
+// Parses the image manifest referenced by the specified descriptor from the OCI image layout in the specified directory
+func ReadManifest(imageDir string, descriptor oci.Descriptor) (*oci.Manifest, error) {
+	data, err := os.ReadFile(BlobPath(imageDir, descriptor.Digest))
+	if err != nil {
+		return nil, err
+	}
+	
+	manifest := &oci.Manifest{}
+	return manifest, json.Unmarshal(data, manifest)
+}
+
+// Parses the image configuration referenced by the specified image manifest from the OCI image layout in the specified directory
+func ReadConfig(imageDir string, manifest *oci.Manifest) (*oci.Image, error) {
+	data, err := os.ReadFile(BlobPath(imageDir, manifest.Config.Digest))
+	if err != nil {
+		return nil, err
+	}
+	
+	config := &oci.Image{}
+	return config, json.Unmarshal(data, config)
+}
+
+// Parses the OCI index of the OCI image layout in the specified directory
+func ReadIndex(imageDir string) (*oci.Index, error) {
+	data, err := os.ReadFile(filepath.Join(imageDir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	
+	index := &oci.Index{}
+	return index, json.Unmarshal(data, index)
+}
+
+// Serialises a value as JSON and writes it to the OCI image layout as a blob, returning its descriptor
+func WriteJsonBlob(imageDir string, mediaType string, value interface{}) (oci.Descriptor, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	return WriteBlob(imageDir, mediaType, data)
+}
+
+// Writes an image for the host platform to the OCI image layout, with a layer of the specified media type (uncompressed or gzip-compressed) for each of the specified uncompressed layer archives, returning the descriptor for the image manifest
+func CreateImage(imageDir string, mediaType string, archives [][]byte) (oci.Descriptor, error) {
+	return CreateImageForPlatform(imageDir, oci.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}, mediaType, archives)
+}
+
+// Writes an image for the specified platform to the OCI image layout, as per CreateImage()
+func CreateImageForPlatform(imageDir string, platform oci.Platform, mediaType string, archives [][]byte) (oci.Descriptor, error) {
+	if mediaType != oci.MediaTypeImageLayer && mediaType != oci.MediaTypeImageLayerGzip {
+		return oci.Descriptor{}, fmt.Errorf("unsupported layer media type %q", mediaType)
+	}
+	
+	// (The image configuration includes the variant field, which the version of oci.Image that we depend upon predates)
+	config := &struct {
+		oci.Image
+		Variant string `json:"variant,omitempty"`
+	}{
+		Image: oci.Image{OS: platform.OS, Architecture: platform.Architecture, RootFS: oci.RootFS{Type: "layers"}},
+		Variant: platform.Variant,
+	}
+	manifest := &oci.Manifest{Versioned: specs.Versioned{SchemaVersion: 2}}
+	for _, archive := range archives {
+		
+		// Compress the layer archive if required
+		blob := archive
+		if mediaType == oci.MediaTypeImageLayerGzip {
+			compressed := &bytes.Buffer{}
+			compressor := gzip.NewWriter(compressed)
+			if _, err := compressor.Write(archive); err != nil {
+				return oci.Descriptor{}, err
+			}
+			if err := compressor.Close(); err != nil {
+				return oci.Descriptor{}, err
+			}
+			blob = compressed.Bytes()
+		}
+		
+		// Write the layer blob and record its diff_id and history entry
+		descriptor, err := WriteBlob(imageDir, mediaType, blob)
+		if err != nil {
+			return oci.Descriptor{}, err
+		}
+		manifest.Layers = append(manifest.Layers, descriptor)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digest.FromBytes(archive))
+		config.History = append(config.History, oci.History{CreatedBy: "layer " + descriptor.Digest.Encoded()})
+	}
+	
+	// Write the image configuration and image manifest
+	configDescriptor, err := WriteJsonBlob(imageDir, oci.MediaTypeImageConfig, config)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	manifest.Config = configDescriptor
+	descriptor, err := WriteJsonBlob(imageDir, oci.MediaTypeImageManifest, manifest)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	descriptor.Platform = &platform
+	return descriptor, nil
+}
+
+// Writes the OCI index and layout marker for an OCI image layout containing the specified image manifests
+func WriteIndex(imageDir string, manifests []oci.Descriptor) error {
+	index, err := json.Marshal(&oci.Index{Versioned: specs.Versioned{SchemaVersion: 2}, Manifests: manifests})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, "index.json"), index, 0644); err != nil {
+		return err
+	}
+	
+	return os.WriteFile(filepath.Join(imageDir, oci.ImageLayoutFile), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+}
+
+// Creates an OCI image layout containing a single image for the host platform, with a layer of the specified media type for each of the specified uncompressed layer archives
+func CreateLayout(imageDir string, mediaType string, archives ...[]byte) (oci.Descriptor, error) {
+	descriptor, err := CreateImage(imageDir, mediaType, archives)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	
+	return descriptor, WriteIndex(imageDir, []oci.Descriptor{descriptor})
+}
@@ -1,27 +1,29 @@
 package testutil
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 
 	"github.com/macoscontainers/experiments/internal/filesystem"
-	"github.com/macoscontainers/experiments/internal/marshal"
+	"github.com/macoscontainers/experiments/internal/image"
 	oci "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // Represents a sample container image that can be used for testing purposes
 type SampleImage struct {
 	
-	// The absolute filesystem path to the directory that holds the OCI layout of our sample image
+	// The absolute filesystem path to the directory that holds our sample image and the files generated from it
 	RootDir string
 	
 	// The directory that contains our input Dockerfiles
 	DockerfilesDir string
 	
-	// The directory that will contain OCI image blobs
-	BlobsDir string
+	// The path to the `docker save` tarball for our sample image
+	ArchivePath string
 	
 	// The directory that will contain extracted filesystem layers
 	LayersDir string
@@ -40,7 +42,7 @@ func SampleImageForTest() (*SampleImage, error) {
 	return &SampleImage{
 		RootDir: rootDir,
 		DockerfilesDir: filepath.Dir(rootDir),
-		BlobsDir: filepath.Join(rootDir, "blobs", "sha256"),
+		ArchivePath: filepath.Join(rootDir, "sample.tar"),
 		LayersDir: filepath.Join(rootDir, "layers"),
 	}, nil
 }
@@ -53,10 +55,6 @@ func (sample *SampleImage) Exists() bool {
 // Generates our sample container image
 func (sample *SampleImage) Generate() error {
 	
-	// Generate the flags for the bind-mounts that we will use when running containers with Docker
-	hostdirMount := fmt.Sprintf("-v%s:/hostdir", sample.RootDir)
-	socketMount := "-v/var/run/docker.sock:/var/run/docker.sock"
-	
 	// Remove our output directory if it already exists
 	if sample.Exists() {
 		if err := os.RemoveAll(sample.RootDir); err != nil {
@@ -74,30 +72,26 @@ func (sample *SampleImage) Generate() error {
 		return err
 	}
 	
-	// Build the container image for skopeo
-	if err := DockerBuild("skopeo:latest", sample.DockerfilesDir, filepath.Join(sample.DockerfilesDir, "Dockerfile.skopeo")); err != nil {
-		return err
-	}
-	
 	// Build our sample container image
 	if err := DockerBuild("sample-layers:latest", sample.DockerfilesDir, filepath.Join(sample.DockerfilesDir, "Dockerfile")); err != nil {
 		return err
 	}
 	
-	// Use skopeo to copy the sample container image to an OCI directory layout
-	if err := DockerRun("skopeo:latest", []string{"copy", "docker-daemon:sample-layers:latest", "oci:/hostdir:latest"}, []string{hostdirMount, socketMount}); err != nil {
+	// Save the sample container image to a tarball
+	if err := DockerSave("sample-layers:latest", sample.ArchivePath); err != nil {
 		return err
 	}
 	
-	// Take ownership of the generated tarballs (since skopeo generates them as root)
-	alpineImage := "alpine:3.13.5"
-	if err := DockerRun(alpineImage, []string{"sh", "-c", fmt.Sprintf("chown -R %d:%d /hostdir", os.Getuid(), os.Getgid())}, []string{hostdirMount}); err != nil {
+	// Open the tarball as an OCI image layout
+	archive, err := image.OpenDockerArchive(sample.ArchivePath)
+	if err != nil {
 		return err
 	}
+	defer archive.Close()
 	
 	// Parse the OCI image index
 	index := &oci.Index{}
-	if err := marshal.UnmarshalJsonFile(filepath.Join(sample.RootDir, "index.json"), index); err != nil {
+	if err := readJsonFile(archive, "index.json", index); err != nil {
 		return err
 	}
 	
@@ -108,14 +102,13 @@ func (sample *SampleImage) Generate() error {
 	
 	// Parse the image manifest
 	manifest := &oci.Manifest{}
-	if err := marshal.UnmarshalJsonFile(filepath.Join(sample.BlobsDir, index.Manifests[0].Digest.Hex()), manifest); err != nil {
+	if err := readJsonFile(archive, blobPath(index.Manifests[0]), manifest); err != nil {
 		return err
 	}
 	
 	// Verify that the archive blob exists for each filesystem layer
 	for _, layer := range manifest.Layers {
-		archive := filepath.Join(sample.BlobsDir, layer.Digest.Hex())
-		if !filesystem.Exists(archive) {
+		if _, err := fs.Stat(archive, blobPath(layer)); err != nil {
 			return errors.New(fmt.Sprint("could not find archive blob for image layer with digest ", layer.Digest.Hex()))
 		}
 	}
@@ -133,3 +126,18 @@ func (sample *SampleImage) Generate() error {
 	
 	return nil
 }
+
+// Returns the path to the blob for a descriptor within an OCI image layout
+func blobPath(descriptor oci.Descriptor) string {
+	return fmt.Sprintf("blobs/%s/%s", descriptor.Digest.Algorithm(), descriptor.Digest.Encoded())
+}
+
+// Reads and parses a JSON file from an OCI image layout
+func readJsonFile(layout fs.FS, name string, out interface{}) error {
+	data, err := fs.ReadFile(layout, name)
+	if err != nil {
+		return err
+	}
+	
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/macoscontainers/experiments/internal/filesystem"
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/tests/testutil"
+	digest "github.com/opencontainers/go-digest"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Tests that layers whose uncompressed archives contain record padding and additional zero blocks after the end-of-archive marker pass diff_id verification
+func TestUnpackHashesTrailingPadding(t *testing.T) {
+	root := t.TempDir()
+	uid, gid := os.Getuid(), os.Getgid()
+	
+	// Create an archive and pad it to a multiple of the 10KiB record size used by GNU tar, followed by two further zero blocks
+	archive := createExtractTestArchive(t, []*tar.Header{
+		{Typeflag: tar.TypeReg, Name: "file", Mode: 0644, Uid: uid, Gid: gid, ModTime: time.Unix(1600000000, 0)},
+	}, map[string]string{"file": "contents"}).Bytes()
+	archive = append(archive, make([]byte, 10240 - len(archive) % 10240 + 1024)...)
+	
+	for _, mediaType := range []string{oci.MediaTypeImageLayer, oci.MediaTypeImageLayerGzip} {
+		
+		// Create an OCI image layout containing the padded layer
+		imageDir := filepath.Join(root, filepath.Base(mediaType), "image")
+		if _, err := testutil.CreateLayout(imageDir, mediaType, archive); err != nil {
+			t.Fatal(err)
+		}
+		
+		// Verify that the image unpacks, and that the diff_id covers the padding
+		unpacker, err := image.UnpackerForImage(imageDir, filepath.Join(root, filepath.Base(mediaType), "unpacked"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpacked, err := unpacker.Unpack(nil)
+		if err != nil {
+			t.Errorf("failed to unpack %s layer: %v", mediaType, err)
+			continue
+		}
+		if diffIDs := unpacked.Config.RootFS.DiffIDs; len(diffIDs) != 1 || diffIDs[0] != digest.FromBytes(archive) {
+			t.Errorf("unexpected diff_ids for unpacked %s image: %v", mediaType, diffIDs)
+		}
+	}
+}
+
+// Replaces the diff_id of the specified layer of an image, writing a new image configuration and image manifest and making the modified image the only image in the OCI index
+func replaceDiffID(t *testing.T, imageDir string, descriptor oci.Descriptor, index int, diffID digest.Digest) (*oci.Manifest, *oci.Image) {
+	manifest, err := testutil.ReadManifest(imageDir, descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &oci.Image{}
+	data, err := os.ReadFile(testutil.BlobPath(imageDir, manifest.Config.Digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		t.Fatal(err)
+	}
+	
+	config.RootFS.DiffIDs[index] = diffID
+	if manifest.Config, err = testutil.WriteJsonBlob(imageDir, oci.MediaTypeImageConfig, config); err != nil {
+		t.Fatal(err)
+	}
+	modified, err := testutil.WriteJsonBlob(imageDir, oci.MediaTypeImageManifest, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.WriteIndex(imageDir, []oci.Descriptor{modified}); err != nil {
+		t.Fatal(err)
+	}
+	
+	return manifest, config
+}
+
+// Tests that a layer whose uncompressed contents do not match its diff_id is rejected, and that nothing is left behind that could be mistaken for the layer
+func TestUnpackRejectsDiffIDMismatch(t *testing.T) {
+	root := t.TempDir()
+	archives := createCacheTestArchives(t, "first", "second")
+	
+	for _, mediaType := range []string{oci.MediaTypeImageLayer, oci.MediaTypeImageLayerGzip} {
+		
+		// Create an image and replace the diff_id of its second layer with the digest of different contents
+		imageDir := filepath.Join(root, filepath.Base(mediaType), "image")
+		descriptor, err := testutil.CreateImage(imageDir, mediaType, archives)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := digest.FromString("different contents")
+		manifest, config := replaceDiffID(t, imageDir, descriptor, 1, expected)
+		
+		// Verify that unpacking fails with an error describing the mismatch
+		unpacker, err := image.UnpackerForImage(imageDir, filepath.Join(root, filepath.Base(mediaType), "unpacked"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = unpacker.Unpack(nil)
+		mismatch := &image.DiffIDMismatchError{}
+		if !errors.As(err, &mismatch) {
+			t.Errorf("expected a diff_id mismatch for the %s layer, got: %v", mediaType, err)
+			continue
+		}
+		if mismatch.Layer != manifest.Layers[1].Digest || mismatch.Expected != expected || mismatch.Actual != digest.FromBytes(archives[1]) {
+			t.Errorf("unexpected details for the %s diff_id mismatch: %+v", mediaType, mismatch)
+		}
+		
+		// Verify that the valid first layer was committed, and that neither a layer directory nor a staging directory remains for the mismatched layer
+		chainIDs := image.ChainIDs(config.RootFS.DiffIDs)
+		if !filesystem.Exists(filepath.Join(unpacker.LayerDir(chainIDs[0]), image.LAYER_RECORD_FILENAME)) {
+			t.Errorf("expected the valid first %s layer to be committed", mediaType)
+		}
+		if filesystem.Exists(unpacker.LayerDir(chainIDs[1])) || filesystem.Exists(unpacker.StagingDir(chainIDs[1])) {
+			t.Errorf("expected nothing to remain for the mismatched %s layer", mediaType)
+		}
+	}
+}
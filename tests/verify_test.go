@@ -0,0 +1,95 @@
+package tests
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/tests/testutil"
+	digest "github.com/opencontainers/go-digest"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Tests that unpacking rejects layer and configuration blobs whose digest or size does not match their descriptor, naming the offending blob
+func TestUnpackRejectsCorruptedBlobs(t *testing.T) {
+	archive, err := testutil.CreateArchive([]testutil.ArchiveEntry{
+		{Type: tar.TypeReg, Name: "file", Contents: "contents"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	cases := []struct {
+		
+		// A description of the corruption
+		name string
+		
+		// Selects the blob to corrupt from the image manifest
+		blob func(manifest *oci.Manifest) digest.Digest
+		
+		// Corrupts the contents of the blob
+		corrupt func(data []byte) []byte
+	}{
+		{
+			name: "layer with modified contents",
+			blob: func(manifest *oci.Manifest) digest.Digest { return manifest.Layers[0].Digest },
+			corrupt: func(data []byte) []byte { data[len(data) - 1] ^= 0xff; return data },
+		},
+		{
+			name: "layer with extra data",
+			blob: func(manifest *oci.Manifest) digest.Digest { return manifest.Layers[0].Digest },
+			corrupt: func(data []byte) []byte { return append(data, 0) },
+		},
+		{
+			name: "truncated layer",
+			blob: func(manifest *oci.Manifest) digest.Digest { return manifest.Layers[0].Digest },
+			corrupt: func(data []byte) []byte { return data[:len(data) - 1] },
+		},
+		{
+			name: "configuration with modified contents",
+			blob: func(manifest *oci.Manifest) digest.Digest { return manifest.Config.Digest },
+			corrupt: func(data []byte) []byte { return []byte(strings.Replace(string(data), "layers", "LAYERS", 1)) },
+		},
+	}
+	
+	for _, testCase := range cases {
+		root := t.TempDir()
+		
+		// Create an OCI image layout and corrupt one of its blobs
+		imageDir := filepath.Join(root, "image")
+		descriptor, err := testutil.CreateLayout(imageDir, oci.MediaTypeImageLayerGzip, archive.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest, err := testutil.ReadManifest(imageDir, descriptor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		corrupted := testCase.blob(manifest)
+		data, err := os.ReadFile(testutil.BlobPath(imageDir, corrupted))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(testutil.BlobPath(imageDir, corrupted), testCase.corrupt(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		
+		// Verify that unpacking fails with an error that names the corrupted blob
+		unpacker, err := image.UnpackerForImage(imageDir, filepath.Join(root, "unpacked"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = unpacker.Unpack(nil)
+		var mismatch *image.BlobMismatchError
+		if !errors.As(err, &mismatch) || mismatch.Digest != corrupted {
+			t.Errorf("expected unpacking a %s to fail verification of blob %s, got: %v", testCase.name, corrupted, err)
+		} else if !strings.Contains(err.Error(), corrupted.String()) {
+			t.Errorf("expected the error for a %s to name blob %s, got: %v", testCase.name, corrupted, err)
+		}
+		unpacker.Close()
+	}
+}
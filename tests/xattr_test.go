@@ -0,0 +1,256 @@
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/macoscontainers/experiments/internal/filesystem"
+	"github.com/macoscontainers/experiments/internal/image"
+	"github.com/macoscontainers/experiments/internal/layer"
+	"github.com/macoscontainers/experiments/tests/testutil"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+)
+
+// Tests that extended attribute filters honour allowed and denied prefixes, and never include overrides
+func TestXattrFilter(t *testing.T) {
+	cases := []struct {
+		
+		// The filter to test
+		filter *layer.XattrFilter
+		
+		// The attribute names that the filter is expected to include or exclude
+		expected map[string]bool
+	}{
+		{
+			filter: &layer.XattrFilter{},
+			expected: map[string]bool{"user.test": true, "security.capability": true, "user.containers.override_stat": false},
+		},
+		{
+			filter: layer.ParseXattrFilter("user., security.selinux", "user.denied."),
+			expected: map[string]bool{"user.test": true, "user.denied.test": false, "security.selinux": true, "security.capability": false, "trusted.test": false},
+		},
+		{
+			filter: layer.ParseXattrFilter("", "security.,trusted."),
+			expected: map[string]bool{"user.test": true, "system.posix_acl_access": true, "security.capability": false, "trusted.test": false},
+		},
+	}
+	
+	for _, testCase := range cases {
+		for name, expected := range testCase.expected {
+			if actual := testCase.filter.Includes(name); actual != expected {
+				t.Errorf("expected filter %+v to include %s: %v, got %v", testCase.filter, name, expected, actual)
+			}
+		}
+	}
+	
+	// Empty specifications select the default filter
+	if filter := layer.ParseXattrFilter("", ""); filter != nil {
+		t.Errorf("expected empty specifications to produce a nil filter, got %+v", filter)
+	}
+}
+
+// Tests that extended attributes are extracted from PAX records, copied when diffs are applied and written back out when diffs are packed
+func TestXattrsSurviveExtractApplyAndPack(t *testing.T) {
+	root := t.TempDir()
+	if err := filesystem.SetXattr(root, "user.test", []byte("value")); filesystem.IsXattrUnsupported(err) {
+		t.Skip("the filesystem does not support user extended attributes")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Create an archive whose entries carry extended attributes, including ones that are denied and an attempt to forge an override
+	archive, err := testutil.CreateArchive([]testutil.ArchiveEntry{
+		{Type: tar.TypeDir, Name: "etc/", Xattrs: map[string]string{"user.dir": "directory"}},
+		{Type: tar.TypeReg, Name: "etc/file", Contents: "contents", Xattrs: map[string]string{
+			"user.test": "value",
+			"user.denied.test": "denied",
+			layer.OVERRIDE_STAT_XATTR: "0:0:4755:file",
+		}},
+		{Type: tar.TypeSymlink, Name: "etc/link", Linkname: "file", Xattrs: map[string]string{"user.link": "symlink"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Extract the archive
+	filter := &layer.XattrFilter{Deny: []string{"user.denied."}}
+	diffDir := filepath.Join(root, "diff")
+	extractor := &layer.LayerExtractor{DiffDir: diffDir, Xattrs: filter}
+	if err := extractor.Extract(archive); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verifies that a file holds exactly the expected values for the specified extended attributes (with nil representing an absent attribute)
+	assertXattrs := func(path string, expected map[string][]byte) {
+		for name, value := range expected {
+			if actual, err := filesystem.GetXattr(path, name); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(actual, value) {
+				t.Errorf("expected extended attribute %s of %s to be %q, got %q", name, path, value, actual)
+			}
+		}
+	}
+	
+	// Verify that the permitted attributes were extracted and the others were not
+	fileXattrs := map[string][]byte{"user.test": []byte("value"), "user.denied.test": nil, layer.OVERRIDE_STAT_XATTR: nil}
+	assertXattrs(filepath.Join(diffDir, "etc"), map[string][]byte{"user.dir": []byte("directory")})
+	assertXattrs(filepath.Join(diffDir, "etc", "file"), fileXattrs)
+	
+	// Apply the diff to an empty base layer and verify that the attributes were copied
+	baseDir := filepath.Join(root, "base")
+	mergedDir := filepath.Join(root, "merged")
+	for _, dir := range []string{baseDir, mergedDir} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	applier := &layer.DiffApplier{BaseDir: baseDir, DiffDir: diffDir, MergedDir: mergedDir}
+	if err := <-applier.ApplyRecursive("", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	assertXattrs(filepath.Join(mergedDir, "etc"), map[string][]byte{"user.dir": []byte("directory")})
+	assertXattrs(filepath.Join(mergedDir, "etc", "file"), fileXattrs)
+	
+	// Pack the diff and verify that the attributes were written as PAX records
+	packed := &bytes.Buffer{}
+	packer := &layer.LayerPacker{DiffDir: diffDir, Xattrs: filter}
+	if err := packer.Pack(packed); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string]string{
+		"etc/": {layer.PAX_XATTR_PREFIX + "user.dir": "directory"},
+		"etc/file": {layer.PAX_XATTR_PREFIX + "user.test": "value"},
+	}
+	reader := tar.NewReader(packed)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		
+		for key, value := range expected[header.Name] {
+			if header.PAXRecords[key] != value {
+				t.Errorf("expected PAX record %s of %s to be %q, got %q", key, header.Name, value, header.PAXRecords[key])
+			}
+		}
+		if _, exists := header.PAXRecords[layer.PAX_XATTR_PREFIX + layer.OVERRIDE_STAT_XATTR]; exists {
+			t.Errorf("expected no override to be packed for %s", header.Name)
+		}
+		delete(expected, header.Name)
+	}
+	if len(expected) != 0 {
+		t.Errorf("expected entries missing from the packed archive: %v", expected)
+	}
+}
+
+// Tests that only unsupported extended attributes are skipped, and that attributes the current user is not permitted to set are reported as errors unless the platform does not permit them on the type of file
+func TestXattrPermissionFailures(t *testing.T) {
+	
+	// Verify that permission failures are distinguished from unsupported attributes
+	if filesystem.IsXattrUnsupported(unix.EPERM) || !filesystem.IsXattrNotPermitted(unix.EPERM) {
+		t.Error("expected EPERM to indicate that an attribute is not permitted rather than unsupported")
+	}
+	for _, err := range []error{unix.ENOTSUP, unix.EOPNOTSUPP} {
+		if !filesystem.IsXattrUnsupported(err) || filesystem.IsXattrNotPermitted(err) {
+			t.Errorf("expected %v to indicate that an attribute is unsupported rather than not permitted", err)
+		}
+	}
+	
+	root := t.TempDir()
+	if err := filesystem.SetXattr(root, "user.test", []byte("value")); filesystem.IsXattrUnsupported(err) {
+		t.Skip("the filesystem does not support user extended attributes")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Verify that user attributes on symlinks are skipped, since Linux only permits them on regular files and directories
+	archive, err := testutil.CreateArchive([]testutil.ArchiveEntry{
+		{Type: tar.TypeReg, Name: "file", Contents: "contents"},
+		{Type: tar.TypeSymlink, Name: "link", Linkname: "file", Xattrs: map[string]string{"user.link": "symlink"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	extractor := &layer.LayerExtractor{DiffDir: filepath.Join(root, "symlink"), Xattrs: &layer.XattrFilter{}}
+	if err := extractor.Extract(archive); err != nil {
+		t.Errorf("expected user attributes on symlinks to be skipped, got: %v", err)
+	}
+	
+	// Attributes in the trusted namespace can only be set by privileged users
+	if os.Geteuid() == 0 {
+		t.Skip("privileged users are permitted to set attributes in the trusted namespace")
+	}
+	
+	// Verify that explicitly allowing an attribute that the current user is not permitted to set causes extraction to fail rather than silently dropping the attribute
+	archive, err = testutil.CreateArchive([]testutil.ArchiveEntry{
+		{Type: tar.TypeReg, Name: "file", Contents: "contents", Xattrs: map[string]string{"trusted.test": "value"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	extractor = &layer.LayerExtractor{DiffDir: filepath.Join(root, "trusted"), Xattrs: &layer.XattrFilter{Allow: []string{"trusted."}}}
+	if err := extractor.Extract(archive); !filesystem.IsXattrNotPermitted(err) {
+		t.Errorf("expected setting a trusted attribute without privileges to fail, got: %v", err)
+	}
+}
+
+// Tests that committing modified files directly requires the diff generator to use the same extended attribute filter as the unpacker
+func TestCommitModifiedRequiresMatchingXattrFilter(t *testing.T) {
+	root := t.TempDir()
+	imageDir := filepath.Join(root, "image")
+	archive, err := testutil.CreateArchive([]testutil.ArchiveEntry{{Type: tar.TypeReg, Name: "file", Contents: "contents"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testutil.CreateLayout(imageDir, oci.MediaTypeImageLayerGzip, archive.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Unpack the image with an explicit filter
+	unpacker, err := image.UnpackerForImage(imageDir, filepath.Join(root, "unpacked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacker.Xattrs = &layer.XattrFilter{Deny: []string{"user.denied."}}
+	base, err := unpacker.Unpack(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Create a modified file
+	modifiedDir := filepath.Join(root, "modified")
+	writeFileWithTime(t, filepath.Join(modifiedDir, "added"), "added", time.Unix(1600000000, 0))
+	
+	cases := []struct {
+		
+		// The filter used by the diff generator
+		filter *layer.XattrFilter
+		
+		// Whether the filter is expected to match the unpacker's filter
+		matches bool
+	}{
+		{filter: nil, matches: false},
+		{filter: &layer.XattrFilter{}, matches: false},
+		{filter: &layer.XattrFilter{Deny: []string{"user."}}, matches: false},
+		{filter: &layer.XattrFilter{Allow: []string{}, Deny: []string{"user.denied."}}, matches: true},
+	}
+	for _, testCase := range cases {
+		generator := &layer.DiffGenerator{BaseDir: base.Layers[len(base.Layers) - 1].MergedDir, ModifiedDir: modifiedDir, Xattrs: testCase.filter}
+		_, err := unpacker.CommitModified(context.Background(), base, generator, image.CommitOptions{})
+		if testCase.matches && err != nil {
+			t.Errorf("expected the filter %+v to match the unpacker's filter, got: %v", testCase.filter, err)
+		} else if !testCase.matches && err == nil {
+			t.Errorf("expected committing with the mismatched filter %+v to fail", testCase.filter)
+		}
+	}
+}